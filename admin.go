@@ -0,0 +1,257 @@
+package openidauth
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// adminAPI lets operators inspect and control the middleware at runtime.
+// It only answers requests from the loopback interface that send the Token
+// as a bearer token, or present a certificate verified by Caddy whose
+// subject common name is one of the Clients. A loopback address alone is
+// no proof, behind a sidecar or a proxy on the same host every request has
+// one:
+//
+//	GET    <path>/providers            the configured providers
+//	GET    <path>/cache                the cached documents and tokens
+//	DELETE <path>/cache/<name>         flushes jwks, tokens, introspection
+//	                                   or sessions
+//	GET    <path>/deny-list            see denyList.ServeAdmin
+//	POST   <path>/deny-list
+//	DELETE <path>/deny-list
+//	GET    <path>/sessions             see serveSessions
+//	DELETE <path>/sessions
+type adminAPI struct {
+	Path      string
+	Token     string
+	Clients   []string
+	Providers []providerConfig
+	Cache     *fetchCache
+	Tokens    validator
+	Storage   storage
+	DenyList  *denyList
+	Login     *loginHandler
+}
+
+// sessionInfo describes a login session in GET <path>/sessions.
+type sessionInfo struct {
+	ID       string    `json:"id"`
+	Created  time.Time `json:"created"`
+	LastSeen time.Time `json:"last_seen"`
+	Expires  time.Time `json:"expires"`
+	Sid      string    `json:"sid,omitempty"`
+}
+
+// cachedDocument describes an entry of the fetch cache.
+type cachedDocument struct {
+	URL     string    `json:"url"`
+	Fetched time.Time `json:"fetched"`
+}
+
+// cacheStats is the body of GET <path>/cache.
+type cacheStats struct {
+	Documents       []cachedDocument `json:"documents"`
+	ValidTokens     int              `json:"valid_tokens"`
+	MalformedTokens int              `json:"malformed_tokens"`
+}
+
+// matches reports whether the request is for the admin API.
+func (a *adminAPI) matches(r *http.Request) bool {
+	return a != nil && strings.HasPrefix(r.URL.Path, a.Path+"/")
+}
+
+// ServeHTTP answers the requests to the admin API.
+func (a *adminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return http.StatusForbidden, nil
+	}
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		return http.StatusUnauthorized, nil
+	}
+
+	switch resource := strings.TrimPrefix(r.URL.Path, a.Path); {
+	case resource == "/providers":
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			return http.StatusMethodNotAllowed, nil
+		}
+		return writeJSON(w, a.providers())
+	case resource == "/cache":
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			return http.StatusMethodNotAllowed, nil
+		}
+		return writeJSON(w, a.cacheStats())
+	case strings.HasPrefix(resource, "/cache/"):
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", "DELETE")
+			return http.StatusMethodNotAllowed, nil
+		}
+		n, ok, err := a.flush(strings.TrimPrefix(resource, "/cache/"))
+		if !ok {
+			return http.StatusNotFound, nil
+		}
+		if err != nil {
+			return http.StatusServiceUnavailable, err
+		}
+		return writeJSON(w, map[string]int{"flushed": n})
+	case resource == "/deny-list" && a.DenyList != nil:
+		return a.DenyList.ServeAdmin(w, r)
+	case resource == "/sessions" && a.Login != nil:
+		return a.serveSessions(w, r)
+	}
+	return http.StatusNotFound, nil
+}
+
+// authorized reports whether the request has the token or the certificate
+// of a client.
+func (a *adminAPI) authorized(r *http.Request) bool {
+	if a.Token != "" && strings.EqualFold(authorizationScheme(r), "Bearer") {
+		if token := bearerToken(r); subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) == 1 {
+			return true
+		}
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return containsString(a.Clients, r.TLS.VerifiedChains[0][0].Subject.CommonName)
+	}
+	return false
+}
+
+// serveSessions lists and ends the login sessions of a user, for example
+// when a device was stolen:
+//
+//	GET    <path>/sessions?sub=<sub>           the sessions of the user
+//	DELETE <path>/sessions?sub=<sub>           ends all of them
+//	DELETE <path>/sessions?sub=<sub>&id=<id>   ends one of them
+//
+// Only the sessions kept in the storage can be listed and ended one by one.
+// Ending all sessions of a user revokes them, which covers the sessions in
+// cookies as well.
+func (a *adminAPI) serveSessions(w http.ResponseWriter, r *http.Request) (int, error) {
+	q := r.URL.Query()
+	sub := q.Get("sub")
+	if sub == "" {
+		return http.StatusBadRequest, errors.New("openidauth: sub is missing")
+	}
+	store, _ := a.Login.Sessions.(*serverSessionStore)
+
+	switch r.Method {
+	case http.MethodGet:
+		if store == nil {
+			return http.StatusNotImplemented, nil
+		}
+		sessions, err := store.List(a.Login.Provider.Issuer, sub)
+		if err != nil {
+			return http.StatusServiceUnavailable, err
+		}
+		infos := make([]sessionInfo, 0, len(sessions))
+		for id, sess := range sessions {
+			sid, _ := sess.User.Claims["sid"].(string)
+			infos = append(infos, sessionInfo{
+				ID:       sessionHandle(id),
+				Created:  sess.Created,
+				LastSeen: sess.lastSeen(),
+				Expires:  sess.Expires,
+				Sid:      sid,
+			})
+		}
+		sort.Slice(infos, func(i, j int) bool { return infos[i].Created.Before(infos[j].Created) })
+		return writeJSON(w, infos)
+	case http.MethodDelete:
+		handle := q.Get("id")
+		if handle == "" {
+			if err := a.Login.Revocations.Revoke(sub, "", a.Login.retention()); err != nil {
+				return http.StatusServiceUnavailable, err
+			}
+		} else if store == nil {
+			return http.StatusNotImplemented, nil
+		}
+		if store != nil {
+			sessions, err := store.List(a.Login.Provider.Issuer, sub)
+			if err != nil {
+				return http.StatusServiceUnavailable, err
+			}
+			found := false
+			for id := range sessions {
+				if handle == "" || sessionHandle(id) == handle {
+					store.Delete(id)
+					found = true
+				}
+			}
+			if !found && handle != "" {
+				return http.StatusNotFound, nil
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return 0, nil
+	}
+	w.Header().Set("Allow", "GET, DELETE")
+	return http.StatusMethodNotAllowed, nil
+}
+
+// providers returns the configuration of the providers without their
+// secrets.
+func (a *adminAPI) providers() []providerConfig {
+	providers := make([]providerConfig, len(a.Providers))
+	for i, p := range a.Providers {
+		p.ClientSecret, p.ClientSecretFile = "", ""
+		providers[i] = p
+	}
+	return providers
+}
+
+func (a *adminAPI) cacheStats() cacheStats {
+	stats := cacheStats{Documents: []cachedDocument{}}
+	for url, fetched := range a.Cache.Entries() {
+		stats.Documents = append(stats.Documents, cachedDocument{URL: url, Fetched: fetched})
+	}
+	sort.Slice(stats.Documents, func(i, j int) bool {
+		return stats.Documents[i].URL < stats.Documents[j].URL
+	})
+	if c, ok := a.Tokens.(*cachingValidator); ok {
+		stats.ValidTokens, stats.MalformedTokens = c.Len()
+	}
+	return stats
+}
+
+// flush empties the named cache and returns the number of entries it had.
+// Flushing the sessions logs out all users. It reports false for unknown
+// caches.
+func (a *adminAPI) flush(name string) (int, bool, error) {
+	switch name {
+	case "jwks":
+		// The discovery documents are flushed with the JWKS, they may
+		// point at another one.
+		return a.Cache.Flush(), true, nil
+	case "tokens":
+		if c, ok := a.Tokens.(*cachingValidator); ok {
+			return c.Flush(), true, nil
+		}
+		return 0, true, nil
+	case "introspection":
+		n, err := a.Storage.DeletePrefix("introspection:")
+		return n, true, err
+	case "sessions":
+		n, err := a.Storage.DeletePrefix("session:")
+		return n, true, err
+	}
+	return 0, false, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) (int, error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(v)
+	return 0, nil
+}
@@ -0,0 +1,78 @@
+package openidauth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/emanoelxavier/openid2go/openid"
+)
+
+const (
+	// apiKeyHeader carries the static API keys.
+	apiKeyHeader = "X-API-Key"
+
+	// apiKeyIssuer is the issuer of the identities of API keys.
+	apiKeyIssuer = "api-key"
+
+	// tokenSourceAPIKey is the source of requests authenticated with an
+	// API key, like "session" for the session cookie.
+	tokenSourceAPIKey = "api_key"
+)
+
+// apiKey is a static key for clients that can't get a token, like CI
+// runners. Only the SHA-256 hash of the key is configured. Requests with
+// the key are authenticated as the user Name with the scopes.
+type apiKey struct {
+	Name   string   `json:"name"`
+	Hash   string   `json:"hash"`
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// parseAPIKey parses the arguments of an api_key directive:
+//
+//	api_key ci-runner 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+//	api_key deployer 2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae deploy:write
+func parseAPIKey(c Dispenser) (apiKey, error) {
+	args := c.RemainingArgs()
+	if len(args) < 2 {
+		return apiKey{}, c.ArgErr()
+	}
+	return apiKey{Name: args[0], Hash: strings.ToLower(args[1]), Scopes: args[2:]}, nil
+}
+
+// valid reports whether the hash is a hex encoded SHA-256 hash.
+func (k apiKey) valid() bool {
+	b, err := hex.DecodeString(k.Hash)
+	return err == nil && len(b) == sha256.Size
+}
+
+// authenticateAPIKey returns the identity of the API key in the request if
+// it is one of the keys the rule accepts. It returns nil if there is no API
+// key in the request.
+func authenticateAPIKey(r *http.Request, rule *pathRule, keys []apiKey) (*openid.User, error) {
+	if len(rule.APIKeys) == 0 {
+		return nil, nil
+	}
+	value := r.Header.Get(apiKeyHeader)
+	// The key is meant for the middleware, not for the backend.
+	r.Header.Del(apiKeyHeader)
+	if value == "" {
+		return nil, nil
+	}
+	sum := sha256.Sum256([]byte(value))
+	hash := hex.EncodeToString(sum[:])
+	for _, k := range keys {
+		if containsString(rule.APIKeys, k.Name) && subtle.ConstantTimeCompare([]byte(hash), []byte(k.Hash)) == 1 {
+			claims := map[string]interface{}{"iss": apiKeyIssuer, "sub": k.Name}
+			if len(k.Scopes) > 0 {
+				claims["scope"] = strings.Join(k.Scopes, " ")
+			}
+			return &openid.User{ID: k.Name, Issuer: apiKeyIssuer, Claims: claims}, nil
+		}
+	}
+	return nil, validationError(openid.ValidationErrorJwtValidationFailure, http.StatusUnauthorized,
+		"The API key is not valid", nil)
+}
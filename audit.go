@@ -0,0 +1,125 @@
+package openidauth
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/emanoelxavier/openid2go/openid"
+)
+
+// Decisions recorded in the audit log.
+const (
+	decisionAllow    = "allow"
+	decisionDeny     = "deny"
+	decisionRedirect = "redirect"
+	decisionBypass   = "bypass"
+)
+
+// auditEntry is one line in the audit log.
+type auditEntry struct {
+	Time      string `json:"ts"`
+	RequestID string `json:"request_id,omitempty"`
+	RemoteIP  string `json:"remote_ip"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Subject   string `json:"sub,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Source    string `json:"source,omitempty"`
+	Decision  string `json:"decision"`
+	Reason    string `json:"reason,omitempty"`
+	Shadow    bool   `json:"shadow,omitempty"`
+}
+
+// auditLogger writes a JSON line for every request to a protected path.
+// In shadow mode the entries are marked, their decision was not enforced.
+type auditLogger struct {
+	Shadow bool
+
+	mu   sync.Mutex
+	w    io.Writer
+	file *os.File
+}
+
+// newAuditLogger opens the audit log. The destination is stdout, stderr or
+// a file which is appended to.
+func newAuditLogger(dest string) (*auditLogger, error) {
+	switch dest {
+	case "stdout":
+		return &auditLogger{w: os.Stdout}, nil
+	case "stderr":
+		return &auditLogger{w: os.Stderr}, nil
+	}
+	f, err := os.OpenFile(dest, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLogger{w: f, file: f}, nil
+}
+
+// Log writes an entry for the request.
+func (l *auditLogger) Log(r *http.Request, source string, u *openid.User, decision string, err error) {
+	if l == nil {
+		return
+	}
+	entry := auditEntry{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		RequestID: requestID(r),
+		RemoteIP:  remoteIP(r),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Source:    source,
+		Decision:  decision,
+		Shadow:    l.Shadow,
+	}
+	if u != nil {
+		entry.Subject = u.ID
+		entry.Issuer = u.Issuer
+		entry.ClientID = clientID(u)
+	}
+	if err != nil {
+		entry.Reason = err.Error()
+	}
+
+	b, mErr := json.Marshal(entry)
+	if mErr != nil {
+		return
+	}
+	b = append(b, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(b)
+}
+
+// Close closes the log file, if the log is written to a file.
+func (l *auditLogger) Close() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// remoteIP returns the IP address of the client without the port.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientID returns the client the token was issued to. Access tokens carry
+// it in azp or client_id, ID tokens in aud.
+func clientID(u *openid.User) string {
+	for _, name := range []string{"azp", "client_id", "aud"} {
+		if s, ok := u.Claims[name].(string); ok && s != "" {
+			return s
+		}
+	}
+	return ""
+}
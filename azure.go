@@ -0,0 +1,218 @@
+package openidauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emanoelxavier/openid2go/openid"
+)
+
+const profileAzure = "azure"
+
+const (
+	azureV1Issuer = "https://sts.windows.net/"
+	azureV2Issuer = "https://login.microsoftonline.com/"
+	azureGraphURL = "https://graph.microsoft.com/v1.0/"
+
+	// The groups fetched from Microsoft Graph are remembered this long.
+	azureGroupsTTL = 10 * time.Minute
+	// At most this many users have their groups remembered.
+	maxAzureGroups = 10000
+)
+
+// azureIssuerAlias returns the issuer of the other token version of an Azure
+// AD tenant. v1.0 tokens are issued by https://sts.windows.net/{tenant}/,
+// v2.0 tokens by https://login.microsoftonline.com/{tenant}/v2.0, and which
+// one an API gets depends on its app registration rather than on the
+// client. It returns an empty string for other issuers.
+func azureIssuerAlias(issuer string) string {
+	switch {
+	case strings.HasPrefix(issuer, azureV2Issuer) && strings.HasSuffix(issuer, "/v2.0"):
+		tenant := strings.TrimSuffix(strings.TrimPrefix(issuer, azureV2Issuer), "/v2.0")
+		return azureV1Issuer + tenant + "/"
+	case strings.HasPrefix(issuer, azureV1Issuer):
+		tenant := strings.TrimSuffix(strings.TrimPrefix(issuer, azureV1Issuer), "/")
+		return azureV2Issuer + tenant + "/v2.0"
+	}
+	return ""
+}
+
+// azureProfile normalizes the claims of Azure AD tokens. v1.0 tokens carry
+// the user name in upn or unique_name, it is copied to preferred_username as
+// in v2.0 tokens. When a user is in too many groups to include them in the
+// token, Azure AD leaves out the groups claim and points to the Graph API
+// with _claim_names instead. The groups are then fetched from Microsoft
+// Graph with the client credentials of the provider, if it has a client
+// secret.
+type azureProfile struct {
+	Provider providerConfig
+	Client   *providerClient
+
+	mu     sync.Mutex
+	tokens map[string]*azureToken
+	groups map[string]*azureGroups
+}
+
+type azureToken struct {
+	AccessToken string
+	Expires     time.Time
+}
+
+type azureGroups struct {
+	Groups  []interface{}
+	Expires time.Time
+}
+
+func newAzureProfile(p providerConfig, client *providerClient) *azureProfile {
+	return &azureProfile{
+		Provider: p,
+		Client:   client,
+		tokens:   make(map[string]*azureToken),
+		groups:   make(map[string]*azureGroups),
+	}
+}
+
+// normalize completes the claims of the user.
+func (a *azureProfile) normalize(u *openid.User) error {
+	if _, ok := u.Claims["preferred_username"]; !ok {
+		for _, name := range []string{"upn", "unique_name"} {
+			if v, ok := u.Claims[name].(string); ok {
+				u.Claims["preferred_username"] = v
+				break
+			}
+		}
+	}
+
+	if !hasGroupsOverage(u.Claims) || !a.Provider.hasClientSecret() {
+		return nil
+	}
+	tenant, _ := u.Claims["tid"].(string)
+	oid, _ := u.Claims["oid"].(string)
+	if tenant == "" || oid == "" {
+		return nil
+	}
+	groups, err := a.memberGroups(tenant, oid)
+	if err != nil {
+		return validationError(openid.ValidationErrorJwtValidationFailure, http.StatusServiceUnavailable,
+			"Failed to get the groups of the user from Microsoft Graph", err)
+	}
+	u.Claims["groups"] = groups
+	return nil
+}
+
+// hasGroupsOverage reports whether the groups were left out of the token.
+func hasGroupsOverage(claims map[string]interface{}) bool {
+	if _, ok := claims["groups"]; ok {
+		return false
+	}
+	names, ok := claims["_claim_names"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	_, ok = names["groups"]
+	return ok
+}
+
+// memberGroups returns the ids of the groups the user is a member of.
+func (a *azureProfile) memberGroups(tenant, oid string) ([]interface{}, error) {
+	key := tenant + "/" + oid
+	a.mu.Lock()
+	cached, ok := a.groups[key]
+	a.mu.Unlock()
+	if ok && time.Now().Before(cached.Expires) {
+		return cached.Groups, nil
+	}
+
+	token, err := a.graphToken(tenant)
+	if err != nil {
+		return nil, err
+	}
+	body, _ := json.Marshal(map[string]bool{"securityEnabledOnly": false})
+	req, err := http.NewRequest(http.MethodPost, azureGraphURL+"users/"+url.PathEscape(oid)+"/getMemberObjects", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("openidauth: Microsoft Graph returned status %d", resp.StatusCode)
+	}
+	var result struct {
+		Value []interface{} `json:"value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if result.Value == nil {
+		result.Value = []interface{}{}
+	}
+
+	a.mu.Lock()
+	if len(a.groups) >= maxAzureGroups {
+		for k, g := range a.groups {
+			if time.Now().After(g.Expires) {
+				delete(a.groups, k)
+			}
+		}
+		if len(a.groups) >= maxAzureGroups {
+			a.groups = make(map[string]*azureGroups)
+		}
+	}
+	a.groups[key] = &azureGroups{Groups: result.Value, Expires: time.Now().Add(azureGroupsTTL)}
+	a.mu.Unlock()
+	return result.Value, nil
+}
+
+// graphToken returns an access token for Microsoft Graph in the tenant,
+// obtained with the client credentials grant.
+func (a *azureProfile) graphToken(tenant string) (string, error) {
+	a.mu.Lock()
+	cached, ok := a.tokens[tenant]
+	a.mu.Unlock()
+	if ok && time.Now().Before(cached.Expires) {
+		return cached.AccessToken, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {a.Provider.ClientIds[0]},
+		"client_secret": {a.Provider.clientSecret()},
+		"scope":         {"https://graph.microsoft.com/.default"},
+	}
+	endpoint := azureV2Issuer + url.PathEscape(tenant) + "/oauth2/v2.0/token"
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("openidauth: token endpoint returned status %d", resp.StatusCode)
+	}
+	tokens := &tokenResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(tokens); err != nil {
+		return "", err
+	}
+
+	// Renew the token a minute before it expires.
+	expires := time.Now().Add(time.Duration(tokens.ExpiresIn)*time.Second - time.Minute)
+	a.mu.Lock()
+	a.tokens[tenant] = &azureToken{AccessToken: tokens.AccessToken, Expires: expires}
+	a.mu.Unlock()
+	return tokens.AccessToken, nil
+}
@@ -0,0 +1,134 @@
+package openidauth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// The event a logout token must carry.
+const backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+// revocations remembers the users and sessions logged out through
+// back-channel logout. Sessions stored in encrypted cookies can't be deleted
+// on the server, so every session is checked against the list instead.
+type revocations struct {
+	Storage storage
+}
+
+// Revoke logs out the session with the sid, or if sid is empty all sessions
+// of the subject created until now. Entries are forgotten after retention,
+// when the sessions they refer to have expired anyway.
+func (rv *revocations) Revoke(sub, sid string, retention time.Duration) error {
+	key := "revoked:sub:" + sub
+	if sid != "" {
+		key = "revoked:sid:" + sid
+	}
+	now, err := time.Now().MarshalText()
+	if err != nil {
+		return err
+	}
+	return rv.Storage.Set(key, now, retention)
+}
+
+// Revoked reports whether the session has been logged out.
+func (rv *revocations) Revoked(sess *session) bool {
+	if sid, _ := sess.User.Claims["sid"].(string); sid != "" {
+		if value, _ := rv.Storage.Get("revoked:sid:" + sid); value != nil {
+			return true
+		}
+	}
+	value, _ := rv.Storage.Get("revoked:sub:" + sess.User.ID)
+	if value == nil {
+		return false
+	}
+	var t time.Time
+	return t.UnmarshalText(value) != nil || !sess.Created.After(t)
+}
+
+// ServeBackchannelLogout implements OpenID Connect Back-Channel Logout. The
+// provider posts a logout token, which is validated like an ID token, and
+// the sessions it refers to are ended.
+func (l *loginHandler) ServeBackchannelLogout(w http.ResponseWriter, r *http.Request) (int, error) {
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	sub, sid, err := l.validateLogoutToken(r.PostFormValue("logout_token"))
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error":             "invalid_request",
+			"error_description": err.Error(),
+		})
+		return 0, err
+	}
+
+	if err := l.Revocations.Revoke(sub, sid, l.retention()); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	w.WriteHeader(http.StatusOK)
+	return 0, nil
+}
+
+// validateLogoutToken checks a logout token and returns the subject and
+// session id it refers to. Each token is accepted once, its jti is kept
+// until the token expires.
+func (l *loginHandler) validateLogoutToken(token string) (string, string, error) {
+	if token == "" {
+		return "", "", errors.New("logout_token is missing")
+	}
+	u, err := l.Validator.ValidateLogoutToken(token)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Issuer != l.Provider.Issuer {
+		return "", "", errors.New("logout_token is from another issuer")
+	}
+	events, ok := u.Claims["events"].(map[string]interface{})
+	if !ok {
+		return "", "", errors.New("logout_token is missing events")
+	}
+	if _, ok := events[backchannelLogoutEvent]; !ok {
+		return "", "", errors.New("logout_token is missing the back-channel logout event")
+	}
+	if _, ok := u.Claims["nonce"]; ok {
+		return "", "", errors.New("logout_token must not contain a nonce")
+	}
+	if _, ok := u.Claims["iat"]; !ok {
+		return "", "", errors.New("logout_token is missing iat")
+	}
+	sid, _ := u.Claims["sid"].(string)
+	if u.ID == "" && sid == "" {
+		return "", "", errors.New("logout_token must contain sub or sid")
+	}
+	jti, _ := u.Claims["jti"].(string)
+	if jti == "" {
+		return "", "", errors.New("logout_token is missing jti")
+	}
+	ttl := l.retention()
+	if exp := claimTime(u.Claims["exp"]); !exp.IsZero() {
+		ttl = time.Until(exp) + l.Validator.Leeway
+	}
+	first, err := l.Storage.SetIfAbsent("logout:"+u.Issuer+" "+jti, []byte{1}, ttl)
+	if err != nil {
+		return "", "", err
+	}
+	if !first {
+		return "", "", errors.New("logout_token has been used before")
+	}
+	return u.ID, sid, nil
+}
+
+// retention returns how long a revocation must be remembered, the longest
+// time a session can be used.
+func (l *loginHandler) retention() time.Duration {
+	if l.Lifetime > defaultSessionLifetime {
+		return l.Lifetime + refreshWindow
+	}
+	return defaultSessionLifetime + refreshWindow
+}
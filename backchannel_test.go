@@ -0,0 +1,56 @@
+package openidauth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateLogoutToken(t *testing.T) {
+	rsaKey, _, _ := generateKeys(t)
+	l := &loginHandler{
+		Provider:  providerConfig{Issuer: "https://issuer.example.com"},
+		Validator: newTestValidator(t, rsaKey),
+		Storage:   newMemoryStorage(),
+	}
+	logoutToken := func(typ string, changes ...interface{}) string {
+		claims := testClaims(append([]interface{}{
+			"iat", time.Now().Unix(),
+			"jti", "j1",
+			"sid", "s1",
+			"events", map[string]interface{}{backchannelLogoutEvent: map[string]interface{}{}},
+		}, changes...)...)
+		token, err := encodeJWT(jwtHeader{Alg: "RS256", Kid: "k1", Typ: typ}, claims, rsaKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	// The session ID is enough, sub is optional.
+	sub, sid, err := l.validateLogoutToken(logoutToken("logout+jwt", "sub", nil))
+	if err != nil || sub != "" || sid != "s1" {
+		t.Errorf("sid-only logout token: got %q, %q, %v", sub, sid, err)
+	}
+	sub, sid, err = l.validateLogoutToken(logoutToken("", "jti", "j2", "sid", nil))
+	if err != nil || sub != "user" || sid != "" {
+		t.Errorf("sub-only logout token: got %q, %q, %v", sub, sid, err)
+	}
+
+	invalid := map[string]string{
+		"replayed":             logoutToken("logout+jwt", "sub", nil),
+		"without sub and sid":  logoutToken("logout+jwt", "jti", "j3", "sub", nil, "sid", nil),
+		"without events":       logoutToken("logout+jwt", "jti", "j4", "events", nil),
+		"without the event":    logoutToken("logout+jwt", "jti", "j5", "events", map[string]interface{}{}),
+		"without jti":          logoutToken("logout+jwt", "jti", nil),
+		"with a nonce":         logoutToken("logout+jwt", "jti", "j6", "nonce", "n"),
+		"of another type":      logoutToken("JWT", "jti", "j7"),
+		"without iat":          logoutToken("logout+jwt", "jti", "j8", "iat", nil),
+		"from another issuer":  logoutToken("logout+jwt", "jti", "j9", "iss", "https://api.example.com"),
+		"for another audience": logoutToken("logout+jwt", "jti", "j10", "aud", "other"),
+	}
+	for name, token := range invalid {
+		if _, _, err := l.validateLogoutToken(token); err == nil {
+			t.Errorf("logout token %s accepted", name)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package openidauth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emanoelxavier/openid2go/openid"
+)
+
+const (
+	grantTypePassword = "password"
+
+	// tokenSourceBasic is the source of the tokens the middleware obtains
+	// for Basic credentials.
+	tokenSourceBasic = "basic"
+
+	// defaultBasicRealm is the realm of the Basic challenge if no realm is
+	// configured.
+	defaultBasicRealm = "openidauth"
+
+	// basicKeyName is the storage key of the secret the credentials are
+	// keyed with, shared by the Caddy instances.
+	basicKeyName = "basic_key"
+)
+
+// basicBridge lets clients that only know Basic authentication use the
+// protected paths. Their user name and password are exchanged for a token
+// with the resource owner password grant at the token endpoint of Provider,
+// or at Endpoint if it is set. The tokens are kept in Storage per
+// credentials until shortly before they expire, so the provider only sees
+// the first request of every client, and are validated and authorized like
+// the tokens clients send. Neither the credentials nor the tokens can be
+// read from the storage, the tokens are encrypted and stored under keys
+// derived from an HMAC of the credentials with a random secret.
+type basicBridge struct {
+	Provider  providerConfig
+	Endpoint  string
+	Discovery *discovery
+	Storage   storage
+	Client    *providerClient
+
+	mu  sync.Mutex
+	key []byte
+}
+
+func newBasicBridge(provider providerConfig, endpoint string, cache *fetchCache, store storage) *basicBridge {
+	if endpoint == introspectionDiscovery {
+		endpoint = ""
+	}
+	return &basicBridge{
+		Provider:  provider,
+		Endpoint:  endpoint,
+		Discovery: newDiscovery(provider, cache),
+		Storage:   store,
+		Client:    cache.Client,
+	}
+}
+
+// token returns a token for the Basic credentials of the request. Found is
+// false if the request has none.
+func (b *basicBridge) token(r *http.Request) (token string, found bool, err error) {
+	if b == nil {
+		return "", false, nil
+	}
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return "", false, nil
+	}
+	key, sealer, err := b.credentialsKey(username, password)
+	if err != nil {
+		return "", true, &openid.ValidationError{
+			Code:       openid.ValidationErrorGetOpenIdConfigurationFailure,
+			Message:    "No token could be obtained for the credentials",
+			Err:        err,
+			HTTPStatus: http.StatusServiceUnavailable,
+		}
+	}
+	if value, err := b.Storage.Get(key); err == nil && value != nil {
+		if token := sealer.open(string(value)); token != nil {
+			return string(token), true, nil
+		}
+	}
+
+	tokens, status, err := b.post(username, password)
+	if err != nil {
+		if status == http.StatusBadRequest || status == http.StatusUnauthorized {
+			return "", true, validationError(openid.ValidationErrorJwtValidationFailure, http.StatusUnauthorized,
+				"The user name or password is not valid", nil)
+		}
+		return "", true, &openid.ValidationError{
+			Code:       openid.ValidationErrorGetOpenIdConfigurationFailure,
+			Message:    "No token could be obtained for the credentials",
+			Err:        err,
+			HTTPStatus: http.StatusServiceUnavailable,
+		}
+	}
+	if ttl := time.Duration(tokens.ExpiresIn)*time.Second - tokenExchangeMargin; ttl > 0 {
+		if sealed, err := sealer.seal([]byte(tokens.AccessToken)); err == nil {
+			b.Storage.Set(key, []byte(sealed), ttl)
+		}
+	}
+	return tokens.AccessToken, true, nil
+}
+
+// credentialsKey returns the storage key of the token for the credentials,
+// and the sealer the token is encrypted with. Both are derived from the
+// HMAC of the credentials, the key can't be traced back to them and only
+// requests with the same credentials can decrypt the token.
+func (b *basicBridge) credentialsKey(username, password string) (string, *sealer, error) {
+	secret, err := b.secret()
+	if err != nil {
+		return "", nil, err
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(username + "\x00" + password))
+	sum := mac.Sum(nil)
+	sealer, err := newSealer(sum, sealBasicToken)
+	if err != nil {
+		return "", nil, err
+	}
+	id := sha256.Sum256(sum)
+	return "basic:" + hex.EncodeToString(id[:]), sealer, nil
+}
+
+// secret returns the random secret the credentials are keyed with. It is
+// created by the first Caddy instance that needs it and kept in Storage,
+// so the instances find each other's tokens.
+func (b *basicBridge) secret() ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.key != nil {
+		return b.key, nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err := b.Storage.SetIfAbsent(basicKeyName, key, 0); err != nil {
+		return nil, err
+	}
+	stored, err := b.Storage.Get(basicKeyName)
+	if err != nil {
+		return nil, err
+	}
+	if len(stored) != len(key) {
+		return nil, fmt.Errorf("openidauth: invalid %s in the storage", basicKeyName)
+	}
+	b.key = stored
+	return b.key, nil
+}
+
+// post sends the password grant request to the token endpoint. The status
+// is that of the response, or 0 if there was none.
+func (b *basicBridge) post(username, password string) (*tokenResponse, int, error) {
+	endpoint := b.Endpoint
+	if endpoint == "" {
+		doc, err := b.Discovery.Document()
+		if err != nil {
+			return nil, 0, err
+		}
+		if doc.TokenEndpoint == "" {
+			return nil, 0, fmt.Errorf("openidauth: issuer %s has no token endpoint", b.Provider.Issuer)
+		}
+		endpoint = doc.TokenEndpoint
+	}
+
+	form := url.Values{
+		"grant_type": {grantTypePassword},
+		"username":   {username},
+		"password":   {password},
+		"scope":      {"openid"},
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(b.Provider.ClientIds[0]), url.QueryEscape(b.Provider.clientSecret()))
+
+	resp, err := b.Client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode, fmt.Errorf("openidauth: token endpoint returned status %d", resp.StatusCode)
+	}
+	tokens := &tokenResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(tokens); err != nil {
+		return nil, resp.StatusCode, err
+	}
+	if tokens.AccessToken == "" {
+		return nil, resp.StatusCode, fmt.Errorf("openidauth: token endpoint returned no access token")
+	}
+	return tokens, resp.StatusCode, nil
+}
+
+// challenge adds the Basic challenge to a 401 response, clients that only
+// know Basic authentication don't send their credentials without it.
+func (b *basicBridge) challenge(w http.ResponseWriter, er *errorResponder) {
+	if b == nil {
+		return
+	}
+	var extra []authParam
+	if er == nil || er.Realm == "" {
+		extra = append(extra, authParam{"realm", defaultBasicRealm})
+	}
+	er.challenge(w, "Basic", "", "", append(extra, authParam{"charset", "UTF-8"})...)
+}
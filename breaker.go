@@ -0,0 +1,115 @@
+package openidauth
+
+import (
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/emanoelxavier/openid2go/openid"
+)
+
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// What to do with requests while the providers are unavailable.
+const (
+	outageFailOpen   = "fail_open"
+	outageFailClosed = "fail_closed"
+)
+
+// errCircuitOpen is returned instead of calling a provider that is down.
+var errCircuitOpen = errors.New("openidauth: provider is unavailable, circuit breaker is open")
+
+// circuitBreaker stops calling a provider after Threshold consecutive
+// failures. After the cooldown one call is let through to probe whether the
+// provider is back, which closes the circuit again if it succeeds.
+type circuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// allow reports whether a call may be made.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.Threshold {
+		return true
+	}
+	if b.probing || time.Since(b.openedAt) < b.Cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// done records the outcome of a call.
+func (b *circuitBreaker) done(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.Threshold {
+		b.openedAt = time.Now()
+	}
+}
+
+// providerUnavailable reports whether validation failed because a provider
+// could not be reached, rather than because of the token.
+func providerUnavailable(err error) bool {
+	verr, ok := err.(*openid.ValidationError)
+	return ok && (verr.Code == openid.ValidationErrorGetOpenIdConfigurationFailure ||
+		verr.Code == openid.ValidationErrorGetJwksFailure)
+}
+
+// breakers holds a circuit breaker for every host the middleware talks to,
+// so one provider being down doesn't affect the others.
+type breakers struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*circuitBreaker
+}
+
+func newBreakers(threshold int, cooldown time.Duration) *breakers {
+	return &breakers{Threshold: threshold, Cooldown: cooldown, hosts: make(map[string]*circuitBreaker)}
+}
+
+// Call calls fn, which talks to the server at rawurl, unless the circuit of
+// the server is open.
+func (b *breakers) Call(rawurl string, fn func() error) error {
+	if b == nil {
+		return fn()
+	}
+	host := rawurl
+	if u, err := url.Parse(rawurl); err == nil {
+		host = u.Host
+	}
+
+	b.mu.Lock()
+	cb, ok := b.hosts[host]
+	if !ok {
+		cb = &circuitBreaker{Threshold: b.Threshold, Cooldown: b.Cooldown}
+		b.hosts[host] = cb
+	}
+	b.mu.Unlock()
+
+	if !cb.allow() {
+		return errCircuitOpen
+	}
+	err := fn()
+	cb.done(err)
+	return err
+}
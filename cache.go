@@ -0,0 +1,182 @@
+package openidauth
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultCacheTTL = time.Hour
+
+// cacheEntry is a cached response body.
+type cacheEntry struct {
+	Body    []byte
+	Fetched time.Time
+}
+
+// fetchCache caches the documents fetched from the providers, the discovery
+// documents and the JWKS. Entries older than the TTL are fetched again, but
+// if that fails the old entry is used so that tokens can still be validated
+// during short outages of the provider. A background refresh keeps entries
+// fresh so requests rarely have to wait for the provider.
+type fetchCache struct {
+	TTL    time.Duration
+	Client *providerClient
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	stop    chan struct{}
+}
+
+func newFetchCache(ttl time.Duration, client *providerClient) *fetchCache {
+	return &fetchCache{TTL: ttl, Client: client, entries: make(map[string]*cacheEntry)}
+}
+
+// Get returns the body of the document at url.
+func (c *fetchCache) Get(url string) ([]byte, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[url]
+	c.mu.Unlock()
+	if ok && time.Since(entry.Fetched) < c.TTL {
+		return entry.Body, nil
+	}
+
+	body, err := c.fetch(url)
+	if err != nil {
+		if ok {
+			// Serve the stale entry rather than failing.
+			return entry.Body, nil
+		}
+		return nil, err
+	}
+	return body, nil
+}
+
+// Refresh fetches the document at url again, regardless of its age.
+func (c *fetchCache) Refresh(url string) ([]byte, error) {
+	return c.fetch(url)
+}
+
+// HTTPGet fulfils openid.HTTPGetFunc so that the openid package reads
+// through the cache.
+func (c *fetchCache) HTTPGet(r *http.Request, url string) (*http.Response, error) {
+	body, err := c.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       r,
+	}, nil
+}
+
+// fetch downloads the document and stores it in the cache.
+func (c *fetchCache) fetch(url string) ([]byte, error) {
+	span := startFetchSpan(url)
+	start := time.Now()
+	body, err := c.Client.Get(url)
+	observeFetch(time.Since(start), err)
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.entries[url] = &cacheEntry{Body: body, Fetched: time.Now()}
+	c.mu.Unlock()
+	return body, nil
+}
+
+// Entries returns the URLs of the cached documents and when they were
+// fetched.
+func (c *fetchCache) Entries() map[string]time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries := make(map[string]time.Time, len(c.entries))
+	for url, entry := range c.entries {
+		entries[url] = entry.Fetched
+	}
+	return entries
+}
+
+// Remove forgets the documents at the urls, they are no longer refreshed.
+func (c *fetchCache) Remove(urls ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, url := range urls {
+		delete(c.entries, url)
+	}
+}
+
+// Flush forgets all the documents, they are fetched again when they are
+// needed.
+func (c *fetchCache) Flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.entries)
+	c.entries = make(map[string]*cacheEntry)
+	return n
+}
+
+// Start refreshes the cached documents in the background until Stop is
+// called. Entries are refreshed when they have reached 80% of the TTL.
+func (c *fetchCache) Start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stop != nil {
+		return
+	}
+	c.stop = make(chan struct{})
+
+	interval := c.TTL / 5
+	if interval < time.Second {
+		interval = time.Second
+	}
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				c.refresh()
+			}
+		}
+	}(c.stop)
+}
+
+// Stop ends the background refresh.
+func (c *fetchCache) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+}
+
+func (c *fetchCache) refresh() {
+	var urls []string
+	c.mu.Lock()
+	for url, entry := range c.entries {
+		if time.Since(entry.Fetched) >= c.TTL*4/5 {
+			urls = append(urls, url)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, url := range urls {
+		// Errors are ignored, the old entry stays until the next attempt.
+		c.fetch(url)
+	}
+}
@@ -0,0 +1,83 @@
+// Package caddy1 registers the openidauth middleware as a Caddy v1 plugin.
+//
+// Import it in run.go of your Caddy v1 build:
+//
+//	import _ "github.com/greenpau/openidauth/caddy1"
+package caddy1
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/greenpau/openidauth"
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("openidauth", caddy.Plugin{
+		ServerType: "http",
+		Action:     Setup,
+	})
+}
+
+// Setup sets up the middleware
+func Setup(c *caddy.Controller) error {
+	openidauth.CaseSensitivePath = httpserver.CaseSensitivePath
+	cfg, err := openidauth.ParseCaddyfile(c)
+	if err != nil {
+		return err
+	}
+
+	m, err := openidauth.New(cfg, nil)
+	if err != nil {
+		return err
+	}
+
+	c.OnStartup(func() error {
+		fmt.Println("Initiating OpenID Connect autentication middleware")
+		return m.Start()
+	})
+	c.OnShutdown(m.Stop)
+
+	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		return handler{m.WithNext(remoteUser{next})}
+	})
+	fmt.Println("OpenID Connect autentication middleware successfully initiated")
+
+	return nil
+}
+
+// handler passes the replacer of Caddy v1 on to the middleware, which sets
+// the claims as placeholders through it.
+type handler struct {
+	m *openidauth.Middleware
+}
+
+func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	if repl, ok := r.Context().Value(httpserver.ReplacerCtxKey).(httpserver.Replacer); ok {
+		r = r.WithContext(context.WithValue(r.Context(), openidauth.ReplacerCtxKey, repl))
+	}
+	return h.m.ServeHTTP(w, r)
+}
+
+// remoteUser makes the subject of the authenticated user the {user}
+// placeholder of Caddy v1.
+type remoteUser struct {
+	next httpserver.Handler
+}
+
+func (u remoteUser) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	if id, ok := r.Context().Value(openidauth.RemoteUserCtxKey).(string); ok {
+		r = r.WithContext(context.WithValue(r.Context(), httpserver.RemoteUserCtxKey, id))
+	}
+	return u.next.ServeHTTP(w, r)
+}
+
+// Interface guards
+var (
+	_ openidauth.Dispenser = (*caddy.Controller)(nil)
+	_ openidauth.Replacer  = httpserver.Replacer(nil)
+	_ openidauth.Handler   = httpserver.Handler(nil)
+)
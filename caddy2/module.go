@@ -0,0 +1,155 @@
+// Package caddy2 provides the openidauth middleware as a Caddy v2 HTTP
+// handler module.
+//
+// Import it in your Caddy v2 build:
+//
+//	import _ "github.com/greenpau/openidauth/caddy2"
+//
+// The Caddyfile syntax is the same as for Caddy v1. As with any third
+// party handler, the directive needs to be ordered in the global options,
+// e.g. "order openidauth before reverse_proxy".
+package caddy2
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/greenpau/openidauth"
+)
+
+func init() {
+	caddy.RegisterModule(OpenIDAuth{})
+	httpcaddyfile.RegisterHandlerDirective("openidauth", parseCaddyfile)
+}
+
+// OpenIDAuth validates OpenID Connect tokens before passing requests on to
+// the next handler. The JSON configuration has the same settings as the
+// openidauth Caddyfile block.
+type OpenIDAuth struct {
+	openidauth.Config
+
+	m *openidauth.Middleware
+}
+
+// CaddyModule returns the Caddy module information.
+func (OpenIDAuth) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.openidauth",
+		New: func() caddy.Module { return new(OpenIDAuth) },
+	}
+}
+
+// Provision sets up the middleware. With "storage caddy" its state is
+// kept in the storage of Caddy.
+func (a *OpenIDAuth) Provision(ctx caddy.Context) error {
+	if a.Config.Storage == "caddy" {
+		a.Config.StorageBackend = caddyStorage{Storage: ctx.Storage()}
+	}
+	m, err := openidauth.New(&a.Config, openidauth.HandlerFunc(serveNext))
+	if err != nil {
+		return err
+	}
+	if err := m.Start(); err != nil {
+		return err
+	}
+	a.m = m
+	return nil
+}
+
+// Cleanup stops the middleware.
+func (a *OpenIDAuth) Cleanup() error {
+	if a.m == nil {
+		return nil
+	}
+	return a.m.Stop()
+}
+
+type nextCallKey struct{}
+
+// nextCall carries the next handler of a request through the Caddy v1 style
+// middleware, and the result of calling it back out.
+type nextCall struct {
+	Next   caddyhttp.Handler
+	Called bool
+	Err    error
+}
+
+// serveNext is the next handler of the middleware. It calls the Caddy v2
+// handler that was passed for the request.
+func serveNext(w http.ResponseWriter, r *http.Request) (int, error) {
+	call := r.Context().Value(nextCallKey{}).(*nextCall)
+	call.Called = true
+	call.Err = call.Next.ServeHTTP(w, r)
+	return 0, nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (a *OpenIDAuth) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	call := &nextCall{Next: next}
+	ctx := context.WithValue(r.Context(), nextCallKey{}, call)
+	if repl, ok := ctx.Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		ctx = context.WithValue(ctx, openidauth.ReplacerCtxKey, replacer{repl})
+	}
+	r = r.WithContext(ctx)
+
+	status, err := a.m.ServeHTTP(w, r)
+	if call.Called {
+		return call.Err
+	}
+	if status >= 400 {
+		// Caddy v1 handlers leave writing the error to the server.
+		return caddyhttp.Error(status, err)
+	}
+	// The middleware has written the response.
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens.
+func (a *OpenIDAuth) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	cfg, err := openidauth.ParseCaddyfile(dispenser{d})
+	if err != nil {
+		return err
+	}
+	a.Config = *cfg
+	return nil
+}
+
+func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	a := new(OpenIDAuth)
+	err := a.UnmarshalCaddyfile(h.Dispenser)
+	return a, err
+}
+
+// dispenser adapts the Caddy v2 dispenser to the one the parser expects.
+type dispenser struct {
+	*caddyfile.Dispenser
+}
+
+// NextBlock reads the next line of the openidauth block.
+func (d dispenser) NextBlock() bool {
+	return d.Dispenser.NextBlock(0)
+}
+
+// replacer adapts the Caddy v2 replacer to the one of the middleware, so
+// that the claims are available as {openid.claims.*} placeholders.
+type replacer struct {
+	repl *caddy.Replacer
+}
+
+func (r replacer) Set(key, value string) {
+	r.repl.Set(key, value)
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*OpenIDAuth)(nil)
+	_ caddy.CleanerUpper          = (*OpenIDAuth)(nil)
+	_ caddyhttp.MiddlewareHandler = (*OpenIDAuth)(nil)
+	_ caddyfile.Unmarshaler       = (*OpenIDAuth)(nil)
+	_ openidauth.Dispenser        = dispenser{}
+	_ openidauth.Replacer         = replacer{}
+)
@@ -0,0 +1,129 @@
+package caddy2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// storagePrefix is the directory of the state of the middleware in the
+// storage of Caddy.
+const storagePrefix = "openidauth"
+
+// caddyStorage keeps the state of the middleware in the storage of Caddy,
+// which the instances of a cluster share if it is a database or a shared
+// file system. The storage has no expiry: the values are stored with their
+// expiry time, and expired ones are deleted when they are read.
+type caddyStorage struct {
+	Storage certmagic.Storage
+}
+
+type storageItem struct {
+	Value   []byte    `json:"value"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+func (s caddyStorage) path(key string) string {
+	return path.Join(storagePrefix, url.QueryEscape(key))
+}
+
+func (s caddyStorage) Get(key string) ([]byte, error) {
+	data, err := s.Storage.Load(context.Background(), s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	item := storageItem{}
+	if err := json.Unmarshal(data, &item); err != nil {
+		return nil, err
+	}
+	if !item.Expires.IsZero() && time.Now().After(item.Expires) {
+		return nil, s.Delete(key)
+	}
+	return item.Value, nil
+}
+
+func (s caddyStorage) Set(key string, value []byte, ttl time.Duration) error {
+	item := storageItem{Value: value}
+	if ttl > 0 {
+		item.Expires = time.Now().Add(ttl)
+	}
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return s.Storage.Store(context.Background(), s.path(key), data)
+}
+
+// SetIfAbsent stores the value under the lock of the key if there is none.
+func (s caddyStorage) SetIfAbsent(key string, value []byte, ttl time.Duration) (bool, error) {
+	ctx := context.Background()
+	if err := s.Storage.Lock(ctx, s.path(key)); err != nil {
+		return false, err
+	}
+	defer s.Storage.Unlock(ctx, s.path(key))
+	existing, err := s.Get(key)
+	if err != nil || existing != nil {
+		return false, err
+	}
+	return true, s.Set(key, value, ttl)
+}
+
+// Take reads and deletes the value under the lock of the key, so that of
+// the instances of a cluster only one gets it.
+func (s caddyStorage) Take(key string) ([]byte, error) {
+	ctx := context.Background()
+	if err := s.Storage.Lock(ctx, s.path(key)); err != nil {
+		return nil, err
+	}
+	defer s.Storage.Unlock(ctx, s.path(key))
+	value, err := s.Get(key)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	return value, s.Delete(key)
+}
+
+func (s caddyStorage) Delete(key string) error {
+	err := s.Storage.Delete(context.Background(), s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s caddyStorage) DeletePrefix(prefix string) (int, error) {
+	names, err := s.Storage.List(context.Background(), storagePrefix, false)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, name := range names {
+		key, err := url.QueryUnescape(path.Base(name))
+		if err != nil || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if err := s.Delete(key); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Close does nothing, the storage belongs to Caddy.
+func (s caddyStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,201 @@
+package openidauth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/emanoelxavier/openid2go/openid"
+)
+
+// claimHeader maps a claim in a validated token to a request header that
+// is passed on to the next handler.
+type claimHeader struct {
+	Claim  string `json:"claim"`
+	Header string `json:"header"`
+}
+
+// claimString converts a claim value to its header representation. Arrays
+// are joined with a comma, everything else uses its default formatting.
+func claimString(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case []interface{}:
+		values := make([]string, 0, len(t))
+		for _, e := range t {
+			values = append(values, claimString(e))
+		}
+		return strings.Join(values, ",")
+	case float64:
+		// JSON numbers are decoded as float64, avoid printing 1.5e+09 for
+		// timestamps like exp and iat.
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+// removeClaimHeaders deletes the configured claim headers from the request so
+// that a client cannot spoof an identity towards the backend.
+func removeClaimHeaders(r *http.Request, headers []claimHeader) {
+	for _, h := range headers {
+		r.Header.Del(h.Header)
+	}
+}
+
+// setClaimHeaders copies the configured claims from the authenticated user
+// into the request headers.
+func setClaimHeaders(r *http.Request, u *openid.User, headers []claimHeader) {
+	if u == nil {
+		return
+	}
+	for _, h := range headers {
+		v, ok := u.Claims[h.Claim]
+		if !ok {
+			continue
+		}
+		r.Header.Set(h.Header, claimString(v))
+	}
+}
+
+// setPlaceholders registers the claims of the authenticated user as
+// placeholders, e.g. {openid.claims.sub}, so that other directives like log,
+// header and proxy can use them. The subject is also made available as the
+// {user} placeholder.
+func setPlaceholders(r *http.Request, u *openid.User) *http.Request {
+	if u == nil {
+		return r
+	}
+	if repl, ok := r.Context().Value(ReplacerCtxKey).(Replacer); ok {
+		repl.Set("openid.issuer", u.Issuer)
+		repl.Set("openid.subject", u.ID)
+		for name, v := range u.Claims {
+			repl.Set("openid.claims."+name, claimString(v))
+		}
+	}
+	return r.WithContext(context.WithValue(r.Context(), RemoteUserCtxKey, u.ID))
+}
+
+// claimMapping derives the Target claim from another claim with a list of
+// transformations, so that claim headers and placeholders can pass
+// identities on in the shape the backend expects.
+type claimMapping struct {
+	Claim      string   `json:"claim"`
+	Target     string   `json:"target"`
+	Transforms []string `json:"transforms,omitempty"`
+}
+
+// parseClaimMapping parses the arguments of a map_claim directive:
+//
+//	map_claim preferred_username -> user lowercase strip_domain
+//	map_claim groups group_list join=;
+func parseClaimMapping(c Dispenser) (claimMapping, error) {
+	args := c.RemainingArgs()
+	if len(args) > 1 && args[1] == "->" {
+		args = append(args[:1], args[2:]...)
+	}
+	if len(args) < 2 {
+		return claimMapping{}, c.ArgErr()
+	}
+	m := claimMapping{Claim: args[0], Target: args[1], Transforms: args[2:]}
+	if err := m.validate(); err != nil {
+		return claimMapping{}, c.Errf("%v", err)
+	}
+	return m, nil
+}
+
+// validate checks that the transformations are known.
+func (m claimMapping) validate() error {
+	for _, t := range m.Transforms {
+		name := strings.SplitN(t, "=", 2)[0]
+		switch name {
+		case "lowercase", "uppercase", "strip_domain", "first", "join":
+		default:
+			return fmt.Errorf("openidauth: unknown claim transformation %q", t)
+		}
+	}
+	return nil
+}
+
+// apply transforms a claim value. Strings in an array are transformed one
+// by one until the array is joined.
+func (m claimMapping) apply(v interface{}) interface{} {
+	for _, t := range m.Transforms {
+		kv := strings.SplitN(t, "=", 2)
+		switch kv[0] {
+		case "lowercase":
+			v = mapStrings(v, strings.ToLower)
+		case "uppercase":
+			v = mapStrings(v, strings.ToUpper)
+		case "strip_domain":
+			v = mapStrings(v, func(s string) string {
+				if i := strings.LastIndex(s, "@"); i >= 0 {
+					return s[:i]
+				}
+				return s
+			})
+		case "first":
+			if list, ok := v.([]interface{}); ok {
+				v = nil
+				if len(list) > 0 {
+					v = list[0]
+				}
+			}
+		case "join":
+			sep := ","
+			if len(kv) == 2 {
+				sep = kv[1]
+			}
+			if list, ok := v.([]interface{}); ok {
+				values := make([]string, 0, len(list))
+				for _, e := range list {
+					values = append(values, claimString(e))
+				}
+				v = strings.Join(values, sep)
+			}
+		}
+	}
+	return v
+}
+
+// mapStrings applies f to a string, or to the strings in an array.
+func mapStrings(v interface{}, f func(string) string) interface{} {
+	switch t := v.(type) {
+	case string:
+		return f(t)
+	case []interface{}:
+		mapped := make([]interface{}, len(t))
+		for i, e := range t {
+			mapped[i] = mapStrings(e, f)
+		}
+		return mapped
+	}
+	return v
+}
+
+// mapClaims returns the user with the mapped claims added. The user is
+// copied, users of cached tokens are shared between requests.
+func mapClaims(u *openid.User, mappings []claimMapping) *openid.User {
+	if u == nil || len(mappings) == 0 {
+		return u
+	}
+	claims := make(map[string]interface{}, len(u.Claims)+len(mappings))
+	for name, v := range u.Claims {
+		claims[name] = v
+	}
+	for _, m := range mappings {
+		if v, ok := claims[m.Claim]; ok {
+			if v = m.apply(v); v != nil {
+				claims[m.Target] = v
+			}
+		}
+	}
+	mapped := *u
+	mapped.Claims = claims
+	return &mapped
+}
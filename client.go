@@ -0,0 +1,217 @@
+package openidauth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultConnectTimeout = 10 * time.Second
+	defaultHTTPTimeout    = 30 * time.Second
+)
+
+// httpClientConfig holds the settings of the HTTP client used to talk to the
+// providers. Without a proxy the environment variables HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY are used.
+type httpClientConfig struct {
+	ConnectTimeout time.Duration `json:"connect_timeout,omitempty"`
+	Timeout        time.Duration `json:"timeout,omitempty"`
+	Proxy          string        `json:"proxy,omitempty"`
+	CAFile         string        `json:"ca_file,omitempty"`
+	CertFile       string        `json:"cert_file,omitempty"`
+	KeyFile        string        `json:"key_file,omitempty"`
+	MinTLSVersion  string        `json:"min_tls_version,omitempty"`
+
+	// Pins of the certificates the providers may present, see parsePin.
+	Pins []string `json:"pins,omitempty"`
+
+	// insecure skips the verification of the certificates of the
+	// providers, see Config.AllowInsecureIssuer.
+	insecure bool
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// providerClient makes the HTTP requests to the providers. Requests to a
+// provider that keeps failing are stopped by its circuit breaker.
+type providerClient struct {
+	HTTP     *http.Client
+	Breakers *breakers
+}
+
+func newProviderClient(cfg httpClientConfig, b *breakers) (*providerClient, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.insecure}
+	if cfg.MinTLSVersion != "" {
+		version, ok := tlsVersions[cfg.MinTLSVersion]
+		if !ok {
+			return nil, fmt.Errorf("openidauth: unknown TLS version %q", cfg.MinTLSVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("openidauth: no certificates found in %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(cfg.Pins) > 0 {
+		verify, err := verifyPins(cfg.Pins)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.VerifyPeerCertificate = verify
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if cfg.Proxy != "" {
+		proxyURL, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("openidauth: invalid proxy: %v", err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   cfg.ConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: cfg.ConnectTimeout,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &providerClient{
+		HTTP:     &http.Client{Transport: transport, Timeout: cfg.Timeout},
+		Breakers: b,
+	}, nil
+}
+
+// certificatePin is the SHA-256 hash of a certificate, or of its public key.
+type certificatePin struct {
+	SPKI bool
+	Hash []byte
+}
+
+// parsePin parses a pin. A pin of the public key, which stays the same when
+// the certificate is renewed with the same key, is written like in HPKP:
+//
+//	sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=
+//
+// A pin of the whole certificate is its hex encoded fingerprint:
+//
+//	cert/3b0d2c7e...
+func parsePin(pin string) (certificatePin, error) {
+	switch {
+	case strings.HasPrefix(pin, "sha256/"):
+		hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+		if err == nil && len(hash) == sha256.Size {
+			return certificatePin{SPKI: true, Hash: hash}, nil
+		}
+	case strings.HasPrefix(pin, "cert/"):
+		hash, err := hex.DecodeString(strings.Replace(strings.TrimPrefix(pin, "cert/"), ":", "", -1))
+		if err == nil && len(hash) == sha256.Size {
+			return certificatePin{Hash: hash}, nil
+		}
+	}
+	return certificatePin{}, fmt.Errorf("openidauth: invalid certificate pin %q", pin)
+}
+
+// verifyPins returns a function that accepts a connection only if one of the
+// certificates presented by the server matches one of the pins. It runs
+// after the usual verification of the certificate chain.
+func verifyPins(pins []string) (func([][]byte, [][]*x509.Certificate) error, error) {
+	var parsed []certificatePin
+	for _, pin := range pins {
+		p, err := parsePin(pin)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, p)
+	}
+
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		for _, raw := range rawCerts {
+			certHash := sha256.Sum256(raw)
+			var spkiHash [sha256.Size]byte
+			if cert, err := x509.ParseCertificate(raw); err == nil {
+				spkiHash = sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			}
+			for _, p := range parsed {
+				if p.SPKI && bytes.Equal(p.Hash, spkiHash[:]) || !p.SPKI && bytes.Equal(p.Hash, certHash[:]) {
+					return nil
+				}
+			}
+		}
+		return errors.New("openidauth: the certificate of the provider does not match any pin")
+	}, nil
+}
+
+// Do sends the request. Responses with a 5xx status count as failures of
+// the provider but are returned like any other response.
+func (c *providerClient) Do(req *http.Request) (*http.Response, error) {
+	var resp *http.Response
+	err := c.Breakers.Call(req.URL.String(), func() error {
+		var err error
+		resp, err = c.HTTP.Do(req)
+		if err == nil && resp.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("openidauth: %s returned status %d", req.URL, resp.StatusCode)
+		}
+		return err
+	})
+	if resp != nil {
+		return resp, nil
+	}
+	return nil, err
+}
+
+// Get downloads the document at url.
+func (c *providerClient) Get(url string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("openidauth: unexpected status %d fetching %s", resp.StatusCode, url)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,129 @@
+package openidauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	grantTypeClientCredentials = "client_credentials"
+
+	// tokenSourceClientCredentials is the source of the tokens the
+	// middleware obtains for clients with a certificate.
+	tokenSourceClientCredentials = "client_credentials"
+)
+
+// certificateClient is a legacy client that authenticates with a client
+// certificate instead of a token. Requests with a verified certificate whose
+// subject common name is Subject get a token obtained with the client
+// credentials grant, for the Scopes.
+type certificateClient struct {
+	Name    string   `json:"name"`
+	Subject string   `json:"subject"`
+	Scopes  []string `json:"scopes,omitempty"`
+}
+
+// parseCertificateClient parses the arguments of a client_credentials
+// directive:
+//
+//	client_credentials billing billing.legacy.internal
+//	client_credentials reports reports.legacy.internal reports:read
+func parseCertificateClient(c Dispenser) (certificateClient, error) {
+	args := c.RemainingArgs()
+	if len(args) < 2 {
+		return certificateClient{}, c.ArgErr()
+	}
+	return certificateClient{Name: args[0], Subject: args[1], Scopes: args[2:]}, nil
+}
+
+// clientCredentials obtains tokens for the certificate clients at the token
+// endpoint of Provider with its client id and secret, see RFC 6749 section
+// 4.4. The tokens are kept in Storage until shortly before they expire, and
+// are validated and authorized like the tokens clients send. Caddy must
+// terminate TLS and verify the client certificates against a trusted CA,
+// unverified certificates are ignored.
+type clientCredentials struct {
+	Clients   []certificateClient
+	Provider  providerConfig
+	Discovery *discovery
+	Cache     *fetchCache
+	Storage   storage
+}
+
+// client returns the client of the request if the rule accepts it, or nil.
+func (cc *clientCredentials) client(r *http.Request, rule *pathRule) *certificateClient {
+	if cc == nil || len(rule.Clients) == 0 || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	for i, c := range cc.Clients {
+		if c.Subject == subject && containsString(rule.Clients, c.Name) {
+			return &cc.Clients[i]
+		}
+	}
+	return nil
+}
+
+// token returns a token for the client.
+func (cc *clientCredentials) token(c *certificateClient) (string, error) {
+	key := "client_credentials:" + c.Name
+	if value, err := cc.Storage.Get(key); err == nil && value != nil {
+		return string(value), nil
+	}
+	tokens, err := cc.post(c)
+	if err != nil {
+		return "", &authorizationError{
+			Code:        "temporarily_unavailable",
+			Description: "No token could be obtained for the client",
+			Unavailable: true,
+		}
+	}
+	if ttl := time.Duration(tokens.ExpiresIn)*time.Second - tokenExchangeMargin; ttl > 0 {
+		cc.Storage.Set(key, []byte(tokens.AccessToken), ttl)
+	}
+	return tokens.AccessToken, nil
+}
+
+// post sends the client credentials request to the token endpoint.
+func (cc *clientCredentials) post(c *certificateClient) (*tokenResponse, error) {
+	doc, err := cc.Discovery.Document()
+	if err != nil {
+		return nil, err
+	}
+	if doc.TokenEndpoint == "" {
+		return nil, fmt.Errorf("openidauth: issuer %s has no token endpoint", cc.Provider.Issuer)
+	}
+
+	form := url.Values{"grant_type": {grantTypeClientCredentials}}
+	if len(c.Scopes) > 0 {
+		form.Set("scope", strings.Join(c.Scopes, " "))
+	}
+	req, err := http.NewRequest(http.MethodPost, doc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(cc.Provider.ClientIds[0]), url.QueryEscape(cc.Provider.clientSecret()))
+
+	resp, err := cc.Cache.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("openidauth: token endpoint returned status %d", resp.StatusCode)
+	}
+	tokens := &tokenResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(tokens); err != nil {
+		return nil, err
+	}
+	if tokens.AccessToken == "" {
+		return nil, fmt.Errorf("openidauth: token endpoint returned no access token")
+	}
+	return tokens, nil
+}
@@ -0,0 +1,53 @@
+package openidauth
+
+import (
+	"strings"
+
+	"github.com/emanoelxavier/openid2go/openid"
+)
+
+const profileCognito = "cognito"
+
+// cognitoProfile maps the claims of Amazon Cognito tokens to the standard
+// ones. The groups in cognito:groups become the groups and roles claims, and
+// cognito:username the username claim as in access tokens. Custom
+// attributes like custom:tenant are also available without the prefix,
+// unless the token has a claim with that name.
+type cognitoProfile struct{}
+
+// normalize adds the mapped claims.
+func (cognitoProfile) normalize(u *openid.User) error {
+	if groups, ok := u.Claims["cognito:groups"]; ok {
+		for _, name := range []string{"groups", "roles"} {
+			if _, found := u.Claims[name]; !found {
+				u.Claims[name] = groups
+			}
+		}
+	}
+	if username, ok := u.Claims["cognito:username"]; ok {
+		if _, found := u.Claims["username"]; !found {
+			u.Claims["username"] = username
+		}
+	}
+	for name, v := range u.Claims {
+		if !strings.HasPrefix(name, "custom:") {
+			continue
+		}
+		if _, found := u.Claims[strings.TrimPrefix(name, "custom:")]; !found {
+			u.Claims[strings.TrimPrefix(name, "custom:")] = v
+		}
+	}
+	return nil
+}
+
+// cognitoAudiences returns the audiences of a Cognito token. Access tokens
+// have no aud claim, the client they were issued to is in client_id.
+func cognitoAudiences(t *rawJWT) []string {
+	if _, found := t.Claims["aud"]; found {
+		return t.audiences()
+	}
+	if clientID, ok := t.Claims["client_id"].(string); ok && clientID != "" {
+		return []string{clientID}
+	}
+	return nil
+}
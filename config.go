@@ -3,57 +3,570 @@ package openidauth
 import (
 	"errors"
 	"fmt"
-
-	"github.com/emanoelxavier/openid2go/openid"
-	"github.com/mholt/caddy"
-	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type auth struct {
-	Configuration *openid.Configuration
-	Paths         []string
-	Next          httpserver.Handler
+	Validator      validator
+	Tenants        *tenantRouter
+	Paths          []*pathRule
+	Exceptions     []pathMatcher
+	PathIndex      *pathIndex
+	ExceptIndex    *pathIndex
+	RequiredClaims []claimRequirement
+	HostedDomains  []string
+	Require        []*policy
+	Policies       map[string]*policy
+	Validators     []namedValidator
+	OPA            *opaAuthorizer
+	Webhook        *authzWebhook
+	Exchange       *tokenExchanger
+	ClaimMappings  []claimMapping
+	ClaimHeaders   []claimHeader
+	InternalToken  *internalTokenMinter
+	HeaderSigner   *headerSigner
+	TokenSources   []tokenSource
+	StripToken     bool
+	MaxTokenSize   int
+	DPoP           *dpopVerifier
+	Login          *loginHandler
+	MetricsPath    string
+	AuditLog       *auditLogger
+	Cache          *fetchCache
+	Storage        storage
+	Introspectors  []*introspector
+	HMACValidators map[string]validator
+	Errors         *errorResponder
+	FailOpen       bool
+	DenyList       *denyList
+	Limiter        *failureLimiter
+	Networks       *trustedNetworks
+	Health         *healthChecks
+	Admin          *adminAPI
+	Shadow         bool
+	Debug          bool
+	Dev            *devProvider
+	APIKeys        []apiKey
+	Credentials    *clientCredentials
+	Basic          *basicBridge
+	Next           Handler
+}
+
+// Config is the configuration of the middleware. It is parsed from the
+// openidauth block of the Caddyfile, or decoded from the JSON configuration
+// of the Caddy v2 module.
+type Config struct {
+	Providers      []providerConfig      `json:"providers,omitempty"`
+	TenantHeader   string                `json:"tenant_header,omitempty"`
+	Paths          []*pathRule           `json:"paths,omitempty"`
+	Exceptions     []pathMatcher         `json:"except,omitempty"`
+	RequiredClaims []claimRequirement    `json:"require_claims,omitempty"`
+	HostedDomains  []string              `json:"require_hd,omitempty"`
+	Require        []string              `json:"require,omitempty"`
+	Policies       map[string]string     `json:"policies,omitempty"`
+	Validators     []string              `json:"validators,omitempty"`
+	OPA            string                `json:"opa,omitempty"`
+	OPATimeout     time.Duration         `json:"opa_timeout,omitempty"`
+	ClaimMappings  []claimMapping        `json:"claim_mappings,omitempty"`
+	ClaimHeaders   []claimHeader         `json:"claim_headers,omitempty"`
+	TokenSources   []tokenSource         `json:"token_sources,omitempty"`
+	StripToken     bool                  `json:"strip_token,omitempty"`
+	MaxTokenSize   int                   `json:"max_token_size,omitempty"`
+	RequireDPoP    bool                  `json:"require_dpop,omitempty"`
+	Login          *loginConfig          `json:"login,omitempty"`
+	CacheTTL       time.Duration         `json:"cache_ttl,omitempty"`
+	Leeway         time.Duration         `json:"leeway,omitempty"`
+	AllowedAlgs    []string              `json:"allowed_algs,omitempty"`
+	HMACSecrets    map[string]hmacSecret `json:"hmac_secrets,omitempty"`
+	DecryptionKeys []string              `json:"decryption_keys,omitempty"`
+	MetricsPath    string                `json:"metrics,omitempty"`
+	AuditLog       string                `json:"audit_log,omitempty"`
+	ErrorFormat    string                `json:"error_format,omitempty"`
+	Errors         string                `json:"errors,omitempty"`
+	ErrorPage      string                `json:"error_page,omitempty"`
+	Realm          string                `json:"realm,omitempty"`
+	StatusCodes    map[string]int        `json:"status_codes,omitempty"`
+	DenyListFile   string                `json:"deny_list,omitempty"`
+	DenyListAdmin  string                `json:"deny_list_admin,omitempty"`
+
+	// The webhook is asked about every authenticated request. The listed
+	// headers of its response are passed on to the backend.
+	AuthzWebhook        string        `json:"authz_webhook,omitempty"`
+	AuthzWebhookTimeout time.Duration `json:"authz_webhook_timeout,omitempty"`
+	AuthzWebhookHeaders []string      `json:"authz_webhook_headers,omitempty"`
+
+	// Tokens are exchanged for tokens for the audience and scopes before
+	// they are passed on to the backend.
+	TokenExchangeAudience string   `json:"token_exchange_audience,omitempty"`
+	TokenExchangeScopes   []string `json:"token_exchange_scopes,omitempty"`
+
+	// The identity of the user is passed on to the backend in a token
+	// signed by the middleware.
+	InternalToken *internalTokenConfig `json:"internal_token,omitempty"`
+
+	// The claim headers are signed with the secret, or the secret read
+	// from the file, see headerSigner.
+	ClaimHeaderSecret     string `json:"claim_header_secret,omitempty"`
+	ClaimHeaderSecretFile string `json:"claim_header_secret_file,omitempty"`
+	claimHeaderSecret     string
+
+	// Clients and users are banned for FailureBan after FailureLimit failed
+	// authentications within FailureWindow.
+	FailureLimit  int           `json:"failure_limit,omitempty"`
+	FailureWindow time.Duration `json:"failure_window,omitempty"`
+	FailureBan    time.Duration `json:"failure_ban,omitempty"`
+
+	// Requests from the networks skip the token validation, or with
+	// RequireBoth must come from them and have a valid token.
+	BypassCIDRs []string `json:"bypass_cidrs,omitempty"`
+	RequireBoth bool     `json:"require_both,omitempty"`
+
+	// The health and readiness endpoints are served under the prefix.
+	HealthChecks string `json:"health_checks,omitempty"`
+
+	// The admin API is served under the path to local clients that send
+	// the token, or the secret read from the file, or present a verified
+	// certificate with one of the subjects.
+	AdminAPI          string   `json:"admin_api,omitempty"`
+	AdminAPIToken     string   `json:"admin_api_token,omitempty"`
+	AdminAPITokenFile string   `json:"admin_api_token_file,omitempty"`
+	AdminAPIClients   []string `json:"admin_api_clients,omitempty"`
+	adminAPIToken     string
+
+	// Mode is enforce, or shadow to only record the decisions.
+	Mode string `json:"mode,omitempty"`
+
+	// LogLevel debug logs every step of the decisions.
+	LogLevel string `json:"log_level,omitempty"`
+
+	// DevMode is the path of the development provider, see devProvider.
+	DevMode string `json:"dev_mode,omitempty"`
+
+	// APIKeys are accepted instead of tokens on the paths that name them.
+	APIKeys []apiKey `json:"api_keys,omitempty"`
+
+	// Clients with these certificates get a token obtained with the client
+	// credentials grant on the paths that name them.
+	ClientCredentials []certificateClient `json:"client_credentials,omitempty"`
+
+	// BasicAuth is the token endpoint Basic credentials are exchanged at
+	// for a token, or "discovery" to use the one of the first issuer.
+	BasicAuth string `json:"basic_auth,omitempty"`
+
+	// AllowInsecureIssuer allows issuers with plain HTTP and providers
+	// with certificates that can't be verified, for test environments.
+	AllowInsecureIssuer bool `json:"allow_insecure_issuer,omitempty"`
+
+	IntrospectionCacheTTL time.Duration `json:"introspection_cache_ttl,omitempty"`
+	ValidationCacheTTL    time.Duration `json:"validation_cache_ttl,omitempty"`
+
+	// Fingerprint binds the remembered validation results and the sessions
+	// to the client that used them first. When another client uses them
+	// they are validated again (revalidate) or rejected (reject).
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+	// Calls to a provider stop for the cooldown after the threshold of
+	// consecutive failures. While providers are unavailable requests are
+	// rejected (fail_closed) or passed on unauthenticated (fail_open).
+	BreakerThreshold int           `json:"breaker_threshold,omitempty"`
+	BreakerCooldown  time.Duration `json:"breaker_cooldown,omitempty"`
+	ProviderOutage   string        `json:"provider_outage,omitempty"`
+
+	HTTPClient httpClientConfig `json:"http_client,omitempty"`
+
+	// Storage is where the state of the middleware is kept, "memory", the
+	// URL of a Redis server or "caddy" for the storage of Caddy v2, which is
+	// then passed in StorageBackend.
+	Storage        string  `json:"storage,omitempty"`
+	StorageBackend Storage `json:"-"`
+}
+
+// providerConfig is a token issuer and the client ids accepted from it.
+// The client secret is used by the interactive login flow and to
+// authenticate at the introspection endpoint. It may be a {env.NAME}
+// placeholder, or be read from ClientSecretFile.
+type providerConfig struct {
+	Issuer           string   `json:"issuer"`
+	ClientIds        []string `json:"client_ids"`
+	ClientSecret     string   `json:"client_secret,omitempty"`
+	ClientSecretFile string   `json:"client_secret_file,omitempty"`
+
+	// Introspection is the endpoint opaque tokens are introspected at, or
+	// "discovery" to use the one in the discovery document.
+	Introspection string `json:"introspection,omitempty"`
+
+	// Audiences accepted in the aud claim. The client ids are accepted if
+	// there are none.
+	Audiences         []string `json:"audiences,omitempty"`
+	SkipAudienceCheck bool     `json:"skip_audience_check,omitempty"`
+
+	// AllowMissingExp accepts tokens without an exp claim, which never
+	// expire. Access and ID tokens must have one otherwise.
+	AllowMissingExp bool `json:"allow_missing_exp,omitempty"`
+
+	// Local files with the signing keys, used instead of the JWKS of the
+	// issuer.
+	JWKSFile       string   `json:"jwks_file,omitempty"`
+	PublicKeyFiles []string `json:"public_key_files,omitempty"`
+
+	// Tenants the provider is restricted to, matched against the host of
+	// the request or the tenant header.
+	Tenants []string `json:"tenants,omitempty"`
+
+	// Profile adapts the middleware to a provider, like azure.
+	Profile string `json:"profile,omitempty"`
+
+	// SigningAlgs replace allowed_algs for the tokens of the provider.
+	SigningAlgs []string `json:"signing_algs,omitempty"`
+
+	// IssuerURL is where the middleware reaches the provider, if that is not
+	// the issuer in the tokens.
+	IssuerURL string `json:"issuer_url,omitempty"`
+
+	// Endpoints replace those of the discovery document, by their names in
+	// the document, like jwks_uri.
+	Endpoints map[string]string `json:"endpoints,omitempty"`
+
+	secretFile *secretFile
 }
 
-func init() {
-	caddy.RegisterPlugin("openidauth", caddy.Plugin{
-		ServerType: "http",
-		Action:     Setup,
-	})
+// clientSecret returns the client secret of the provider.
+func (p providerConfig) clientSecret() string {
+	if p.secretFile != nil {
+		secret, _ := p.secretFile.Value()
+		return secret
+	}
+	return p.ClientSecret
 }
 
-// Setup sets up the middleware
-func Setup(c *caddy.Controller) error {
-	issuer, clientIds, paths, err := parse(c)
+// hasClientSecret reports whether the provider has a client secret.
+func (p providerConfig) hasClientSecret() bool {
+	return p.ClientSecret != "" || p.ClientSecretFile != ""
+}
+
+// Dispenser is the part of the Caddyfile token dispenser that the parser
+// uses. It is implemented by *caddy.Controller of Caddy v1, the Caddy v2
+// module adapts its own dispenser to it.
+type Dispenser interface {
+	Next() bool
+	NextArg() bool
+	NextBlock() bool
+	Val() string
+	RemainingArgs() []string
+	ArgErr() error
+	Errf(format string, args ...interface{}) error
+}
+
+// newAuth creates the middleware from a prepared configuration. Next is
+// set when the middleware is added to a chain.
+func newAuth(cfg *Config) (_ *auth, err error) {
+	clientConfig := cfg.HTTPClient
+	if cfg.AllowInsecureIssuer {
+		clientConfig.insecure = true
+		log.Printf("openidauth: WARNING: allow_insecure_issuer is enabled, the providers are not authenticated and tokens can be forged, never use it in production")
+	}
+	client, err := newProviderClient(clientConfig, newBreakers(cfg.BreakerThreshold, cfg.BreakerCooldown))
 	if err != nil {
-		return err
+		return nil, err
+	}
+	cache := newFetchCache(cfg.CacheTTL, client)
+	if err := cfg.check(cache); err != nil {
+		return nil, err
 	}
+	verifier := newTokenValidator(cfg.Providers, cfg.Leeway, cfg.AllowedAlgs, cache)
+	verifier.Decrypter, err = newDecrypter(cfg.DecryptionKeys)
+	if err != nil {
+		return nil, err
+	}
+	var dev *devProvider
+	if cfg.DevMode != "" {
+		dev, err = newDevProvider(cfg.DevMode)
+		if err != nil {
+			return nil, err
+		}
+		verifier.Issuers = append(verifier.Issuers, dev.issuerValidator(cache))
+		log.Printf("openidauth: WARNING: dev_mode is enabled, anyone can get tokens at %s/token", dev.Path)
+	}
+	var store storage
+	if cfg.Storage == storageCaddy && cfg.StorageBackend != nil {
+		store = cfg.StorageBackend
+	} else {
+		store, err = acquireStorage(cfg.Storage)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			store.Close()
+		}
+	}()
 
-	c.OnStartup(func() error {
-		fmt.Println("Initiating OpenID Connect autentication middleware")
-		return nil
-	})
+	var auditLog *auditLogger
+	if cfg.AuditLog != "" {
+		auditLog, err = newAuditLogger(cfg.AuditLog)
+		if err != nil {
+			return nil, err
+		}
+		auditLog.Shadow = cfg.Mode == modeShadow
+	}
 
-	configuration, err := openid.NewConfiguration(openid.ProvidersGetter(getProviderFunc(issuer, clientIds)),
-		openid.ErrorHandler(onAuthenticateFailed))
+	var login *loginHandler
+	if cfg.Login != nil {
+		login, err = newLoginHandler(cfg.Providers[0], cfg.Login, verifier, cache, store)
+		if err != nil {
+			return nil, err
+		}
+		if len(cfg.HostedDomains) == 1 {
+			login.HostedDomain = cfg.HostedDomains[0]
+		}
+	}
 
+	var minter *internalTokenMinter
+	if cfg.InternalToken != nil {
+		minter, err = newInternalTokenMinter(*cfg.InternalToken)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var networks *trustedNetworks
+	if len(cfg.BypassCIDRs) > 0 {
+		parsed, err := parseCIDRs(cfg.BypassCIDRs)
+		if err != nil {
+			return nil, err
+		}
+		networks = &trustedNetworks{Networks: parsed, RequireBoth: cfg.RequireBoth}
+	}
+
+	var limiter *failureLimiter
+	if cfg.FailureLimit > 0 {
+		limiter = newFailureLimiter(cfg.FailureLimit, cfg.FailureWindow, cfg.FailureBan)
+	}
+
+	var signer *headerSigner
+	if cfg.claimHeaderSecret != "" {
+		signer = newHeaderSigner(cfg.claimHeaderSecret, cfg.ClaimHeaders)
+	}
+
+	var exchanger *tokenExchanger
+	if cfg.TokenExchangeAudience != "" {
+		exchanger = &tokenExchanger{
+			Audience:  cfg.TokenExchangeAudience,
+			Scopes:    cfg.TokenExchangeScopes,
+			Providers: cfg.Providers,
+			Cache:     cache,
+			Storage:   store,
+		}
+	}
+
+	var credentials *clientCredentials
+	if len(cfg.ClientCredentials) > 0 {
+		credentials = &clientCredentials{
+			Clients:   cfg.ClientCredentials,
+			Provider:  cfg.Providers[0],
+			Discovery: newDiscovery(cfg.Providers[0], cache),
+			Cache:     cache,
+			Storage:   store,
+		}
+	}
+
+	var basic *basicBridge
+	if cfg.BasicAuth != "" {
+		basic = newBasicBridge(cfg.Providers[0], cfg.BasicAuth, cache, store)
+	}
+
+	var introspectors []*introspector
+	for _, p := range cfg.Providers {
+		if p.Introspection != "" {
+			introspectors = append(introspectors, newIntrospector(p, cfg.IntrospectionCacheTTL, cache, store))
+		}
+	}
+
+	var loginPath string
+	if login != nil {
+		loginPath = login.callbackPath()
+	}
+	responder, err := newErrorResponder(cfg, loginPath)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	var denied *denyList
+	if cfg.DenyListFile != "" || cfg.DenyListAdmin != "" || cfg.AdminAPI != "" {
+		denied, err = newDenyList(cfg.DenyListFile, cfg.DenyListAdmin, store)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var health *healthChecks
+	if cfg.HealthChecks != "" {
+		health = &healthChecks{Prefix: strings.TrimSuffix(cfg.HealthChecks, "/"), Verifier: verifier, Storage: store}
 	}
 
-	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
-		return &auth{
-			Configuration: configuration,
-			Paths:         paths,
-			Next:          next,
+	// Tokens from the providers and signed with the shared secrets can be
+	// remembered, ID tokens of the login are always validated.
+	var tokens validator = verifier
+	hmacValidators := make(map[string]validator)
+	for name, secret := range cfg.HMACSecrets {
+		hmacValidators[name] = &hmacValidator{
+			Secret:      []byte(secret.value),
+			Issuer:      secret.Issuer,
+			Audience:    secret.Audience,
+			OptionalExp: secret.OptionalExp,
+			Leeway:      cfg.Leeway,
 		}
-	})
-	fmt.Println("OpenID Connect autentication middleware successfully initiated")
+	}
+	if cfg.ValidationCacheTTL > 0 {
+		c := newCachingValidator(verifier, cfg.ValidationCacheTTL)
+		c.Bind = cfg.Fingerprint
+		tokens = c
+		for name, v := range hmacValidators {
+			c := newCachingValidator(v, cfg.ValidationCacheTTL)
+			c.Bind = cfg.Fingerprint
+			hmacValidators[name] = c
+		}
+	}
 
+	var admin *adminAPI
+	if cfg.AdminAPI != "" {
+		admin = &adminAPI{
+			Path:      strings.TrimSuffix(cfg.AdminAPI, "/"),
+			Token:     cfg.adminAPIToken,
+			Clients:   cfg.AdminAPIClients,
+			Providers: cfg.Providers,
+			Cache:     cache,
+			Tokens:    tokens,
+			Storage:   store,
+			DenyList:  denied,
+			Login:     login,
+		}
+	}
+
+	for _, rule := range cfg.Paths {
+		if rule.responder, err = responder.forPath(rule.OnFailure); err != nil {
+			return nil, err
+		}
+		rule.apiResponder = rule.responder
+		if rule.OnFailure == failureAuto {
+			rule.apiResponder, _ = responder.forPath(failureJSON)
+		}
+		if rule.Challenge != "" {
+			rule.responder = rule.responder.withScheme(rule.Challenge)
+			rule.apiResponder = rule.apiResponder.withScheme(rule.Challenge)
+		}
+		rule.accepted = nil
+		for _, iss := range rule.Issuers {
+			for _, p := range cfg.Providers {
+				if p.Issuer == iss {
+					rule.accepted = append(rule.accepted, providerIssuers(p)...)
+				}
+			}
+		}
+	}
+
+	matchers := make([]pathMatcher, len(cfg.Paths))
+	for i, rule := range cfg.Paths {
+		matchers[i] = rule.Path
+	}
+
+	var require []*policy
+	for i, expr := range cfg.Require {
+		p, err := newPolicy(fmt.Sprintf("require#%d", i+1), expr)
+		if err != nil {
+			return nil, err
+		}
+		require = append(require, p)
+	}
+	policies := make(map[string]*policy)
+	for name, expr := range cfg.Policies {
+		if policies[name], err = newPolicy(name, expr); err != nil {
+			return nil, err
+		}
+	}
+
+	var custom []namedValidator
+	for _, name := range cfg.Validators {
+		v, _ := registeredValidator(name)
+		custom = append(custom, namedValidator{Name: name, Func: v})
+	}
+
+	var opa *opaAuthorizer
+	if cfg.OPA != "" {
+		opa = newOPAAuthorizer(cfg.OPA, cfg.OPATimeout)
+	}
+	var webhook *authzWebhook
+	if cfg.AuthzWebhook != "" {
+		webhook = newAuthzWebhook(cfg.AuthzWebhook, cfg.AuthzWebhookTimeout, cfg.AuthzWebhookHeaders)
+	}
+
+	return &auth{
+		Validator:      tokens,
+		Tenants:        newTenantRouter(cfg.Providers, cfg.TenantHeader),
+		Paths:          cfg.Paths,
+		Exceptions:     cfg.Exceptions,
+		PathIndex:      newPathIndex(matchers),
+		ExceptIndex:    newPathIndex(cfg.Exceptions),
+		RequiredClaims: cfg.RequiredClaims,
+		HostedDomains:  cfg.HostedDomains,
+		Require:        require,
+		Policies:       policies,
+		Validators:     custom,
+		OPA:            opa,
+		Webhook:        webhook,
+		Exchange:       exchanger,
+		ClaimMappings:  cfg.ClaimMappings,
+		ClaimHeaders:   cfg.ClaimHeaders,
+		InternalToken:  minter,
+		HeaderSigner:   signer,
+		TokenSources:   cfg.TokenSources,
+		StripToken:     cfg.StripToken,
+		MaxTokenSize:   cfg.MaxTokenSize,
+		DPoP:           &dpopVerifier{Required: cfg.RequireDPoP, Leeway: cfg.Leeway, Storage: store},
+		Login:          login,
+		MetricsPath:    cfg.MetricsPath,
+		AuditLog:       auditLog,
+		Cache:          cache,
+		Storage:        store,
+		Introspectors:  introspectors,
+		HMACValidators: hmacValidators,
+		Errors:         responder,
+		FailOpen:       cfg.ProviderOutage == outageFailOpen,
+		DenyList:       denied,
+		Limiter:        limiter,
+		Networks:       networks,
+		Health:         health,
+		Admin:          admin,
+		Shadow:         cfg.Mode == modeShadow,
+		Debug:          cfg.LogLevel == logLevelDebug,
+		Dev:            dev,
+		APIKeys:        cfg.APIKeys,
+		Credentials:    credentials,
+		Basic:          basic,
+	}, nil
+}
+
+// start starts the background work of the middleware.
+func (h *auth) start() error {
+	h.Cache.Start()
 	return nil
 }
 
-func parseSingleValue(c *caddy.Controller) (string, error) {
+// stop ends the background work and releases the resources of the
+// middleware.
+func (h *auth) stop() error {
+	h.Cache.Stop()
+	h.Storage.Close()
+	return h.AuditLog.Close()
+}
+
+func parseSingleValue(c Dispenser) (string, error) {
 	if !c.NextArg() {
 		// we are expecting a value
 		return "", c.ArgErr()
@@ -66,17 +579,158 @@ func parseSingleValue(c *caddy.Controller) (string, error) {
 	return r, nil
 }
 
-func parse(c *caddy.Controller) (issuer string, clientIds, paths []string, err error) {
+// parseEndpoint parses the arguments of a directive that calls an external
+// service: the URL and an optional timeout.
+func parseEndpoint(c Dispenser) (string, time.Duration, error) {
+	directive := c.Val()
+	args := c.RemainingArgs()
+	if len(args) == 0 || len(args) > 2 {
+		return "", 0, c.ArgErr()
+	}
+	if u, err := url.Parse(args[0]); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", 0, c.Errf("openidauth: invalid %s URL %q", directive, args[0])
+	}
+	var timeout time.Duration
+	if len(args) == 2 {
+		var err error
+		timeout, err = time.ParseDuration(args[1])
+		if err != nil || timeout <= 0 {
+			return "", 0, c.Errf("openidauth: invalid %s timeout %q", directive, args[1])
+		}
+	}
+	return args[0], timeout, nil
+}
+
+// ParseCaddyfile parses an openidauth block. The configuration is validated
+// and completed by New.
+func ParseCaddyfile(d Dispenser) (*Config, error) {
+	return parse(d)
+}
+
+func parse(c Dispenser) (*Config, error) {
 	// This parses the following config blocks
 	/*
 	   openid_auth {
-	       issuer http://issuer.com
+	       issuer https://issuer.com
 	       clientid client.id.1
 	       clientid client.id.2
+	       issuer https://other-issuer.com
+	       clientid client.id.3
+	       tenant tenant-b.example.com
+	       issuer_url http://issuer.svc:8080
+	       endpoint jwks_uri http://issuer.internal/keys
+	       tenant_header X-Tenant
+	       issuer https://*.auth.example.com
+	       clientid client.id.4
+	       issuer https://login.microsoftonline.com/{tenant}/v2.0
+	       clientid client.id.5
+	       profile azure
 	       path /service1/
 	       path /service2/
+	       path /admin/ scope=admin:write
+	       path /docs/ methods=POST,PUT,DELETE
+	       path /reports/**.pdf
+	       path ~^/reports/[0-9]+$
+	       except /service1/health
+	       require_claim groups sysadmins admins
+	       require_role admin
+	       require_hd example.com
+	       require claims.email endswith @example.com
+	       policy admins "admin" in claims.groups || claims.email == root@example.com
+	       path /manage/ policy=admins
+	       path /partner/ issuer=https://other-issuer.com
+	       validate tenant-license
+	       opa http://localhost:8181/v1/data/httpapi/authz 2s
+	       authz_webhook http://entitlements.local/check 2s
+	       authz_webhook_header X-Entitlements
+	       token_exchange https://orders.internal orders:read
+	       map_claim preferred_username -> user lowercase strip_domain
+	       claim_header sub X-Token-Subject
+	       sign_claim_headers {env.CLAIM_HEADER_SECRET}
+	       failure_limit 20 1m 10m
+	       bypass_cidr 10.0.0.0/8 192.168.1.10
+	       internal_token /etc/caddy/identity.pem claims=email,groups audience=backend
+	       token_source header
+	       token_source cookie access_token
+	       strip_token
+	       max_token_size 16384
+	       require_dpop
+	       client_secret {env.OIDC_CLIENT_SECRET}
+	       client_secret_file /run/secrets/oidc
+	       audience https://api.issuer.com
+	       skip_audience_check
+	       allow_missing_exp
+	       jwks_file /etc/caddy/jwks.json
+	       decryption_key /etc/caddy/token-key.pem
+	       public_key /etc/caddy/signing-key.pem
+	       introspect https://issuer.com/oauth2/introspect
+	       introspection_cache_ttl 5m
+	       validation_cache_ttl 1m
+	       fingerprint revalidate
+	       login /oauth2/callback
+	       login_scopes openid profile email
+	       login_timeout 10m
+	       login_return_urls /app docs.example.com
+	       login_landing_page /app
+	       session_key {env.OPENIDAUTH_SESSION_KEY}
+	       session_key_file /run/secrets/session-key
+	       stateless_login
+	       session_cookie openidauth_session
+	       session_domain example.com
+	       session_samesite lax
+	       session_lifetime 8h
+	       session_idle_timeout 30m
+	       session_max_lifetime 12h
+	       session_limit 3
+	       logout /logout /
+	       backchannel_logout /oauth2/backchannel-logout
+	       frontchannel_logout /oauth2/frontchannel-logout
+	       cache_ttl 1h
+	       circuit_breaker 5 30s
+	       provider_outage fail_closed
+	       http_connect_timeout 5s
+	       http_timeout 10s
+	       http_proxy http://proxy.example.com:3128
+	       tls_ca /etc/ssl/certs/corporate-ca.pem
+	       tls_client_cert /etc/caddy/client.pem /etc/caddy/client-key.pem
+	       tls_min_version 1.2
+	       tls_pin sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=
+	       leeway 60s
+	       allowed_algs RS256 ES256
+	       signing_algs EdDSA PS256
+	       hmac_secret internal {env.INTERNAL_JWT_SECRET}
+	       hmac_secret_file reports /run/secrets/reports-jwt
+	       path /internal/ hmac=internal
+	       api_key ci-runner 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08 deploy:write
+	       path /deploy/ api_keys=ci-runner
+	       client_credentials billing billing.legacy.internal billing:write
+	       path /billing/ client_credentials=billing
+	       basic_auth https://sso.example.com/oauth2/token
+	       metrics /metrics
+	       health_checks /openidauth
+	       admin_api /openidauth/admin
+	       admin_api_token {env.OPENIDAUTH_ADMIN_TOKEN}
+	       admin_api_token_file /run/secrets/openidauth-admin
+	       admin_api_client ops.example.com
+	       mode shadow
+	       log_level debug
+	       dev_mode /openidauth/dev
+	       audit_log /var/log/caddy/openidauth.log
+	       error_format json
+	       errors minimal
+	       error_page /etc/caddy/unauthorized.html
+	       realm api.example.com
+	       error_status insufficient_scope 404
+	       deny_list /etc/caddy/denied-tokens.txt
+	       deny_list_admin /admin/deny-list
+	       storage redis://:password@10.0.0.5:6379/0
 	   }
 	*/
+	cfg := &Config{}
+
+	// Client ids belong to the issuer declared before them. Client ids
+	// declared before any issuer belong to the first one.
+	var pendingClientIds []string
 
 	for c.Next() {
 		args := c.RemainingArgs()
@@ -86,45 +740,1167 @@ func parse(c *caddy.Controller) (issuer string, clientIds, paths []string, err e
 			for c.NextBlock() {
 				switch c.Val() {
 				case "path":
-					path, err := parseSingleValue(c)
+					rule, err := parsePathRule(c)
 					if err != nil {
-						return "", nil, nil, err
+						return nil, err
 					}
-					paths = append(paths, path)
+					cfg.Paths = append(cfg.Paths, rule)
 
-				case "issuer":
-					if issuer != "" {
-						return issuer, clientIds, paths, errors.New("openidauth: only 1 issuer can be configured")
+				case "except":
+					path, err := parseSingleValue(c)
+					if err != nil {
+						return nil, err
 					}
+					matcher, err := newPathMatcher(path)
+					if err != nil {
+						return nil, c.Errf("openidauth: invalid path %q: %v", path, err)
+					}
+					cfg.Exceptions = append(cfg.Exceptions, matcher)
+				case "issuer":
 					is, err := parseSingleValue(c)
 					if err != nil {
-						return "", nil, nil, err
+						return nil, err
+					}
+					for _, p := range cfg.Providers {
+						if p.Issuer == is {
+							return nil, fmt.Errorf("openidauth: issuer %s is configured more than once", is)
+						}
+					}
+					cfg.Providers = append(cfg.Providers, providerConfig{Issuer: is})
+					if len(cfg.Providers) == 1 {
+						cfg.Providers[0].ClientIds = pendingClientIds
 					}
-					issuer = is
 				case "clientid":
 					clientID, err := parseSingleValue(c)
 					if err != nil {
-						return "", nil, nil, err
+						return nil, err
+					}
+					if len(cfg.Providers) == 0 {
+						pendingClientIds = append(pendingClientIds, clientID)
+						break
+					}
+					p := &cfg.Providers[len(cfg.Providers)-1]
+					p.ClientIds = append(p.ClientIds, clientID)
+				case "client_secret":
+					secret, err := parseSingleValue(c)
+					if err != nil {
+						return nil, err
+					}
+					if len(cfg.Providers) == 0 {
+						return nil, errors.New("openidauth: client_secret must follow an issuer")
+					}
+					cfg.Providers[len(cfg.Providers)-1].ClientSecret = secret
+				case "client_secret_file":
+					file, err := parseSingleValue(c)
+					if err != nil {
+						return nil, err
+					}
+					if len(cfg.Providers) == 0 {
+						return nil, errors.New("openidauth: client_secret_file must follow an issuer")
+					}
+					cfg.Providers[len(cfg.Providers)-1].ClientSecretFile = file
+				case "tenant":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return nil, c.ArgErr()
+					}
+					if len(cfg.Providers) == 0 {
+						return nil, errors.New("openidauth: tenant must follow an issuer")
+					}
+					p := &cfg.Providers[len(cfg.Providers)-1]
+					p.Tenants = append(p.Tenants, args...)
+				case "profile":
+					name, err := parseSingleValue(c)
+					if err != nil {
+						return nil, err
+					}
+					if len(cfg.Providers) == 0 {
+						return nil, errors.New("openidauth: profile must follow an issuer")
+					}
+					switch name {
+					case profileAzure, profileKeycloak, profileCognito:
+					default:
+						return nil, c.Errf("openidauth: unknown profile %q", name)
+					}
+					cfg.Providers[len(cfg.Providers)-1].Profile = name
+				case "tenant_header":
+					header, err := parseSingleValue(c)
+					if err != nil {
+						return nil, err
+					}
+					cfg.TenantHeader = header
+				case "audience":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return nil, c.ArgErr()
+					}
+					if len(cfg.Providers) == 0 {
+						return nil, errors.New("openidauth: audience must follow an issuer")
+					}
+					p := &cfg.Providers[len(cfg.Providers)-1]
+					p.Audiences = append(p.Audiences, args...)
+				case "skip_audience_check":
+					if c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					if len(cfg.Providers) == 0 {
+						return nil, errors.New("openidauth: skip_audience_check must follow an issuer")
+					}
+					cfg.Providers[len(cfg.Providers)-1].SkipAudienceCheck = true
+				case "allow_missing_exp":
+					if c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					if len(cfg.Providers) == 0 {
+						return nil, errors.New("openidauth: allow_missing_exp must follow an issuer")
+					}
+					cfg.Providers[len(cfg.Providers)-1].AllowMissingExp = true
+				case "decryption_key":
+					file, err := parseSingleValue(c)
+					if err != nil {
+						return nil, err
+					}
+					cfg.DecryptionKeys = append(cfg.DecryptionKeys, file)
+				case "jwks_file":
+					file, err := parseSingleValue(c)
+					if err != nil {
+						return nil, err
+					}
+					if len(cfg.Providers) == 0 {
+						return nil, errors.New("openidauth: jwks_file must follow an issuer")
+					}
+					cfg.Providers[len(cfg.Providers)-1].JWKSFile = file
+				case "allow_insecure_issuer":
+					if c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					cfg.AllowInsecureIssuer = true
+				case "issuer_url":
+					u, err := parseSingleValue(c)
+					if err != nil {
+						return nil, err
+					}
+					if len(cfg.Providers) == 0 {
+						return nil, errors.New("openidauth: issuer_url must follow an issuer")
+					}
+					cfg.Providers[len(cfg.Providers)-1].IssuerURL = u
+				case "endpoint":
+					args := c.RemainingArgs()
+					if len(args) != 2 {
+						return nil, c.ArgErr()
+					}
+					if len(cfg.Providers) == 0 {
+						return nil, errors.New("openidauth: endpoint must follow an issuer")
+					}
+					p := &cfg.Providers[len(cfg.Providers)-1]
+					if p.Endpoints == nil {
+						p.Endpoints = make(map[string]string)
+					}
+					p.Endpoints[args[0]] = args[1]
+				case "public_key":
+					file, err := parseSingleValue(c)
+					if err != nil {
+						return nil, err
+					}
+					if len(cfg.Providers) == 0 {
+						return nil, errors.New("openidauth: public_key must follow an issuer")
+					}
+					p := &cfg.Providers[len(cfg.Providers)-1]
+					p.PublicKeyFiles = append(p.PublicKeyFiles, file)
+				case "introspect":
+					args := c.RemainingArgs()
+					if len(args) > 1 {
+						return nil, c.ArgErr()
+					}
+					if len(cfg.Providers) == 0 {
+						return nil, errors.New("openidauth: introspect must follow an issuer")
+					}
+					endpoint := introspectionDiscovery
+					if len(args) == 1 {
+						endpoint = args[0]
+					}
+					cfg.Providers[len(cfg.Providers)-1].Introspection = endpoint
+				case "introspection_cache_ttl":
+					value, err := parseSingleValue(c)
+					if err != nil {
+						return nil, err
+					}
+					ttl, err := time.ParseDuration(value)
+					if err != nil || ttl < 0 {
+						return nil, c.Errf("openidauth: invalid introspection_cache_ttl %q", value)
+					}
+					cfg.IntrospectionCacheTTL = ttl
+				case "validation_cache_ttl":
+					value, err := parseSingleValue(c)
+					if err != nil {
+						return nil, err
+					}
+					ttl, err := time.ParseDuration(value)
+					if err != nil || ttl < 0 {
+						return nil, c.Errf("openidauth: invalid validation_cache_ttl %q", value)
+					}
+					cfg.ValidationCacheTTL = ttl
+				case "fingerprint":
+					value, err := parseSingleValue(c)
+					if err != nil {
+						return nil, err
+					}
+					if value != bindRevalidate && value != bindReject {
+						return nil, c.Errf("openidauth: fingerprint must be %s or %s", bindRevalidate, bindReject)
+					}
+					cfg.Fingerprint = value
+				case "login":
+					args := c.RemainingArgs()
+					if len(args) > 1 {
+						return nil, c.ArgErr()
+					}
+					login := cfg.login()
+					if len(args) == 1 {
+						login.CallbackPath = args[0]
+					}
+				case "login_scopes":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return nil, c.ArgErr()
+					}
+					cfg.login().Scopes = args
+				case "login_timeout":
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					timeout, err := time.ParseDuration(c.Val())
+					if err != nil || timeout <= 0 {
+						return nil, c.Errf("openidauth: invalid login_timeout %q", c.Val())
+					}
+					cfg.login().Timeout = timeout
+				case "login_return_urls":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return nil, c.ArgErr()
+					}
+					login := cfg.login()
+					login.ReturnURLs = append(login.ReturnURLs, args...)
+				case "login_landing_page":
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					cfg.login().LandingPage = c.Val()
+				case "logout":
+					args := c.RemainingArgs()
+					if len(args) == 0 || len(args) > 2 {
+						return nil, c.ArgErr()
+					}
+					login := cfg.login()
+					login.LogoutPath = args[0]
+					if len(args) == 2 {
+						login.PostLogoutRedirect = args[1]
+					}
+				case "backchannel_logout":
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					cfg.login().BackchannelLogoutPath = c.Val()
+				case "frontchannel_logout":
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					cfg.login().FrontchannelLogoutPath = c.Val()
+				case "session_key":
+					key, err := parseSingleValue(c)
+					if err != nil {
+						return nil, err
+					}
+					cfg.login().SessionKey = key
+				case "session_key_file":
+					file, err := parseSingleValue(c)
+					if err != nil {
+						return nil, err
+					}
+					cfg.login().SessionKeyFile = file
+				case "stateless_login":
+					if c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					cfg.login().StatelessLogin = true
+				case "session_cookie":
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					cfg.login().CookieName = c.Val()
+				case "session_domain":
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					cfg.login().CookieDomain = c.Val()
+				case "session_samesite":
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					if _, err := parseSameSite(c.Val()); err != nil {
+						return nil, c.Errf("openidauth: %v", err)
+					}
+					cfg.login().CookieSameSite = c.Val()
+				case "session_lifetime":
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					lifetime, err := time.ParseDuration(c.Val())
+					if err != nil || lifetime <= 0 {
+						return nil, c.Errf("openidauth: invalid session_lifetime %q", c.Val())
+					}
+					cfg.login().SessionLifetime = lifetime
+				case "session_idle_timeout":
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					timeout, err := time.ParseDuration(c.Val())
+					if err != nil || timeout <= 0 {
+						return nil, c.Errf("openidauth: invalid session_idle_timeout %q", c.Val())
+					}
+					cfg.login().SessionIdleTimeout = timeout
+				case "session_max_lifetime":
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					lifetime, err := time.ParseDuration(c.Val())
+					if err != nil || lifetime <= 0 {
+						return nil, c.Errf("openidauth: invalid session_max_lifetime %q", c.Val())
+					}
+					cfg.login().SessionMaxLifetime = lifetime
+				case "session_limit":
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					limit, err := strconv.Atoi(c.Val())
+					if err != nil || limit <= 0 {
+						return nil, c.Errf("openidauth: invalid session_limit %q", c.Val())
+					}
+					cfg.login().SessionLimit = limit
+				case "require_claim":
+					req, err := parseClaimRequirement(c)
+					if err != nil {
+						return nil, err
+					}
+					cfg.RequiredClaims = append(cfg.RequiredClaims, req)
+				case "require":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return nil, c.ArgErr()
+					}
+					cfg.Require = append(cfg.Require, joinPolicyArgs(args))
+				case "policy":
+					args := c.RemainingArgs()
+					if len(args) < 2 {
+						return nil, c.ArgErr()
+					}
+					if cfg.Policies == nil {
+						cfg.Policies = make(map[string]string)
+					}
+					cfg.Policies[args[0]] = joinPolicyArgs(args[1:])
+				case "validate":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return nil, c.ArgErr()
+					}
+					cfg.Validators = append(cfg.Validators, args...)
+				case "opa":
+					endpoint, timeout, err := parseEndpoint(c)
+					if err != nil {
+						return nil, err
+					}
+					cfg.OPA, cfg.OPATimeout = endpoint, timeout
+				case "authz_webhook":
+					endpoint, timeout, err := parseEndpoint(c)
+					if err != nil {
+						return nil, err
+					}
+					cfg.AuthzWebhook, cfg.AuthzWebhookTimeout = endpoint, timeout
+				case "authz_webhook_header":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return nil, c.ArgErr()
+					}
+					cfg.AuthzWebhookHeaders = append(cfg.AuthzWebhookHeaders, args...)
+				case "bypass_cidr":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return nil, c.ArgErr()
+					}
+					cfg.BypassCIDRs = append(cfg.BypassCIDRs, args...)
+				case "require_both":
+					if c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					cfg.RequireBoth = true
+				case "failure_limit":
+					args := c.RemainingArgs()
+					if len(args) < 2 || len(args) > 3 {
+						return nil, c.ArgErr()
+					}
+					limit, err := strconv.Atoi(args[0])
+					if err != nil || limit < 1 {
+						return nil, c.Errf("openidauth: invalid failure_limit %q", args[0])
+					}
+					window, err := time.ParseDuration(args[1])
+					if err != nil || window <= 0 {
+						return nil, c.Errf("openidauth: invalid failure_limit window %q", args[1])
+					}
+					cfg.FailureLimit, cfg.FailureWindow = limit, window
+					if len(args) == 3 {
+						ban, err := time.ParseDuration(args[2])
+						if err != nil || ban <= 0 {
+							return nil, c.Errf("openidauth: invalid failure_limit ban %q", args[2])
+						}
+						cfg.FailureBan = ban
+					}
+				case "sign_claim_headers":
+					secret, err := parseSingleValue(c)
+					if err != nil {
+						return nil, err
+					}
+					cfg.ClaimHeaderSecret = secret
+				case "sign_claim_headers_file":
+					file, err := parseSingleValue(c)
+					if err != nil {
+						return nil, err
+					}
+					cfg.ClaimHeaderSecretFile = file
+				case "internal_token":
+					internal, err := parseInternalToken(c)
+					if err != nil {
+						return nil, err
+					}
+					cfg.InternalToken = internal
+				case "token_exchange":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return nil, c.ArgErr()
+					}
+					cfg.TokenExchangeAudience, cfg.TokenExchangeScopes = args[0], args[1:]
+				case "require_hd":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return nil, c.ArgErr()
+					}
+					cfg.HostedDomains = append(cfg.HostedDomains, args...)
+				case "require_role":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return nil, c.ArgErr()
+					}
+					cfg.RequiredClaims = append(cfg.RequiredClaims, claimRequirement{Claim: "roles", Values: args})
+				case "token_source":
+					src, err := parseTokenSource(c)
+					if err != nil {
+						return nil, err
+					}
+					cfg.TokenSources = append(cfg.TokenSources, src)
+				case "cache_ttl":
+					value, err := parseSingleValue(c)
+					if err != nil {
+						return nil, err
+					}
+					ttl, err := time.ParseDuration(value)
+					if err != nil || ttl <= 0 {
+						return nil, c.Errf("openidauth: invalid cache_ttl %q", value)
+					}
+					cfg.CacheTTL = ttl
+				case "leeway":
+					value, err := parseSingleValue(c)
+					if err != nil {
+						return nil, err
+					}
+					leeway, err := time.ParseDuration(value)
+					if err != nil || leeway < 0 {
+						return nil, c.Errf("openidauth: invalid leeway %q", value)
+					}
+					cfg.Leeway = leeway
+				case "allowed_algs":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return nil, c.ArgErr()
+					}
+					cfg.AllowedAlgs = append(cfg.AllowedAlgs, args...)
+				case "signing_algs":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return nil, c.ArgErr()
+					}
+					if len(cfg.Providers) == 0 {
+						return nil, errors.New("openidauth: signing_algs must follow an issuer")
+					}
+					p := &cfg.Providers[len(cfg.Providers)-1]
+					p.SigningAlgs = append(p.SigningAlgs, args...)
+				case "hmac_secret":
+					name, secret, err := parseHMACSecret(c)
+					if err != nil {
+						return nil, err
+					}
+					if cfg.HMACSecrets == nil {
+						cfg.HMACSecrets = make(map[string]hmacSecret)
+					}
+					cfg.HMACSecrets[name] = secret
+				case "hmac_secret_file":
+					name, secret, err := parseHMACSecret(c)
+					if err != nil {
+						return nil, err
+					}
+					if cfg.HMACSecrets == nil {
+						cfg.HMACSecrets = make(map[string]hmacSecret)
+					}
+					cfg.HMACSecrets[name] = secret
+				case "api_key":
+					key, err := parseAPIKey(c)
+					if err != nil {
+						return nil, err
+					}
+					cfg.APIKeys = append(cfg.APIKeys, key)
+				case "client_credentials":
+					client, err := parseCertificateClient(c)
+					if err != nil {
+						return nil, err
+					}
+					cfg.ClientCredentials = append(cfg.ClientCredentials, client)
+				case "basic_auth":
+					args := c.RemainingArgs()
+					if len(args) > 1 {
+						return nil, c.ArgErr()
+					}
+					cfg.BasicAuth = introspectionDiscovery
+					if len(args) == 1 {
+						cfg.BasicAuth = args[0]
+					}
+				case "metrics":
+					args := c.RemainingArgs()
+					if len(args) > 1 {
+						return nil, c.ArgErr()
+					}
+					cfg.MetricsPath = "/metrics"
+					if len(args) == 1 {
+						cfg.MetricsPath = args[0]
+					}
+				case "health_checks":
+					args := c.RemainingArgs()
+					if len(args) > 1 {
+						return nil, c.ArgErr()
+					}
+					cfg.HealthChecks = defaultHealthPrefix
+					if len(args) == 1 {
+						cfg.HealthChecks = args[0]
+					}
+				case "dev_mode":
+					args := c.RemainingArgs()
+					if len(args) > 1 {
+						return nil, c.ArgErr()
+					}
+					cfg.DevMode = defaultDevPath
+					if len(args) == 1 {
+						cfg.DevMode = args[0]
+					}
+				case "log_level":
+					level, err := parseSingleValue(c)
+					if err != nil {
+						return nil, err
+					}
+					cfg.LogLevel = level
+				case "mode":
+					mode, err := parseSingleValue(c)
+					if err != nil {
+						return nil, err
+					}
+					cfg.Mode = mode
+				case "admin_api":
+					path, err := parseSingleValue(c)
+					if err != nil {
+						return nil, err
+					}
+					cfg.AdminAPI = path
+				case "admin_api_token":
+					token, err := parseSingleValue(c)
+					if err != nil {
+						return nil, err
+					}
+					cfg.AdminAPIToken = token
+				case "admin_api_token_file":
+					file, err := parseSingleValue(c)
+					if err != nil {
+						return nil, err
+					}
+					cfg.AdminAPITokenFile = file
+				case "admin_api_client":
+					subjects := c.RemainingArgs()
+					if len(subjects) == 0 {
+						return nil, c.ArgErr()
+					}
+					cfg.AdminAPIClients = append(cfg.AdminAPIClients, subjects...)
+				case "audit_log":
+					dest, err := parseSingleValue(c)
+					if err != nil {
+						return nil, err
+					}
+					cfg.AuditLog = dest
+				case "error_format":
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					format, err := parseErrorFormat(c.Val())
+					if err != nil {
+						return nil, c.Errf("openidauth: %v", err)
+					}
+					cfg.ErrorFormat = format
+				case "errors":
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					verbosity, err := parseErrors(c.Val())
+					if err != nil {
+						return nil, c.Errf("openidauth: %v", err)
+					}
+					cfg.Errors = verbosity
+				case "error_page":
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					cfg.ErrorPage = c.Val()
+				case "realm":
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					cfg.Realm = c.Val()
+				case "error_status":
+					class, status, err := parseErrorStatus(c)
+					if err != nil {
+						return nil, err
+					}
+					if cfg.StatusCodes == nil {
+						cfg.StatusCodes = make(map[string]int)
 					}
-					clientIds = append(clientIds, clientID)
+					cfg.StatusCodes[class] = status
+				case "deny_list":
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					cfg.DenyListFile = c.Val()
+				case "deny_list_admin":
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					cfg.DenyListAdmin = c.Val()
+				case "circuit_breaker":
+					args := c.RemainingArgs()
+					if len(args) != 2 {
+						return nil, c.ArgErr()
+					}
+					threshold, err := strconv.Atoi(args[0])
+					if err != nil || threshold < 1 {
+						return nil, c.Errf("openidauth: invalid circuit_breaker threshold %q", args[0])
+					}
+					cooldown, err := time.ParseDuration(args[1])
+					if err != nil || cooldown <= 0 {
+						return nil, c.Errf("openidauth: invalid circuit_breaker cooldown %q", args[1])
+					}
+					cfg.BreakerThreshold, cfg.BreakerCooldown = threshold, cooldown
+				case "provider_outage":
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					if c.Val() != outageFailOpen && c.Val() != outageFailClosed {
+						return nil, c.Errf("openidauth: provider_outage must be %s or %s", outageFailOpen, outageFailClosed)
+					}
+					cfg.ProviderOutage = c.Val()
+				case "http_connect_timeout":
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					timeout, err := time.ParseDuration(c.Val())
+					if err != nil || timeout <= 0 {
+						return nil, c.Errf("openidauth: invalid http_connect_timeout %q", c.Val())
+					}
+					cfg.HTTPClient.ConnectTimeout = timeout
+				case "http_timeout":
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					timeout, err := time.ParseDuration(c.Val())
+					if err != nil || timeout <= 0 {
+						return nil, c.Errf("openidauth: invalid http_timeout %q", c.Val())
+					}
+					cfg.HTTPClient.Timeout = timeout
+				case "http_proxy":
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					cfg.HTTPClient.Proxy = c.Val()
+				case "tls_ca":
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					cfg.HTTPClient.CAFile = c.Val()
+				case "tls_client_cert":
+					args := c.RemainingArgs()
+					if len(args) != 2 {
+						return nil, c.ArgErr()
+					}
+					cfg.HTTPClient.CertFile, cfg.HTTPClient.KeyFile = args[0], args[1]
+				case "tls_min_version":
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					if _, ok := tlsVersions[c.Val()]; !ok {
+						return nil, c.Errf("openidauth: unknown tls_min_version %q", c.Val())
+					}
+					cfg.HTTPClient.MinTLSVersion = c.Val()
+				case "tls_pin":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return nil, c.ArgErr()
+					}
+					for _, pin := range args {
+						if _, err := parsePin(pin); err != nil {
+							return nil, c.Errf("%v", err)
+						}
+					}
+					cfg.HTTPClient.Pins = append(cfg.HTTPClient.Pins, args...)
+				case "strip_token":
+					if c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					cfg.StripToken = true
+				case "max_token_size":
+					value, err := parseSingleValue(c)
+					if err != nil {
+						return nil, err
+					}
+					size, err := strconv.Atoi(value)
+					if err != nil || size <= 0 {
+						return nil, c.Errf("openidauth: invalid max_token_size %q", value)
+					}
+					cfg.MaxTokenSize = size
+				case "require_dpop":
+					if c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					cfg.RequireDPoP = true
+				case "storage":
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					cfg.Storage = c.Val()
+				case "map_claim":
+					m, err := parseClaimMapping(c)
+					if err != nil {
+						return nil, err
+					}
+					cfg.ClaimMappings = append(cfg.ClaimMappings, m)
+				case "claim_header":
+					args := c.RemainingArgs()
+					if len(args) != 2 {
+						return nil, c.ArgErr()
+					}
+					cfg.ClaimHeaders = append(cfg.ClaimHeaders, claimHeader{Claim: args[0], Header: args[1]})
+				default:
+					return nil, c.Errf("openidauth: unknown directive %q", c.Val())
 				}
 			}
 		default:
 			// we don't want any arguments
-			return "", nil, nil, c.ArgErr()
+			return nil, c.ArgErr()
 		}
 	}
-	if issuer == "" {
-		return issuer, clientIds, paths, errors.New("Openidauth: issuer cannot be empty")
+	return cfg, nil
+}
+
+// prepare validates the configuration and fills in defaults.
+func (cfg *Config) prepare() error {
+	// The development provider can be the only one.
+	if len(cfg.Providers) == 0 && cfg.DevMode == "" {
+		return errors.New("openidauth: issuer cannot be empty")
 	}
 
-	if len(clientIds) == 0 {
-		return issuer, clientIds, paths, errors.New("Openidauth: at least 1 clientid needs to be set up")
+	for i := range cfg.Providers {
+		p := &cfg.Providers[i]
+		if !strings.HasPrefix(p.Issuer, "https://") && !cfg.AllowInsecureIssuer {
+			return fmt.Errorf("openidauth: issuer %s must use https, or allow_insecure_issuer must be set for test environments", p.Issuer)
+		}
+		if len(p.ClientIds) == 0 {
+			return fmt.Errorf("openidauth: at least 1 clientid needs to be set up for issuer %s", p.Issuer)
+		}
+		secret, err := expandEnv(p.ClientSecret)
+		if err != nil {
+			return fmt.Errorf("openidauth: client_secret of issuer %s: %v", p.Issuer, err)
+		}
+		p.ClientSecret = secret
+		if p.ClientSecretFile != "" {
+			if p.ClientSecret != "" {
+				return fmt.Errorf("openidauth: issuer %s has both a client_secret and a client_secret_file", p.Issuer)
+			}
+			p.secretFile = &secretFile{Path: p.ClientSecretFile}
+			if _, err := p.secretFile.Value(); err != nil {
+				return fmt.Errorf("openidauth: client_secret_file of issuer %s: %v", p.Issuer, err)
+			}
+		}
+		if p.Introspection != "" && !p.hasClientSecret() {
+			return fmt.Errorf("openidauth: introspection needs a client_secret for issuer %s", p.Issuer)
+		}
+		for name, endpoint := range p.Endpoints {
+			if !containsString(discoveryEndpoints, name) {
+				return fmt.Errorf("openidauth: unknown endpoint %s of issuer %s, known are: %s", name, p.Issuer, strings.Join(discoveryEndpoints, ", "))
+			}
+			if u, err := url.Parse(endpoint); err != nil || !u.IsAbs() {
+				return fmt.Errorf("openidauth: endpoint %s of issuer %s must be an absolute URL", name, p.Issuer)
+			}
+		}
+		if u, err := url.Parse(p.IssuerURL); p.IssuerURL != "" && (err != nil || !u.IsAbs()) {
+			return fmt.Errorf("openidauth: issuer_url of issuer %s must be an absolute URL", p.Issuer)
+		}
+		if isIssuerPattern(p.Issuer) {
+			if len(p.Endpoints) > 0 || p.IssuerURL != "" {
+				return fmt.Errorf("openidauth: endpoints and issuer_url can't be configured for the issuer pattern %s", p.Issuer)
+			}
+			if !strings.HasPrefix(p.Issuer, "https://") {
+				return fmt.Errorf("openidauth: issuer pattern %s must start with https://", p.Issuer)
+			}
+			if p.Introspection != "" {
+				return fmt.Errorf("openidauth: introspection can't be used with the issuer pattern %s", p.Issuer)
+			}
+		}
+	}
+	if cfg.Login != nil && (len(cfg.Providers) == 0 || isIssuerPattern(cfg.Providers[0].Issuer)) {
+		return fmt.Errorf("openidauth: login needs a first issuer that is not a pattern")
+	}
+	if p := cfg.Providers; cfg.Login != nil && p[0].Endpoints["jwks_uri"] != "" &&
+		(p[0].Endpoints["authorization_endpoint"] == "" || p[0].Endpoints["token_endpoint"] == "") {
+		return fmt.Errorf("openidauth: login needs the authorization_endpoint and token_endpoint of issuer %s, its discovery document is not read", p[0].Issuer)
+	}
+
+	if len(cfg.Paths) == 0 {
+		return errors.New("openidauth: at least 1 path needs to be set up")
+	}
+
+	keys := make(map[string]bool)
+	for _, k := range cfg.APIKeys {
+		if keys[k.Name] {
+			return fmt.Errorf("openidauth: api_key %s is configured more than once", k.Name)
+		}
+		if !k.valid() {
+			return fmt.Errorf("openidauth: api_key %s must be the hex encoded SHA-256 hash of the key", k.Name)
+		}
+		keys[k.Name] = true
 	}
 
-	if len(paths) == 0 {
-		return issuer, clientIds, paths, errors.New("Openidauth: at least 1 path needs to be set up")
+	clients := make(map[string]bool)
+	for _, c := range cfg.ClientCredentials {
+		if clients[c.Name] {
+			return fmt.Errorf("openidauth: client_credentials %s is configured more than once", c.Name)
+		}
+		clients[c.Name] = true
+	}
+	if len(clients) > 0 && (len(cfg.Providers) == 0 || isIssuerPattern(cfg.Providers[0].Issuer) ||
+		!cfg.Providers[0].hasClientSecret()) {
+		return errors.New("openidauth: client_credentials needs a first issuer that is not a pattern and has a client_secret")
 	}
 
-	return issuer, clientIds, paths, nil
+	for name, secret := range cfg.HMACSecrets {
+		value, err := readSecret(secret.Secret, secret.File)
+		if err != nil {
+			return fmt.Errorf("openidauth: hmac_secret %s: %v", name, err)
+		}
+		if len(value) < minHMACSecretSize {
+			return fmt.Errorf("openidauth: hmac_secret %s must be at least %d bytes long", name, minHMACSecretSize)
+		}
+		secret.value = value
+		cfg.HMACSecrets[name] = secret
+	}
+
+	if cfg.BasicAuth != "" && (len(cfg.Providers) == 0 || isIssuerPattern(cfg.Providers[0].Issuer) ||
+		!cfg.Providers[0].hasClientSecret()) {
+		return errors.New("openidauth: basic_auth needs a first issuer that is not a pattern and has a client_secret")
+	}
+
+	for _, rule := range cfg.Paths {
+		for _, name := range rule.APIKeys {
+			if !keys[name] {
+				return fmt.Errorf("openidauth: path %s uses the unknown api_key %s", rule.Path, name)
+			}
+		}
+		if rule.OnFailure == "" {
+			rule.OnFailure = failureStatus
+			if cfg.Login != nil {
+				rule.OnFailure = failureAuto
+			}
+		}
+		if (rule.OnFailure == failureRedirect || rule.OnFailure == failureAuto) && cfg.Login == nil {
+			return fmt.Errorf("openidauth: path %s redirects on failure, which needs the login", rule.Path)
+		}
+		if rule.CSRF != "" && cfg.Login == nil {
+			return fmt.Errorf("openidauth: path %s has csrf protection, which is for the sessions of the login", rule.Path)
+		}
+		for _, name := range rule.Clients {
+			if !clients[name] {
+				return fmt.Errorf("openidauth: path %s uses the unknown client_credentials %s", rule.Path, name)
+			}
+		}
+		if _, ok := cfg.HMACSecrets[rule.HMAC]; rule.HMAC != "" && !ok {
+			return fmt.Errorf("openidauth: path %s uses the unknown hmac_secret %s", rule.Path, rule.HMAC)
+		}
+		if _, ok := cfg.Policies[rule.Policy]; rule.Policy != "" && !ok {
+			return fmt.Errorf("openidauth: path %s uses the unknown policy %s", rule.Path, rule.Policy)
+		}
+		for _, iss := range rule.Issuers {
+			known := false
+			for _, p := range cfg.Providers {
+				known = known || p.Issuer == iss
+			}
+			if !known {
+				return fmt.Errorf("openidauth: path %s uses the unknown issuer %s", rule.Path, iss)
+			}
+		}
+	}
+
+	for _, name := range cfg.Validators {
+		if _, ok := registeredValidator(name); !ok {
+			return fmt.Errorf("openidauth: unknown claim validator %s, registered are: %s", name, strings.Join(ValidatorNames(), ", "))
+		}
+	}
+
+	for _, m := range cfg.ClaimMappings {
+		if err := m.validate(); err != nil {
+			return err
+		}
+	}
+
+	if len(cfg.AuthzWebhookHeaders) > 0 && cfg.AuthzWebhook == "" {
+		return errors.New("openidauth: authz_webhook_header needs an authz_webhook")
+	}
+
+	if _, err := parseCIDRs(cfg.BypassCIDRs); err != nil {
+		return err
+	}
+	if cfg.RequireBoth && len(cfg.BypassCIDRs) == 0 {
+		return errors.New("openidauth: require_both needs a bypass_cidr")
+	}
+
+	if cfg.FailureLimit > 0 && cfg.FailureWindow <= 0 {
+		return errors.New("openidauth: failure_limit needs a window")
+	}
+
+	secret, err := readSecret(cfg.ClaimHeaderSecret, cfg.ClaimHeaderSecretFile)
+	if err != nil {
+		return fmt.Errorf("openidauth: sign_claim_headers: %v", err)
+	}
+	cfg.claimHeaderSecret = secret
+	if cfg.claimHeaderSecret != "" && len(cfg.ClaimHeaders) == 0 {
+		return errors.New("openidauth: sign_claim_headers needs a claim_header")
+	}
+	for i := range cfg.ClaimHeaders {
+		// Canonical names are removed from every request without
+		// allocating.
+		cfg.ClaimHeaders[i].Header = http.CanonicalHeaderKey(cfg.ClaimHeaders[i].Header)
+	}
+
+	if cfg.InternalToken != nil {
+		if err := cfg.InternalToken.validate(); err != nil {
+			return err
+		}
+	}
+
+	if cfg.TokenExchangeAudience != "" {
+		for _, p := range cfg.Providers {
+			if !p.hasClientSecret() {
+				return fmt.Errorf("openidauth: token_exchange needs the client_secret of issuer %s", p.Issuer)
+			}
+		}
+	}
+
+	for i, expr := range cfg.Require {
+		if _, err := newPolicy(fmt.Sprintf("require#%d", i+1), expr); err != nil {
+			return err
+		}
+	}
+	for name, expr := range cfg.Policies {
+		if _, err := newPolicy(name, expr); err != nil {
+			return err
+		}
+	}
+
+	if len(cfg.TokenSources) == 0 {
+		cfg.TokenSources = defaultTokenSources
+	}
+
+	if len(cfg.AllowedAlgs) == 0 {
+		cfg.AllowedAlgs = defaultAllowedAlgs
+	}
+	algs := append([]string(nil), cfg.AllowedAlgs...)
+	for _, p := range cfg.Providers {
+		algs = append(algs, p.SigningAlgs...)
+	}
+	for _, alg := range algs {
+		if strings.EqualFold(alg, "none") {
+			return errors.New("openidauth: unsigned tokens (alg none) can never be allowed")
+		}
+		if !isSupportedAlg(alg) {
+			return fmt.Errorf("openidauth: unsupported algorithm %s in allowed_algs or signing_algs", alg)
+		}
+	}
+
+	if cfg.CacheTTL <= 0 {
+		cfg.CacheTTL = defaultCacheTTL
+	}
+
+	if cfg.ErrorFormat == "" {
+		cfg.ErrorFormat = errorFormatText
+	} else if _, err := parseErrorFormat(cfg.ErrorFormat); err != nil {
+		return fmt.Errorf("openidauth: %v", err)
+	}
+
+	// The admin endpoint is only served to authenticated requests.
+	if cfg.DenyListAdmin != "" && !cfg.protects(cfg.DenyListAdmin) {
+		return fmt.Errorf("openidauth: deny_list_admin %s must be inside a protected path", cfg.DenyListAdmin)
+	}
+
+	if cfg.AdminAPI != "" && !strings.HasPrefix(cfg.AdminAPI, "/") {
+		return fmt.Errorf("openidauth: admin_api %s must be an absolute path", cfg.AdminAPI)
+	}
+	if cfg.adminAPIToken, err = readSecret(cfg.AdminAPIToken, cfg.AdminAPITokenFile); err != nil {
+		return fmt.Errorf("openidauth: admin_api_token: %v", err)
+	}
+	// Every client has a loopback address behind a sidecar or a proxy on
+	// the same host, so that alone doesn't authorize anything.
+	if cfg.AdminAPI != "" && cfg.adminAPIToken == "" && len(cfg.AdminAPIClients) == 0 {
+		return fmt.Errorf("openidauth: admin_api %s needs an admin_api_token or admin_api_client", cfg.AdminAPI)
+	}
+
+	for class, status := range cfg.StatusCodes {
+		if !errorClasses[class] {
+			return fmt.Errorf("openidauth: unknown error class %q", class)
+		}
+		if status < 400 || status > 599 {
+			return fmt.Errorf("openidauth: invalid status code %d for %s", status, class)
+		}
+	}
+
+	if cfg.HTTPClient.ConnectTimeout == 0 {
+		cfg.HTTPClient.ConnectTimeout = defaultConnectTimeout
+	}
+	if cfg.HTTPClient.Timeout == 0 {
+		cfg.HTTPClient.Timeout = defaultHTTPTimeout
+	}
+
+	if cfg.BreakerThreshold == 0 {
+		cfg.BreakerThreshold = defaultBreakerThreshold
+	}
+	if cfg.BreakerCooldown == 0 {
+		cfg.BreakerCooldown = defaultBreakerCooldown
+	}
+	switch cfg.ProviderOutage {
+	case "":
+		cfg.ProviderOutage = outageFailClosed
+	case outageFailOpen, outageFailClosed:
+	default:
+		return fmt.Errorf("openidauth: provider_outage must be %s or %s", outageFailOpen, outageFailClosed)
+	}
+
+	switch cfg.Mode {
+	case "":
+		cfg.Mode = modeEnforce
+	case modeEnforce, modeShadow:
+	default:
+		return fmt.Errorf("openidauth: mode must be %s or %s", modeEnforce, modeShadow)
+	}
+
+	switch cfg.LogLevel {
+	case "":
+		cfg.LogLevel = logLevelInfo
+	case logLevelInfo, logLevelDebug:
+	default:
+		return fmt.Errorf("openidauth: log_level must be %s or %s", logLevelInfo, logLevelDebug)
+	}
+
+	if cfg.MaxTokenSize == 0 {
+		cfg.MaxTokenSize = defaultMaxTokenSize
+	}
+
+	if cfg.IntrospectionCacheTTL == 0 {
+		cfg.IntrospectionCacheTTL = defaultIntrospectionCacheTTL
+	}
+
+	if cfg.Login != nil {
+		if cfg.Login.CallbackPath == "" {
+			cfg.Login.CallbackPath = defaultCallbackPath
+		}
+		if len(cfg.Login.Scopes) == 0 {
+			cfg.Login.Scopes = defaultLoginScopes
+		}
+		if cfg.Login.LogoutPath != "" && cfg.Login.PostLogoutRedirect == "" {
+			cfg.Login.PostLogoutRedirect = "/"
+		}
+		if cfg.Login.Timeout == 0 {
+			cfg.Login.Timeout = defaultLoginTimeout
+		}
+		if cfg.Login.LandingPage == "" {
+			cfg.Login.LandingPage = defaultLandingPage
+		}
+		if !strings.HasPrefix(cfg.Login.LandingPage, "/") && !strings.HasPrefix(cfg.Login.LandingPage, "https://") &&
+			!strings.HasPrefix(cfg.Login.LandingPage, "http://") {
+			return fmt.Errorf("openidauth: login_landing_page must be a path or an absolute URL, got %q", cfg.Login.LandingPage)
+		}
+		for _, entry := range cfg.Login.ReturnURLs {
+			if entry == "" || strings.Contains(entry, "://") {
+				return fmt.Errorf("openidauth: invalid login_return_urls entry %q, use a path or a host with an optional path", entry)
+			}
+		}
+		if cfg.Login.CookieName == "" {
+			cfg.Login.CookieName = defaultSessionCookieName
+		}
+		key, err := readSecret(cfg.Login.SessionKey, cfg.Login.SessionKeyFile)
+		if err != nil {
+			return fmt.Errorf("openidauth: session_key: %v", err)
+		}
+		cfg.Login.sessionKey = key
+		if key != "" {
+			if _, err := parseKey(key); err != nil {
+				return fmt.Errorf("openidauth: invalid session_key: %v", err)
+			}
+		}
+		if cfg.Login.StatelessLogin && key == "" {
+			return errors.New("openidauth: stateless_login requires a session_key")
+		}
+		if cfg.Login.SessionLimit > 0 && key != "" {
+			return errors.New("openidauth: session_limit needs the sessions in the storage, it can't be used with session_key")
+		}
+		cfg.Login.Bind = cfg.Fingerprint
+	}
+	if cfg.Fingerprint != "" && cfg.Fingerprint != bindRevalidate && cfg.Fingerprint != bindReject {
+		return fmt.Errorf("openidauth: fingerprint must be %s or %s", bindRevalidate, bindReject)
+	}
+	if cfg.Fingerprint != "" && cfg.ValidationCacheTTL == 0 && cfg.Login == nil {
+		return errors.New("openidauth: fingerprint binds remembered tokens and sessions, it needs validation_cache_ttl or login")
+	}
+
+	return nil
+}
+
+// protects reports whether a path requires authentication.
+func (cfg *Config) protects(path string) bool {
+	for _, e := range cfg.Exceptions {
+		if e.Matches(path) {
+			return false
+		}
+	}
+	// The first matching rule applies, it must cover all methods.
+	for _, p := range cfg.Paths {
+		if p.Path.Matches(path) {
+			return !p.Optional && len(p.Methods) == 0
+		}
+	}
+	return false
+}
+
+// login returns the login settings, enabling the interactive login if it
+// is not already.
+func (cfg *Config) login() *loginConfig {
+	if cfg.Login == nil {
+		cfg.Login = &loginConfig{}
+	}
+	return cfg.Login
 }
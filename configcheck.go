@@ -0,0 +1,111 @@
+package openidauth
+
+import (
+	"fmt"
+	"strings"
+)
+
+// configErrors reports everything that is wrong with a configuration at
+// once, so it can be fixed in one go.
+type configErrors []error
+
+func (e configErrors) Error() string {
+	if len(e) == 1 {
+		return "openidauth: " + e[0].Error()
+	}
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = "  - " + err.Error()
+	}
+	return fmt.Sprintf("openidauth: %d configuration errors:\n%s", len(e), strings.Join(lines, "\n"))
+}
+
+// check looks for mistakes that prepare lets through because the
+// configuration still makes sense, but that would only show at request
+// time: empty client ids, path rules that never match because an earlier
+// rule takes their requests, and issuers whose discovery document can't be
+// read or doesn't match. With fail_open the middleware is meant to run while
+// the providers are down, unreachable issuers don't stop it then.
+func (cfg *Config) check(cache *fetchCache) error {
+	var errs configErrors
+	for _, p := range cfg.Providers {
+		for _, id := range p.ClientIds {
+			if strings.TrimSpace(id) == "" {
+				errs = append(errs, fmt.Errorf("issuer %s has an empty clientid", p.Issuer))
+			}
+		}
+	}
+
+	for i, rule := range cfg.Paths {
+		for _, earlier := range cfg.Paths[:i] {
+			if shadows(earlier, rule) {
+				errs = append(errs, fmt.Errorf("path %s never applies, the earlier path %s already matches its requests",
+					rule.Path, earlier.Path))
+				break
+			}
+		}
+	}
+
+	for _, p := range cfg.Providers {
+		if isIssuerPattern(p.Issuer) || p.JWKSFile != "" || len(p.PublicKeyFiles) > 0 || p.Endpoints["jwks_uri"] != "" {
+			continue
+		}
+		if err := checkDiscovery(p, cache); err != nil && cfg.ProviderOutage != outageFailOpen {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// shadows reports whether the earlier rule matches all the requests of the
+// later one, which is then never used. Patterns are compared as prefixes,
+// globs and regular expressions only when they are the same.
+func shadows(earlier, later *pathRule) bool {
+	if !containsMethods(earlier.Methods, later.Methods) {
+		return false
+	}
+	if earlier.Path.Pattern == later.Path.Pattern {
+		return true
+	}
+	return earlier.Path.re == nil && later.Path.re == nil &&
+		strings.HasPrefix(later.Path.Pattern, earlier.Path.Pattern)
+}
+
+// containsMethods reports whether all methods in b are in a. No methods
+// stands for all of them.
+func containsMethods(a, b []string) bool {
+	if len(a) == 0 {
+		return true
+	}
+	if len(b) == 0 {
+		return false
+	}
+	for _, m := range b {
+		if !containsString(a, m) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkDiscovery reads the discovery document of the issuer, which also
+// warms the cache for the first requests. The multi-tenant endpoints of Azure
+// AD don't name a single issuer in their document.
+func checkDiscovery(p providerConfig, cache *fetchCache) error {
+	issuer := p.Issuer
+	doc, err := newDiscovery(p, cache).Document()
+	if err != nil {
+		return fmt.Errorf("issuer %s: discovery failed, check the issuer URL and that Caddy can reach it: %v", issuer, err)
+	}
+	if doc.Issuer != issuer && p.Profile != profileAzure {
+		return fmt.Errorf("issuer %s: the discovery document is for the issuer %s, the issuer must be configured exactly as in the tokens", issuer, doc.Issuer)
+	}
+	if doc.JwksURI == "" {
+		return fmt.Errorf("issuer %s: the discovery document has no jwks_uri, use jwks_file or public_key instead", issuer)
+	}
+	return nil
+}
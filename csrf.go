@@ -0,0 +1,86 @@
+package openidauth
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// csrfHeader requires a custom header on unsafe requests. Browsers only
+	// send custom headers cross-site after a CORS preflight, which the
+	// backend does not allow, so pages of other sites can't send them.
+	csrfHeader = "header"
+
+	// csrfDoubleSubmit requires the value of the CSRF cookie in the
+	// X-CSRF-Token header of unsafe requests. Only scripts of the site can
+	// read the cookie.
+	csrfDoubleSubmit = "double_submit"
+
+	csrfCookieName    = "openidauth_csrf"
+	csrfTokenHeader   = "X-CSRF-Token"
+	csrfRequestedWith = "X-Requested-With"
+)
+
+// safeMethod reports whether the method does not change state, those
+// requests need no CSRF protection.
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// checkCSRF protects requests authenticated by the session cookie, which
+// browsers send with requests started by any site. Unsafe requests must come
+// from a page of the same host and carry what the mode of the path requires.
+// Requests with tokens are not affected, browsers don't add those on their
+// own.
+func (l *loginHandler) checkCSRF(r *http.Request, mode string) error {
+	if mode == "" || safeMethod(r.Method) {
+		return nil
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || !strings.EqualFold(u.Host, r.Host) {
+			return &authorizationError{Code: "invalid_request", Description: "The request comes from another site"}
+		}
+	}
+	switch mode {
+	case csrfHeader:
+		if r.Header.Get(csrfRequestedWith) != "" || r.Header.Get(csrfTokenHeader) != "" {
+			return nil
+		}
+	case csrfDoubleSubmit:
+		cookie, err := r.Cookie(csrfCookieName)
+		token := r.Header.Get(csrfTokenHeader)
+		if err == nil && token != "" && subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(token)) == 1 {
+			return nil
+		}
+	}
+	return &authorizationError{Code: "invalid_request", Description: "The request is missing a valid CSRF token"}
+}
+
+// setCSRFCookie gives the browser the CSRF cookie for the double submit mode
+// if it has none yet. Scripts read it to send it back in the header.
+func (l *loginHandler) setCSRFCookie(w http.ResponseWriter, r *http.Request, mode string) {
+	if mode != csrfDoubleSubmit {
+		return
+	}
+	if _, err := r.Cookie(csrfCookieName); err == nil {
+		return
+	}
+	token, err := randomString(32)
+	if err != nil {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Domain:   l.Cookie.Domain,
+		Path:     "/",
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
@@ -0,0 +1,79 @@
+package openidauth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emanoelxavier/openid2go/openid"
+)
+
+// Log levels.
+const (
+	logLevelInfo  = "info"
+	logLevelDebug = "debug"
+)
+
+// Claims whose values are logged in debug mode. Only the names of the
+// other claims are logged, they may hold personal data.
+var debugClaims = []string{"iss", "sub", "aud", "azp", "client_id", "scope", "scp", "acr", "amr", "exp", "nbf", "iat", "auth_time"}
+
+// debugf logs a step of handling the request if the log level is debug.
+// Tokens and secrets must never be passed, use tokenSummary. The arguments
+// are evaluated even if the log level is info, calls on the path of every
+// request check h.Debug first.
+func (h auth) debugf(r *http.Request, format string, args ...interface{}) {
+	if !h.Debug {
+		return
+	}
+	log.Printf("openidauth: debug: [%s] %s %s: %s", requestID(r), r.Method, r.URL.Path, fmt.Sprintf(format, args...))
+}
+
+// tokenSummary describes a token for the debug log without revealing it:
+// its fingerprint, which is the value to put in the deny list, and for JWTs
+// the header and the claim summary, read without verifying the token.
+func tokenSummary(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	fingerprint := hex.EncodeToString(sum[:])
+	t, err := parseJWT(token)
+	if err != nil {
+		if looksLikeJWT(token) {
+			return fmt.Sprintf("sha256=%s, encrypted or malformed JWT", fingerprint)
+		}
+		return fmt.Sprintf("sha256=%s, opaque token", fingerprint)
+	}
+	return fmt.Sprintf("sha256=%s, alg=%s kid=%q, %s", fingerprint, t.Header.Alg, t.Header.Kid, claimSummary(t.Claims))
+}
+
+// claimSummary lists the values of the well-known claims and the names of
+// the others.
+func claimSummary(claims map[string]interface{}) string {
+	var known, other []string
+	for name, value := range claims {
+		if !containsString(debugClaims, name) {
+			other = append(other, name)
+			continue
+		}
+		if t := claimTime(value); !t.IsZero() && name != "iss" && name != "sub" {
+			known = append(known, fmt.Sprintf("%s=%s", name, t.UTC().Format(time.RFC3339)))
+			continue
+		}
+		known = append(known, fmt.Sprintf("%s=%v", name, value))
+	}
+	sort.Strings(known)
+	sort.Strings(other)
+	return fmt.Sprintf("claims %s, other claims: %s", strings.Join(known, " "), strings.Join(other, ","))
+}
+
+// userSummary describes the authenticated user for the debug log.
+func userSummary(u *openid.User) string {
+	if u == nil {
+		return "no user"
+	}
+	return claimSummary(u.Claims)
+}
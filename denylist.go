@@ -0,0 +1,266 @@
+package openidauth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emanoelxavier/openid2go/openid"
+)
+
+// Kinds of deny list entries.
+const (
+	denyJTI   = "jti"
+	denySub   = "sub"
+	denyToken = "token"
+)
+
+// anyIssuer is the issuer of subjects denied whatever their issuer.
+const anyIssuer = "*"
+
+// denyEntry is a denied token id, subject or token. Tokens are identified by
+// the hex encoded SHA-256 hash of the token. Subjects are only unique per
+// issuer, so they are denied for the Issuer, or for any issuer if it is
+// anyIssuer.
+type denyEntry struct {
+	Type   string `json:"type"`
+	Issuer string `json:"issuer,omitempty"`
+	Value  string `json:"value"`
+}
+
+// denyList rejects tokens that are still valid but must not be used anymore,
+// like compromised ones. Entries are read from a file, which is reloaded when
+// it changes, and can be added and removed through the admin endpoint.
+// Entries managed through the endpoint are kept in the storage, and the
+// instances sharing it pick up changes within a few seconds.
+type denyList struct {
+	File      string
+	AdminPath string
+	Storage   storage
+
+	mu      sync.Mutex
+	checked time.Time
+	mtime   time.Time
+	file    map[denyEntry]bool
+	dynamic map[denyEntry]bool
+}
+
+func newDenyList(file, adminPath string, store storage) (*denyList, error) {
+	d := &denyList{File: file, AdminPath: adminPath, Storage: store}
+	dynamic, err := d.loadDynamic()
+	if err != nil {
+		return nil, err
+	}
+	d.dynamic = dynamic
+	d.checked = time.Now()
+	if file != "" {
+		entries, err := readDenyList(file)
+		if err != nil {
+			return nil, err
+		}
+		d.file = entries
+		if info, err := os.Stat(file); err == nil {
+			d.mtime = info.ModTime()
+		}
+	}
+	return d, nil
+}
+
+// Denied returns an error if the token or its user is on the list.
+func (d *denyList) Denied(u *openid.User, token string) error {
+	if d == nil {
+		return nil
+	}
+	entries := []denyEntry{
+		{Type: denySub, Issuer: u.Issuer, Value: u.ID},
+		{Type: denySub, Issuer: anyIssuer, Value: u.ID},
+	}
+	if jti, _ := u.Claims["jti"].(string); jti != "" {
+		entries = append(entries, denyEntry{Type: denyJTI, Value: jti})
+	}
+	if token != "" {
+		sum := sha256.Sum256([]byte(token))
+		entries = append(entries, denyEntry{Type: denyToken, Value: hex.EncodeToString(sum[:])})
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.reload()
+	for _, e := range entries {
+		if e.Value != "" && (d.file[e] || d.dynamic[e]) {
+			return validationError(openid.ValidationErrorJwtValidationFailure, http.StatusUnauthorized,
+				"The token has been revoked", nil)
+		}
+	}
+	return nil
+}
+
+// reload reads the entries again if they have changed. The old entries are
+// kept if they can't be read.
+func (d *denyList) reload() {
+	if time.Since(d.checked) < keyFileCheckInterval {
+		return
+	}
+	d.checked = time.Now()
+	if dynamic, err := d.loadDynamic(); err == nil {
+		d.dynamic = dynamic
+	}
+	if d.File == "" {
+		return
+	}
+	info, err := os.Stat(d.File)
+	if err != nil || info.ModTime().Equal(d.mtime) {
+		return
+	}
+	if entries, err := readDenyList(d.File); err == nil {
+		d.file, d.mtime = entries, info.ModTime()
+	}
+}
+
+// readDenyList reads a deny list file. Each line is an entry type and value,
+// with the issuer before the value of subjects. Blank lines and lines
+// starting with # are ignored:
+//
+//	jti 4f1g23a12aa
+//	sub https://accounts.google.com 248289761001
+//	sub * 248289761001
+//	token 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+func readDenyList(name string) (map[denyEntry]bool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := make(map[denyEntry]bool)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		var e denyEntry
+		switch {
+		case len(fields) == 3 && fields[0] == denySub:
+			e = denyEntry{Type: fields[0], Issuer: fields[1], Value: fields[2]}
+		case len(fields) == 2 && fields[0] != denySub:
+			e = denyEntry{Type: fields[0], Value: fields[1]}
+		case len(fields) == 2:
+			return nil, fmt.Errorf("openidauth: %s:%d: expected issuer and value of sub, use * as the issuer to deny the subject of any issuer", name, line)
+		default:
+			return nil, fmt.Errorf("openidauth: %s:%d: expected type and value", name, line)
+		}
+		if err := e.check(); err != nil {
+			return nil, fmt.Errorf("openidauth: %s:%d: %v", name, line, err)
+		}
+		entries[e] = true
+	}
+	return entries, scanner.Err()
+}
+
+// loadDynamic reads the entries managed through the admin endpoint.
+func (d *denyList) loadDynamic() (map[denyEntry]bool, error) {
+	entries := make(map[denyEntry]bool)
+	value, err := d.Storage.Get("deny_list")
+	if err != nil || value == nil {
+		return entries, err
+	}
+	var list []denyEntry
+	if err := json.Unmarshal(value, &list); err != nil {
+		return nil, err
+	}
+	for _, e := range list {
+		entries[e] = true
+	}
+	return entries, nil
+}
+
+// saveDynamic stores the entries managed through the admin endpoint.
+func (d *denyList) saveDynamic(entries map[denyEntry]bool) error {
+	list := make([]denyEntry, 0, len(entries))
+	for e := range entries {
+		list = append(list, e)
+	}
+	value, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return d.Storage.Set("deny_list", value, 0)
+}
+
+func (e denyEntry) check() error {
+	switch e.Type {
+	case denySub:
+		if e.Issuer == "" {
+			return errors.New("sub deny list entry without an issuer, use * to deny the subject of any issuer")
+		}
+	case denyJTI, denyToken:
+		if e.Issuer != "" {
+			return fmt.Errorf("%s deny list entry with an issuer", e.Type)
+		}
+	default:
+		return fmt.Errorf("unknown deny list entry type %q", e.Type)
+	}
+	if e.Value == "" {
+		return errors.New("deny list entry without a value")
+	}
+	return nil
+}
+
+// ServeAdmin manages the entries of the list: GET lists them, POST adds the
+// entry in the request body and DELETE removes it. Only the entries added
+// through the endpoint can be removed.
+func (d *denyList) ServeAdmin(w http.ResponseWriter, r *http.Request) (int, error) {
+	switch r.Method {
+	case http.MethodGet:
+		d.mu.Lock()
+		d.reload()
+		entries := make([]denyEntry, 0, len(d.file)+len(d.dynamic))
+		for e := range d.file {
+			entries = append(entries, e)
+		}
+		for e := range d.dynamic {
+			entries = append(entries, e)
+		}
+		d.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+		return 0, nil
+	case http.MethodPost, http.MethodDelete:
+		var e denyEntry
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&e); err != nil {
+			return http.StatusBadRequest, err
+		}
+		if err := e.check(); err != nil {
+			return http.StatusBadRequest, err
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		dynamic, err := d.loadDynamic()
+		if err != nil {
+			return http.StatusServiceUnavailable, err
+		}
+		if r.Method == http.MethodPost {
+			dynamic[e] = true
+		} else {
+			delete(dynamic, e)
+		}
+		if err := d.saveDynamic(dynamic); err != nil {
+			return http.StatusServiceUnavailable, err
+		}
+		d.dynamic = dynamic
+		w.WriteHeader(http.StatusNoContent)
+		return 0, nil
+	}
+	w.Header().Set("Allow", "GET, POST, DELETE")
+	return http.StatusMethodNotAllowed, nil
+}
@@ -0,0 +1,155 @@
+package openidauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDevPath = "/openidauth/dev"
+
+	// The issuer and client id of the tokens of the development provider.
+	devIssuer   = "https://openidauth.dev.invalid"
+	devClientID = "dev"
+	devKid      = "dev"
+
+	defaultDevTokenTTL = time.Hour
+)
+
+// devProvider is an OpenID provider inside the middleware for local
+// development, so the stack can run without the real provider. It signs
+// tokens with a key created at startup, which the middleware trusts like the
+// keys of the configured providers. Everyone who can reach the token
+// endpoint can get any token, it must never be enabled in production.
+//
+//	GET  <path>/.well-known/openid-configuration
+//	GET  <path>/jwks
+//	POST <path>/token     sub, scope, aud, ttl and claims (a JSON object)
+type devProvider struct {
+	Path string
+	Key  *ecdsa.PrivateKey
+}
+
+func newDevProvider(path string) (*devProvider, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &devProvider{Path: strings.TrimSuffix(path, "/"), Key: key}, nil
+}
+
+// issuerValidator returns the validator of the tokens of the provider.
+func (d *devProvider) issuerValidator(cache *fetchCache) *issuerValidator {
+	i := newIssuerValidator(providerConfig{Issuer: devIssuer, ClientIds: []string{devClientID}}, cache)
+	i.LocalKeys = d
+	return i
+}
+
+// Keys returns the public key of the provider.
+func (d *devProvider) Keys() ([]publicKey, error) {
+	return []publicKey{{Kid: devKid, Alg: "ES256", Key: d.Key.Public()}}, nil
+}
+
+// matches reports whether the request is for the provider.
+func (d *devProvider) matches(r *http.Request) bool {
+	return d != nil && strings.HasPrefix(r.URL.Path, d.Path+"/")
+}
+
+// ServeHTTP answers the requests to the endpoints of the provider.
+func (d *devProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	switch strings.TrimPrefix(r.URL.Path, d.Path) {
+	case "/.well-known/openid-configuration":
+		base := "http://" + r.Host + d.Path
+		if r.TLS != nil {
+			base = "https://" + r.Host + d.Path
+		}
+		return writeJSON(w, map[string]interface{}{
+			"issuer":                                devIssuer,
+			"jwks_uri":                              base + "/jwks",
+			"token_endpoint":                        base + "/token",
+			"id_token_signing_alg_values_supported": []string{"ES256"},
+		})
+	case "/jwks":
+		return writeJSON(w, map[string]interface{}{"keys": []jsonWebKey{d.jwk()}})
+	case "/token":
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			return http.StatusMethodNotAllowed, nil
+		}
+		return d.serveToken(w, r)
+	}
+	return http.StatusNotFound, nil
+}
+
+// serveToken mints a token with the claims in the form.
+func (d *devProvider) serveToken(w http.ResponseWriter, r *http.Request) (int, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, 64<<10)
+	if err := r.ParseForm(); err != nil {
+		return http.StatusBadRequest, err
+	}
+	claims := make(map[string]interface{})
+	if raw := r.Form.Get("claims"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &claims); err != nil {
+			http.Error(w, "claims must be a JSON object", http.StatusBadRequest)
+			return 0, nil
+		}
+	}
+	ttl := defaultDevTokenTTL
+	if s := r.Form.Get("ttl"); s != "" {
+		var err error
+		if ttl, err = time.ParseDuration(s); err != nil {
+			http.Error(w, "invalid ttl", http.StatusBadRequest)
+			return 0, nil
+		}
+	}
+
+	now := time.Now()
+	claims["iss"] = devIssuer
+	claims["sub"] = "dev-user"
+	if sub := r.Form.Get("sub"); sub != "" {
+		claims["sub"] = sub
+	}
+	claims["aud"] = devClientID
+	if aud := r.Form.Get("aud"); aud != "" {
+		claims["aud"] = aud
+	}
+	if scope := r.Form.Get("scope"); scope != "" {
+		claims["scope"] = scope
+	}
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(ttl).Unix()
+
+	token, err := encodeJWT(jwtHeader{Alg: "ES256", Kid: devKid, Typ: "JWT"}, claims, d.Key)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return writeJSON(w, map[string]interface{}{
+		"access_token": token,
+		"id_token":     token,
+		"token_type":   "Bearer",
+		"expires_in":   int(ttl / time.Second),
+	})
+}
+
+// jwk returns the public key as a JWK.
+func (d *devProvider) jwk() jsonWebKey {
+	size := (d.Key.Curve.Params().BitSize + 7) / 8
+	x, y := make([]byte, size), make([]byte, size)
+	d.Key.X.FillBytes(x)
+	d.Key.Y.FillBytes(y)
+	return jsonWebKey{
+		Kty: "EC",
+		Kid: devKid,
+		Use: "sig",
+		Alg: "ES256",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(x),
+		Y:   base64.RawURLEncoding.EncodeToString(y),
+	}
+}
@@ -0,0 +1,140 @@
+package openidauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// discoveryDocument holds the parts of the OpenID provider metadata that the
+// middleware uses. See https://openid.net/specs/openid-connect-discovery-1_0.html
+type discoveryDocument struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+	IntrospectionEndpoint string `json:"introspection_endpoint"`
+}
+
+// discoveryEndpoints are the endpoints of the document that can be
+// configured, see providerConfig.Endpoints.
+var discoveryEndpoints = []string{
+	"authorization_endpoint",
+	"token_endpoint",
+	"jwks_uri",
+	"userinfo_endpoint",
+	"end_session_endpoint",
+	"introspection_endpoint",
+}
+
+// discovery reads the discovery document of an issuer through the fetch
+// cache. If the middleware reaches the provider at another URL than the
+// issuer, the document is read from there and the endpoints the middleware
+// calls are moved there too; those the browsers are sent to are kept. The
+// Endpoints replace those in the document. With a jwks_uri the document is
+// not fetched at all, for providers whose document is broken or can't be
+// reached.
+// The decoded document is kept and shared by the requests until the fetch
+// cache returns a new version of it.
+type discovery struct {
+	Issuer    string
+	URL       string
+	Cache     *fetchCache
+	Endpoints map[string]string
+
+	mu   sync.RWMutex
+	body []byte
+	doc  *discoveryDocument
+}
+
+func newDiscovery(p providerConfig, cache *fetchCache) *discovery {
+	return &discovery{Issuer: p.Issuer, URL: p.IssuerURL, Cache: cache, Endpoints: p.Endpoints}
+}
+
+// Document returns the discovery document of the issuer. It is shared, the
+// callers must not change it.
+func (d *discovery) Document() (*discoveryDocument, error) {
+	var body []byte
+	if d.Endpoints["jwks_uri"] == "" {
+		var err error
+		if body, err = d.Cache.Get(d.documentURL()); err != nil {
+			return nil, err
+		}
+	}
+
+	d.mu.RLock()
+	doc := d.doc
+	current := doc != nil && bytes.Equal(body, d.body)
+	d.mu.RUnlock()
+	if current {
+		return doc, nil
+	}
+
+	doc, err := d.decode(body)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	d.body, d.doc = body, doc
+	d.mu.Unlock()
+	return doc, nil
+}
+
+// fetchedURLs returns the URLs of the documents of the issuer that may be
+// in the fetch cache: the discovery document and the JWKS it points to.
+func (d *discovery) fetchedURLs() []string {
+	var urls []string
+	if d.Endpoints["jwks_uri"] == "" {
+		urls = append(urls, d.documentURL())
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.doc != nil && d.doc.JwksURI != "" {
+		urls = append(urls, d.doc.JwksURI)
+	}
+	return urls
+}
+
+// documentURL returns the URL of the discovery document.
+func (d *discovery) documentURL() string {
+	base := d.Issuer
+	if d.URL != "" {
+		base = d.URL
+	}
+	return strings.TrimSuffix(base, "/") + "/.well-known/openid-configuration"
+}
+
+// decode decodes the fetched document, or creates one from the Endpoints
+// if nothing was fetched.
+func (d *discovery) decode(body []byte) (*discoveryDocument, error) {
+	doc := &discoveryDocument{Issuer: d.Issuer}
+	if d.Endpoints["jwks_uri"] == "" {
+		if err := json.Unmarshal(body, doc); err != nil {
+			return nil, fmt.Errorf("openidauth: decoding %s: %v", d.documentURL(), err)
+		}
+		if d.URL != "" {
+			for _, endpoint := range []*string{&doc.TokenEndpoint, &doc.JwksURI, &doc.UserinfoEndpoint, &doc.IntrospectionEndpoint} {
+				*endpoint = moveURL(*endpoint, d.Issuer, d.URL)
+			}
+		}
+	}
+	if len(d.Endpoints) > 0 {
+		// The names of the endpoints are those of the document.
+		overrides, _ := json.Marshal(d.Endpoints)
+		json.Unmarshal(overrides, doc)
+	}
+	return doc, nil
+}
+
+// moveURL returns the URL below to instead of from, if it is below from.
+func moveURL(u, from, to string) string {
+	from, to = strings.TrimSuffix(from, "/"), strings.TrimSuffix(to, "/")
+	if u == from || strings.HasPrefix(u, from+"/") {
+		return to + strings.TrimPrefix(u, from)
+	}
+	return u
+}
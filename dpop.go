@@ -0,0 +1,176 @@
+package openidauth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/emanoelxavier/openid2go/openid"
+)
+
+// DPoP proofs are accepted if they were created at most this long before
+// or after the request.
+const dpopProofWindow = 60 * time.Second
+
+// dpopError is returned for a missing or invalid DPoP proof, see RFC 9449.
+type dpopError struct {
+	Description string
+}
+
+func (e *dpopError) Error() string {
+	return e.Description
+}
+
+// dpopVerifier checks the proof of possession of sender-constrained tokens.
+// Tokens bound to a key with the cnf.jkt claim must be sent with the DPoP
+// scheme and a proof signed with the key. The jti of the proofs are
+// remembered in Storage so a proof can't be replayed. With Required all
+// tokens must be bound.
+type dpopVerifier struct {
+	Required bool
+	Leeway   time.Duration
+	Storage  storage
+}
+
+// dpopProofHeader is the JOSE header of a DPoP proof.
+type dpopProofHeader struct {
+	Typ string      `json:"typ"`
+	Alg string      `json:"alg"`
+	JWK *jsonWebKey `json:"jwk"`
+}
+
+// authorizationScheme returns the scheme of the Authorization header.
+func authorizationScheme(r *http.Request) string {
+	v := r.Header.Get("Authorization")
+	if i := strings.IndexByte(v, ' '); i > 0 {
+		return v[:i]
+	}
+	return ""
+}
+
+// verify checks the DPoP proof of the request for the token of the user.
+func (d *dpopVerifier) verify(r *http.Request, token string, u *openid.User) error {
+	if d == nil {
+		return nil
+	}
+	dpopScheme := strings.EqualFold(authorizationScheme(r), "DPoP")
+	var jkt string
+	if cnf, ok := u.Claims["cnf"].(map[string]interface{}); ok {
+		jkt, _ = cnf["jkt"].(string)
+	}
+	if jkt == "" {
+		if dpopScheme {
+			return &dpopError{"The token is not bound to a DPoP key"}
+		}
+		if d.Required {
+			return &dpopError{"A DPoP bound token is required"}
+		}
+		return nil
+	}
+	if !dpopScheme {
+		return &dpopError{"The token is bound to a DPoP key and must be sent with the DPoP scheme"}
+	}
+
+	proofs := r.Header["Dpop"]
+	if len(proofs) != 1 {
+		return &dpopError{"The request must have exactly one DPoP proof"}
+	}
+	t, err := parseJWT(proofs[0])
+	if err != nil {
+		return &dpopError{"The DPoP proof is malformed"}
+	}
+	var header dpopProofHeader
+	rawHeader, _ := base64.RawURLEncoding.DecodeString(strings.SplitN(proofs[0], ".", 2)[0])
+	if err := json.Unmarshal(rawHeader, &header); err != nil || header.JWK == nil {
+		return &dpopError{"The DPoP proof has no key"}
+	}
+	if header.JWK.D != "" {
+		// RFC 9449 section 4.3: the key must not contain a private key.
+		return &dpopError{"The key of the DPoP proof contains a private key"}
+	}
+	if header.Typ != "dpop+jwt" || !isSupportedAlg(header.Alg) {
+		return &dpopError{"The DPoP proof has an invalid type or algorithm"}
+	}
+	key, err := header.JWK.publicKey()
+	if err != nil || key == nil {
+		return &dpopError{"The key of the DPoP proof is invalid"}
+	}
+	if err := verifySignature(header.Alg, key, t.SigningInput, t.Signature); err != nil {
+		return &dpopError{"The signature of the DPoP proof is invalid"}
+	}
+	if thumbprint, err := header.JWK.thumbprint(); err != nil || thumbprint != jkt {
+		return &dpopError{"The DPoP proof is not signed with the key the token is bound to"}
+	}
+
+	if htm, _ := t.Claims["htm"].(string); htm != r.Method {
+		return &dpopError{"The DPoP proof is for another method"}
+	}
+	// The scheme is not compared, TLS is often terminated in front of
+	// Caddy.
+	htu, _ := t.Claims["htu"].(string)
+	target, err := url.Parse(htu)
+	if err != nil || !strings.EqualFold(target.Host, r.Host) || target.Path != r.URL.Path {
+		return &dpopError{"The DPoP proof is for another URL"}
+	}
+	iat := claimTime(t.Claims["iat"])
+	if iat.IsZero() || time.Since(iat) > dpopProofWindow+d.Leeway || time.Until(iat) > dpopProofWindow+d.Leeway {
+		return &dpopError{"The DPoP proof is expired or not valid yet"}
+	}
+	sum := sha256.Sum256([]byte(token))
+	if ath, _ := t.Claims["ath"].(string); ath != base64.RawURLEncoding.EncodeToString(sum[:]) {
+		return &dpopError{"The DPoP proof is for another token"}
+	}
+
+	jti, _ := t.Claims["jti"].(string)
+	if jti == "" {
+		return &dpopError{"The DPoP proof has no jti"}
+	}
+	// Of concurrent requests with the same proof, on any instance sharing
+	// the storage, only one gets to record it.
+	first, err := d.Storage.SetIfAbsent("dpop:"+jkt+":"+jti, []byte{1}, 2*(dpopProofWindow+d.Leeway))
+	if err != nil {
+		return err
+	}
+	if !first {
+		return &dpopError{"The DPoP proof has already been used"}
+	}
+	return nil
+}
+
+// thumbprint returns the RFC 7638 JWK SHA-256 thumbprint of the key.
+func (k jsonWebKey) thumbprint() (string, error) {
+	var members interface{}
+	switch k.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{k.E, k.Kty, k.N}
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{k.Crv, k.Kty, k.X, k.Y}
+	case "OKP":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{k.Crv, k.Kty, k.X}
+	default:
+		return "", &dpopError{"unsupported key type " + k.Kty}
+	}
+	b, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
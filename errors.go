@@ -0,0 +1,410 @@
+package openidauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Formats of the error responses.
+const (
+	errorFormatText = "text"
+	errorFormatJSON = "json"
+	errorFormatGRPC = "grpc"
+)
+
+// How much the error responses tell about the failure.
+const (
+	errorsVerbose = "verbose"
+	errorsMinimal = "minimal"
+)
+
+// Classes of errors whose status code can be overridden.
+const (
+	errorMissingToken      = "missing_token"
+	errorInvalidToken      = "invalid_token"
+	errorInvalidRequest    = "invalid_request"
+	errorInsufficientScope = "insufficient_scope"
+	errorForbidden         = "forbidden"
+	errorUnavailable       = "unavailable"
+	errorStepUp            = "step_up"
+	errorRateLimited       = "rate_limited"
+)
+
+var errorClasses = map[string]bool{
+	errorMissingToken:      true,
+	errorInvalidToken:      true,
+	errorInvalidRequest:    true,
+	errorInsufficientScope: true,
+	errorForbidden:         true,
+	errorUnavailable:       true,
+	errorStepUp:            true,
+	errorRateLimited:       true,
+}
+
+// problem is an RFC 7807 problem details object. Error is the OAuth error
+// code of the failure, like invalid_token.
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Failure modes of paths, see pathRule.OnFailure.
+const (
+	failureAuto     = "auto"
+	failureRedirect = "redirect"
+	failureStatus   = "status"
+	failureJSON     = "json"
+	failurePage     = "page:"
+)
+
+// challengeNone is the challenge scheme of paths without challenges.
+const challengeNone = "none"
+
+// errorPage holds the variables of the error page template.
+type errorPage struct {
+	Status     int
+	StatusText string
+	Code       string
+	Message    string
+	LoginURL   string
+	RequestID  string
+}
+
+// errorResponder writes the body of error responses. gRPC clients get a
+// gRPC status, see writeGRPC. Browsers get the error page for 401 and 403 if
+// there is one. In the json format clients that accept JSON get
+// application/problem+json, everyone else gets plain text. Minimal
+// responses only have the status, the messages of the failures, like why a
+// token was rejected, are left out. All responses carry the id of the
+// request, so a failure reported by a user can be found in the audit log.
+// Forced responders send the JSON or the page whatever the client accepts.
+// Challenges use the Scheme instead of Bearer if it is set, and are left out
+// if it is none.
+type errorResponder struct {
+	Format  string
+	Page    *template.Template
+	Realm   string
+	Minimal bool
+	Forced  bool
+	Scheme  string
+
+	// Status codes to use instead of the defaults, by error class.
+	StatusCodes map[string]int
+
+	// Login starts at the callback path, if the interactive login is
+	// enabled.
+	LoginPath string
+}
+
+// newErrorResponder loads the error page template, if there is one.
+func newErrorResponder(cfg *Config, loginPath string) (*errorResponder, error) {
+	er := &errorResponder{
+		Format:      cfg.ErrorFormat,
+		Realm:       cfg.Realm,
+		Minimal:     cfg.Errors == errorsMinimal,
+		StatusCodes: cfg.StatusCodes,
+		LoginPath:   loginPath,
+	}
+	if cfg.ErrorPage != "" {
+		tmpl, err := template.ParseFiles(cfg.ErrorPage)
+		if err != nil {
+			return nil, fmt.Errorf("openidauth: error_page: %v", err)
+		}
+		er.Page = tmpl
+	}
+	return er, nil
+}
+
+// forPath returns the responder for the failures on a path with the
+// failure mode.
+func (er *errorResponder) forPath(mode string) (*errorResponder, error) {
+	switch {
+	case mode == failureJSON:
+		path := *er
+		path.Format, path.Page, path.Forced = errorFormatJSON, nil, true
+		return &path, nil
+	case strings.HasPrefix(mode, failurePage):
+		tmpl, err := template.ParseFiles(strings.TrimPrefix(mode, failurePage))
+		if err != nil {
+			return nil, fmt.Errorf("openidauth: on_failure page: %v", err)
+		}
+		path := *er
+		path.Page, path.Forced = tmpl, true
+		return &path, nil
+	}
+	return er, nil
+}
+
+// withScheme returns the responder with the challenge scheme.
+func (er *errorResponder) withScheme(scheme string) *errorResponder {
+	path := *er
+	path.Scheme = scheme
+	return &path
+}
+
+// Status returns the status code for an error class.
+func (er *errorResponder) Status(class string, status int) int {
+	if er != nil {
+		if override, ok := er.StatusCodes[class]; ok {
+			return override
+		}
+	}
+	return status
+}
+
+// Write sends an error response with the OAuth error code and message.
+func (er *errorResponder) Write(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	if er != nil && er.Minimal {
+		message = http.StatusText(status)
+	}
+	if isGRPC(r) || er != nil && er.Format == errorFormatGRPC {
+		writeGRPC(w, r, status, message)
+		return
+	}
+	if er != nil && er.Page != nil && (status == http.StatusUnauthorized || status == http.StatusForbidden) &&
+		(er.Forced || acceptsHTML(r)) {
+		if er.writePage(w, r, status, code, message) == nil {
+			return
+		}
+	}
+	if er == nil || er.Format != errorFormatJSON || !er.Forced && !acceptsJSON(r) {
+		if id := requestID(r); id != "" {
+			message += "\nRequest ID: " + id
+		}
+		http.Error(w, message, status)
+		return
+	}
+
+	p := problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    message,
+		Error:     code,
+		RequestID: requestID(r),
+	}
+	if code != "" {
+		p.Type = "https://tools.ietf.org/html/rfc6750#section-3.1"
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// authParam is an additional parameter of a challenge, like scope.
+type authParam struct {
+	Name  string
+	Value string
+}
+
+// Challenge adds the RFC 6750 WWW-Authenticate challenge to the response.
+// Code is empty if the request had no credentials at all.
+func (er *errorResponder) Challenge(w http.ResponseWriter, code, description string, extra ...authParam) {
+	scheme := "Bearer"
+	if er != nil && er.Scheme != "" {
+		scheme = er.Scheme
+	}
+	er.challenge(w, scheme, code, description, extra...)
+}
+
+// challenge adds a WWW-Authenticate challenge of the scheme to the response.
+func (er *errorResponder) challenge(w http.ResponseWriter, scheme, code, description string, extra ...authParam) {
+	if er != nil && er.Scheme == challengeNone {
+		// Some clients, like mobile web views, show a login dialog of
+		// their own when they see a challenge.
+		return
+	}
+	var params []string
+	if er != nil && er.Realm != "" {
+		params = append(params, "realm="+quoteParam(er.Realm))
+	}
+	if code != "" {
+		params = append(params, "error="+quoteParam(code))
+		if description != "" && (er == nil || !er.Minimal) {
+			params = append(params, "error_description="+quoteParam(description))
+		}
+	}
+	for _, p := range extra {
+		params = append(params, p.Name+"="+quoteParam(p.Value))
+	}
+	challenge := scheme
+	if len(params) > 0 {
+		challenge += " " + strings.Join(params, ", ")
+	}
+	w.Header().Add("WWW-Authenticate", challenge)
+}
+
+// quoteParam quotes an auth-param value. RFC 6750 doesn't allow quotes,
+// backslashes or control characters in the values, so they are dropped.
+func quoteParam(s string) string {
+	return `"` + strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			return -1
+		}
+		return r
+	}, s) + `"`
+}
+
+// isToken reports whether s is an RFC 7230 token, like an auth scheme.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r > 0x7e || r <= 0x20 || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// writePage renders the error page. Nothing is written if the template
+// fails.
+func (er *errorResponder) writePage(w http.ResponseWriter, r *http.Request, status int, code, message string) error {
+	page := errorPage{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Code:       code,
+		Message:    message,
+		RequestID:  requestID(r),
+	}
+	if er.LoginPath != "" {
+		page.LoginURL = er.LoginPath + "?" + url.Values{"return": {r.URL.RequestURI()}}.Encode()
+	}
+
+	var buf bytes.Buffer
+	if err := er.Page.Execute(&buf, page); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// grpcStatusCodes are the gRPC status codes of the errors by HTTP status.
+var grpcStatusCodes = map[int]int{
+	http.StatusBadRequest:          3,  // INVALID_ARGUMENT
+	http.StatusUnauthorized:        16, // UNAUTHENTICATED
+	http.StatusForbidden:           7,  // PERMISSION_DENIED
+	http.StatusNotFound:            5,  // NOT_FOUND
+	http.StatusTooManyRequests:     8,  // RESOURCE_EXHAUSTED
+	http.StatusInternalServerError: 13, // INTERNAL
+	http.StatusServiceUnavailable:  14, // UNAVAILABLE
+}
+
+// isGRPC reports whether the request is a gRPC or gRPC-Web call.
+func isGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// writeGRPC sends the error as a Trailers-Only gRPC response: status 200
+// with the grpc-status and grpc-message in the headers and no body. gRPC
+// clients ignore the HTTP status code, a 401 page would only be reported as
+// a protocol error.
+func writeGRPC(w http.ResponseWriter, r *http.Request, status int, message string) {
+	code, ok := grpcStatusCodes[status]
+	if !ok {
+		code = 2 // UNKNOWN
+	}
+	contentType := "application/grpc"
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc-web") {
+		contentType = r.Header.Get("Content-Type")
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", grpcPercentEncode(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcPercentEncode encodes the grpc-message as the gRPC protocol requires:
+// bytes outside printable ASCII and % are percent-encoded.
+func grpcPercentEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// acceptsHTML reports whether the request comes from a browser.
+func acceptsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// isBrowser reports whether the request is a page load of a browser, as
+// opposed to an API client or a script of a page. Browsers tell with
+// Sec-Fetch-Mode, older ones are recognized by asking for HTML without
+// the header of XMLHttpRequest.
+func isBrowser(r *http.Request) bool {
+	if mode := r.Header.Get("Sec-Fetch-Mode"); mode != "" {
+		return mode == "navigate"
+	}
+	return acceptsHTML(r) && !strings.EqualFold(r.Header.Get("X-Requested-With"), "XMLHttpRequest")
+}
+
+// acceptsJSON reports whether JSON is an acceptable response to the request.
+// Clients that ask for text explicitly get text.
+func acceptsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	switch {
+	case accept == "", strings.Contains(accept, "json"):
+		return true
+	case strings.Contains(accept, "text/"):
+		return false
+	}
+	return strings.Contains(accept, "*/*")
+}
+
+// parseErrorStatus parses the arguments of an error_status directive:
+//
+//	error_status insufficient_scope 404
+func parseErrorStatus(c Dispenser) (string, int, error) {
+	args := c.RemainingArgs()
+	if len(args) != 2 {
+		return "", 0, c.ArgErr()
+	}
+	if !errorClasses[args[0]] {
+		return "", 0, c.Errf("openidauth: unknown error class %q", args[0])
+	}
+	status, err := strconv.Atoi(args[1])
+	if err != nil || status < 400 || status > 599 {
+		return "", 0, c.Errf("openidauth: invalid status code %q for %s", args[1], args[0])
+	}
+	return args[0], status, nil
+}
+
+// parseErrors checks the argument of the errors directive.
+func parseErrors(verbosity string) (string, error) {
+	switch verbosity {
+	case errorsVerbose, errorsMinimal:
+		return verbosity, nil
+	}
+	return "", fmt.Errorf("errors must be %s or %s", errorsMinimal, errorsVerbose)
+}
+
+// parseErrorFormat checks the argument of the error_format directive.
+func parseErrorFormat(format string) (string, error) {
+	switch format {
+	case errorFormatText, errorFormatJSON, errorFormatGRPC:
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown error format %q", format)
+}
@@ -0,0 +1,36 @@
+package openidauth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+)
+
+const (
+	// bindRevalidate validates a token again when it comes from another
+	// client than the one it was first seen from, and refreshes such
+	// sessions at the provider.
+	bindRevalidate = "revalidate"
+
+	// bindReject rejects the token or ends the session instead.
+	bindReject = "reject"
+)
+
+// clientFingerprint identifies the client of a request roughly: by the
+// network of its IP address, /24 for IPv4 and /48 for IPv6, and its
+// User-Agent. It stays the same while a client moves within its network, but
+// changes when a token or session cookie is used from a very different
+// client.
+func clientFingerprint(r *http.Request) string {
+	network := remoteIP(r)
+	if ip := net.ParseIP(network); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			network = ip4.Mask(net.CIDRMask(24, 32)).String()
+		} else {
+			network = ip.Mask(net.CIDRMask(48, 128)).String()
+		}
+	}
+	sum := sha256.Sum256([]byte(network + "\x00" + r.UserAgent()))
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,59 @@
+package openidauth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+)
+
+// ServeFrontchannelLogout implements OpenID Connect Front-Channel Logout.
+// The logout page of the provider loads the path in an iframe, with the
+// issuer and the sid of the session when the provider sends them. The
+// session with the sid is revoked, which works even if the browser does not
+// send the session cookie to the iframe. A session cookie the browser does
+// send is removed if it belongs to the sid, or to any session when the
+// provider sends no sid.
+func (l *loginHandler) ServeFrontchannelLogout(w http.ResponseWriter, r *http.Request) (int, error) {
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.Header().Set("Pragma", "no-cache")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	q := r.URL.Query()
+	iss, sid := q.Get("iss"), q.Get("sid")
+	if (iss == "") != (sid == "") {
+		return http.StatusBadRequest, errors.New("openidauth: front-channel logout needs both iss and sid or neither")
+	}
+	if iss != "" && iss != l.Provider.Issuer {
+		return http.StatusBadRequest, errors.New("openidauth: front-channel logout is from another issuer")
+	}
+
+	if sid != "" {
+		if err := l.Revocations.Revoke("", sid, l.retention()); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	if cookie, err := r.Cookie(l.Cookie.Name); err == nil {
+		if sess := l.Sessions.Load(cookie.Value); sess == nil || sessionHasSid(sess, sid) {
+			l.Sessions.Delete(cookie.Value)
+			l.clearSessionCookie(w, r)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("<!DOCTYPE html><title>Logged out</title>"))
+	return 0, nil
+}
+
+// sessionHasSid reports whether the session was created by the provider
+// session sid. Every session matches an empty sid.
+func sessionHasSid(sess *session, sid string) bool {
+	if sid == "" {
+		return true
+	}
+	own, _ := sess.User.Claims["sid"].(string)
+	return subtle.ConstantTimeCompare([]byte(own), []byte(sid)) == 1
+}
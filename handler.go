@@ -0,0 +1,88 @@
+package openidauth
+
+import (
+	"net/http"
+)
+
+// Handler is the next handler of the middleware. It is a Caddy v1 handler:
+// ServeHTTP returns 0 if the response has been written, or the status code
+// to respond with. Caddy v1 handlers implement it as they are.
+type Handler interface {
+	ServeHTTP(http.ResponseWriter, *http.Request) (int, error)
+}
+
+// HandlerFunc adapts a function to a Handler.
+type HandlerFunc func(http.ResponseWriter, *http.Request) (int, error)
+
+// ServeHTTP calls f(w, r).
+func (f HandlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	return f(w, r)
+}
+
+// Replacer sets the placeholders of a request, like {openid.claims.sub}.
+// The replacer of Caddy v1 implements it, the caddy2 package adapts the one
+// of Caddy v2.
+type Replacer interface {
+	Set(key, value string)
+}
+
+type contextKey string
+
+const (
+	// ReplacerCtxKey is the context key of the Replacer of a request. The
+	// claims of authenticated users are set as placeholders through it.
+	ReplacerCtxKey contextKey = "openidauth.replacer"
+
+	// RemoteUserCtxKey is the context key of the subject of the
+	// authenticated user, the request passed on carries it.
+	RemoteUserCtxKey contextKey = "openidauth.remote_user"
+)
+
+// Middleware is the authentication middleware independent of the Caddy
+// plugin registration. It is used by the Caddy v1 plugin in the caddy1
+// package and the Caddy v2 module in the caddy2 package.
+type Middleware struct {
+	auth *auth
+}
+
+// New creates the middleware from the configuration, which is validated and
+// completed with defaults. Requests that pass authentication are handed to
+// next. Start must be called before the middleware serves requests and Stop
+// when it is no longer used.
+func New(cfg *Config, next Handler) (*Middleware, error) {
+	if err := cfg.prepare(); err != nil {
+		return nil, err
+	}
+	h, err := newAuth(cfg)
+	if err != nil {
+		return nil, err
+	}
+	h.Next = next
+	return &Middleware{auth: h}, nil
+}
+
+// WithNext returns a copy of the middleware that hands requests to next.
+// The copies share the state of the middleware, Caddy v1 adds one to the
+// chain of each site.
+func (m *Middleware) WithNext(next Handler) *Middleware {
+	a := *m.auth
+	a.Next = next
+	return &Middleware{auth: &a}
+}
+
+// ServeHTTP authenticates the request. Like a Caddy v1 handler it returns
+// 0 if the response has been written, or the status code to respond with.
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	return m.auth.ServeHTTP(w, r)
+}
+
+// Start starts the background work of the middleware.
+func (m *Middleware) Start() error {
+	return m.auth.start()
+}
+
+// Stop ends the background work and releases the resources of the
+// middleware.
+func (m *Middleware) Stop() error {
+	return m.auth.stop()
+}
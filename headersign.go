@@ -0,0 +1,64 @@
+package openidauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	signatureHeader          = "X-Auth-Signature"
+	signatureTimestampHeader = "X-Auth-Timestamp"
+)
+
+// headerSigner signs the claim headers with a secret shared with the
+// backends, so they can tell headers set by the middleware from headers
+// that reached them another way. The signature is the base64url encoded
+// HMAC-SHA256 of the timestamp and of each claim header, in the configured
+// order, as lowercase name, colon and value on a line of its own:
+//
+//	1700000000
+//	x-user:jane
+//	x-groups:admins,staff
+//
+// Missing headers are signed with an empty value, so they can't be removed
+// unnoticed either.
+type headerSigner struct {
+	Secret  []byte
+	Headers []string
+}
+
+func newHeaderSigner(secret string, headers []claimHeader) *headerSigner {
+	s := &headerSigner{Secret: []byte(secret)}
+	for _, h := range headers {
+		s.Headers = append(s.Headers, h.Header)
+	}
+	return s
+}
+
+// removeHeaders removes the signature headers sent by the client.
+func (s *headerSigner) removeHeaders(r *http.Request) {
+	if s != nil {
+		r.Header.Del(signatureHeader)
+		r.Header.Del(signatureTimestampHeader)
+	}
+}
+
+// sign adds the signature of the claim headers to the request.
+func (s *headerSigner) sign(r *http.Request, now time.Time) {
+	if s == nil {
+		return
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	mac := hmac.New(sha256.New, s.Secret)
+	mac.Write([]byte(timestamp + "\n"))
+	for _, name := range s.Headers {
+		mac.Write([]byte(strings.ToLower(name) + ":" + r.Header.Get(name) + "\n"))
+	}
+	r.Header.Set(signatureTimestampHeader, timestamp)
+	r.Header.Set(signatureHeader, base64.RawURLEncoding.EncodeToString(mac.Sum(nil)))
+}
@@ -0,0 +1,107 @@
+package openidauth
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const defaultHealthPrefix = "/openidauth"
+
+// healthChecks serves the endpoints probed by orchestrators like
+// Kubernetes. Prefix/health reports whether the middleware is configured
+// correctly: the local key files can be read and the storage answers.
+// Prefix/ready reports whether the tokens of every provider can be
+// validated, which needs their discovery documents and JWKS. Both answer
+// 503 if a check fails. Providers whose issuer is a pattern are not checked,
+// their issuers are only known once their tokens arrive.
+type healthChecks struct {
+	Prefix   string
+	Verifier *tokenValidator
+	Storage  storage
+}
+
+// healthReport is the body of the responses.
+type healthReport struct {
+	Status string        `json:"status"`
+	Checks []healthCheck `json:"checks"`
+}
+
+type healthCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+const (
+	healthOK    = "ok"
+	healthError = "error"
+)
+
+// add records the outcome of a check.
+func (r *healthReport) add(name string, err error) {
+	c := healthCheck{Name: name, Status: healthOK}
+	if err != nil {
+		c.Status, c.Error = healthError, err.Error()
+		r.Status = healthError
+	}
+	r.Checks = append(r.Checks, c)
+}
+
+// matches reports whether the request is for one of the endpoints.
+func (c *healthChecks) matches(r *http.Request) bool {
+	if c == nil || !strings.HasPrefix(r.URL.Path, c.Prefix+"/") {
+		return false
+	}
+	switch strings.TrimPrefix(r.URL.Path, c.Prefix) {
+	case "/health", "/ready":
+		return true
+	}
+	return false
+}
+
+// ServeHTTP answers the health and readiness probes.
+func (c *healthChecks) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		return http.StatusMethodNotAllowed, nil
+	}
+	report := &healthReport{Status: healthOK, Checks: []healthCheck{}}
+	if strings.HasSuffix(r.URL.Path, "/ready") {
+		c.ready(report)
+	} else {
+		c.health(report)
+	}
+
+	status := http.StatusOK
+	if report.Status != healthOK {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+	return 0, nil
+}
+
+// health checks what the middleware needs locally.
+func (c *healthChecks) health(report *healthReport) {
+	for _, i := range c.Verifier.Issuers {
+		if i.LocalKeys != nil {
+			_, err := i.LocalKeys.Keys()
+			report.add("keys:"+i.Provider.Issuer, err)
+		}
+	}
+	_, err := c.Storage.Get("health")
+	report.add("storage", err)
+}
+
+// ready checks that the signing keys of every provider can be fetched. They
+// are read through the fetch cache, so probes don't reach the providers
+// more often than the validation does.
+func (c *healthChecks) ready(report *healthReport) {
+	for _, i := range c.Verifier.Issuers {
+		_, err := i.signingKeys()
+		report.add("provider:"+i.Provider.Issuer, err)
+	}
+}
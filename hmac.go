@@ -0,0 +1,135 @@
+package openidauth
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/emanoelxavier/openid2go/openid"
+)
+
+// minHMACSecretSize is the size of the shortest secret accepted, that of
+// the output of SHA-256. RFC 7518 section 3.2 requires keys at least as
+// long as the hash, tokens signed with a longer hash need longer secrets.
+const minHMACSecretSize = 32
+
+// hmacSecret is a shared secret declared with hmac_secret, or read from the
+// File of hmac_secret_file. If the Issuer or the Audience are set, tokens
+// signed with the secret must have them in the iss and aud claims. Tokens
+// without an exp claim are only accepted with OptionalExp.
+type hmacSecret struct {
+	Secret      string `json:"secret,omitempty"`
+	File        string `json:"file,omitempty"`
+	Issuer      string `json:"issuer,omitempty"`
+	Audience    string `json:"audience,omitempty"`
+	OptionalExp bool   `json:"optional_exp,omitempty"`
+
+	// value is the secret read by prepare.
+	value string
+}
+
+// UnmarshalJSON also accepts the secret alone as a string.
+func (s *hmacSecret) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		*s = hmacSecret{}
+		return json.Unmarshal(b, &s.Secret)
+	}
+	type plain hmacSecret
+	return json.Unmarshal(b, (*plain)(s))
+}
+
+// hmacValidator validates JWTs signed with a shared secret (HS256, HS384 or
+// HS512) by internal services, instead of tokens from an OpenID provider.
+type hmacValidator struct {
+	Secret      []byte
+	Issuer      string
+	Audience    string
+	OptionalExp bool
+	Leeway      time.Duration
+}
+
+// parseHMACSecret parses the arguments of a hmac_secret or hmac_secret_file
+// directive and returns the name and the secret:
+//
+//	hmac_secret internal s3cr3t
+//	hmac_secret internal {env.INTERNAL_JWT_SECRET}
+//	hmac_secret internal s3cr3t issuer=https://auth.internal audience=orders
+//	hmac_secret internal s3cr3t exp=optional
+//	hmac_secret_file internal /run/secrets/internal-jwt
+func parseHMACSecret(c Dispenser) (string, hmacSecret, error) {
+	directive := c.Val()
+	args := c.RemainingArgs()
+	if len(args) < 2 {
+		return "", hmacSecret{}, c.ArgErr()
+	}
+	name, secret := args[0], hmacSecret{Secret: args[1]}
+	if directive == "hmac_secret_file" {
+		secret = hmacSecret{File: args[1]}
+	}
+	for _, arg := range args[2:] {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return "", hmacSecret{}, c.Errf("openidauth: expected option=value, got %q", arg)
+		}
+		switch kv[0] {
+		case "issuer":
+			secret.Issuer = kv[1]
+		case "audience":
+			secret.Audience = kv[1]
+		case "exp":
+			if kv[1] != "optional" {
+				return "", hmacSecret{}, c.Errf("openidauth: exp must be optional, got %q", kv[1])
+			}
+			secret.OptionalExp = true
+		default:
+			return "", hmacSecret{}, c.Errf("openidauth: unknown %s option %q", directive, kv[0])
+		}
+	}
+	return name, secret, nil
+}
+
+// Validate verifies the signature and the time claims of the token.
+func (v *hmacValidator) Validate(token string) (*openid.User, error) {
+	t, err := parseJWT(token)
+	if err != nil {
+		return nil, validationError(openid.ValidationErrorJwtValidationFailure, http.StatusUnauthorized,
+			"Failed to parse the token", err)
+	}
+
+	alg := t.Header.Alg
+	if len(alg) != 5 || alg[:2] != "HS" || hashes[alg[2:]] == 0 {
+		return nil, validationError(openid.ValidationErrorJwtValidationFailure, http.StatusUnauthorized,
+			fmt.Sprintf("The token signing algorithm %q is not allowed", alg), nil)
+	}
+	hash := hashes[alg[2:]]
+	if len(v.Secret) < hash.Size() {
+		return nil, validationError(openid.ValidationErrorJwtValidationFailure, http.StatusUnauthorized,
+			fmt.Sprintf("The secret is too short for the token signing algorithm %q", alg), nil)
+	}
+	mac := hmac.New(hash.New, v.Secret)
+	mac.Write([]byte(t.SigningInput))
+	if !hmac.Equal(mac.Sum(nil), t.Signature) {
+		return nil, validationError(openid.ValidationErrorJwtValidationFailure, http.StatusUnauthorized,
+			"The token signature is invalid", nil)
+	}
+
+	if err := validateTimes(t.Claims, time.Now(), v.Leeway, !v.OptionalExp); err != nil {
+		return nil, validationError(openid.ValidationErrorJwtValidationFailure, http.StatusUnauthorized, err.Error(), err)
+	}
+	if iss, _ := t.Claims["iss"].(string); v.Issuer != "" && iss != v.Issuer {
+		return nil, validationError(openid.ValidationErrorInvalidIssuer, http.StatusUnauthorized,
+			"The token issuer is not accepted", nil)
+	}
+	if v.Audience != "" && !containsString(t.audiences(), v.Audience) {
+		return nil, validationError(openid.ValidationErrorInvalidAudience, http.StatusUnauthorized,
+			"The token audience is not accepted", nil)
+	}
+
+	u := &openid.User{Claims: t.Claims}
+	u.Issuer, _ = t.Claims["iss"].(string)
+	u.ID, _ = t.Claims["sub"].(string)
+	return u, nil
+}
@@ -0,0 +1,253 @@
+package openidauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/emanoelxavier/openid2go/openid"
+)
+
+const (
+	defaultInternalTokenHeader = "X-Identity-Token"
+	defaultInternalTokenIssuer = "openidauth"
+	defaultInternalTokenTTL    = time.Minute
+)
+
+// internalTokenConfig is the configuration of the identity token minted for
+// the backend.
+type internalTokenConfig struct {
+	KeyFile  string        `json:"key_file"`
+	Header   string        `json:"header,omitempty"`
+	Claims   []string      `json:"claims,omitempty"`
+	Issuer   string        `json:"issuer,omitempty"`
+	Audience string        `json:"audience,omitempty"`
+	TTL      time.Duration `json:"ttl,omitempty"`
+}
+
+// The claims the middleware always sets in the identity token itself.
+var reservedInternalClaims = []string{"iss", "sub", "aud", "iat", "exp"}
+
+// parseInternalToken parses the arguments of the internal_token directive:
+//
+//	internal_token /etc/caddy/identity.pem
+//	internal_token /etc/caddy/identity.pem header=X-User claims=email,groups
+//	internal_token /etc/caddy/identity.pem issuer=gateway audience=orders ttl=30s
+func parseInternalToken(c Dispenser) (*internalTokenConfig, error) {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return nil, c.ArgErr()
+	}
+	cfg := &internalTokenConfig{KeyFile: args[0]}
+	for _, arg := range args[1:] {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, c.Errf("openidauth: expected option=value, got %q", arg)
+		}
+		switch kv[0] {
+		case "header":
+			cfg.Header = kv[1]
+		case "claims":
+			cfg.Claims = append(cfg.Claims, strings.Split(kv[1], ",")...)
+		case "issuer":
+			cfg.Issuer = kv[1]
+		case "audience":
+			cfg.Audience = kv[1]
+		case "ttl":
+			ttl, err := time.ParseDuration(kv[1])
+			if err != nil || ttl < time.Second {
+				return nil, c.Errf("openidauth: invalid internal_token ttl %q", kv[1])
+			}
+			cfg.TTL = ttl
+		default:
+			return nil, c.Errf("openidauth: unknown internal_token option %q", kv[0])
+		}
+	}
+	return cfg, nil
+}
+
+// validate checks the configuration and fills in the defaults.
+func (cfg *internalTokenConfig) validate() error {
+	for _, claim := range cfg.Claims {
+		if containsString(reservedInternalClaims, claim) {
+			return fmt.Errorf("openidauth: the claim %s of internal_token is always set by the middleware", claim)
+		}
+	}
+	if cfg.Header == "" {
+		cfg.Header = defaultInternalTokenHeader
+	}
+	cfg.Header = http.CanonicalHeaderKey(cfg.Header)
+	if cfg.Issuer == "" {
+		cfg.Issuer = defaultInternalTokenIssuer
+	}
+	if cfg.TTL == 0 {
+		cfg.TTL = defaultInternalTokenTTL
+	}
+	return nil
+}
+
+// internalTokenMinter signs a short-lived JWT asserting the identity of the
+// authenticated user, so backends can verify it with the public key of the
+// middleware instead of trusting plain claim headers. The token carries the
+// subject and the selected claims of the user. It never lasts longer than
+// the token of the user.
+type internalTokenMinter struct {
+	Config internalTokenConfig
+	Key    crypto.Signer
+	Alg    string
+}
+
+func newInternalTokenMinter(cfg internalTokenConfig) (*internalTokenMinter, error) {
+	key, alg, err := loadSigningKey(cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("openidauth: %s: %v", cfg.KeyFile, err)
+	}
+	return &internalTokenMinter{Config: cfg, Key: key, Alg: alg}, nil
+}
+
+// loadSigningKey reads the private key in a PEM file and returns the
+// algorithm to sign with it.
+func loadSigningKey(file string) (crypto.Signer, string, error) {
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, "", err
+	}
+	block, _ := pem.Decode(body)
+	if block == nil {
+		return nil, "", errors.New("no private key found")
+	}
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, "", fmt.Errorf("unexpected PEM block %s", block.Type)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, "RS256", nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve.Params().BitSize {
+		case 256:
+			return k, "ES256", nil
+		case 384:
+			return k, "ES384", nil
+		case 521:
+			return k, "ES512", nil
+		}
+	case ed25519.PrivateKey:
+		return k, "EdDSA", nil
+	}
+	return nil, "", errors.New("unsupported private key type")
+}
+
+// removeHeader removes the identity token sent by the client.
+func (m *internalTokenMinter) removeHeader(r *http.Request) {
+	if m != nil {
+		r.Header.Del(m.Config.Header)
+	}
+}
+
+// set adds the identity token of the user to the request.
+func (m *internalTokenMinter) set(r *http.Request, u *openid.User) error {
+	if m == nil || u == nil {
+		return nil
+	}
+	now := time.Now()
+	exp := now.Add(m.Config.TTL)
+	if userExp := claimTime(u.Claims["exp"]); !userExp.IsZero() && userExp.Before(exp) {
+		exp = userExp
+	}
+
+	claims := make(map[string]interface{}, len(m.Config.Claims)+5)
+	for _, name := range m.Config.Claims {
+		if v, ok := u.Claims[name]; ok {
+			claims[name] = v
+		}
+	}
+	claims["iss"] = m.Config.Issuer
+	claims["sub"] = u.ID
+	if m.Config.Audience != "" {
+		claims["aud"] = m.Config.Audience
+	}
+	claims["iat"] = now.Unix()
+	claims["exp"] = exp.Unix()
+
+	token, err := m.sign(claims)
+	if err != nil {
+		return err
+	}
+	r.Header.Set(m.Config.Header, token)
+	return nil
+}
+
+// sign returns the claims as a signed JWT in compact serialization.
+func (m *internalTokenMinter) sign(claims map[string]interface{}) (string, error) {
+	return encodeJWT(jwtHeader{Alg: m.Alg, Typ: "JWT"}, claims, m.Key)
+}
+
+// encodeJWT returns the claims as a JWT signed with the key, in compact
+// serialization.
+func encodeJWT(h jwtHeader, claims map[string]interface{}, key crypto.Signer) (string, error) {
+	header, err := json.Marshal(h)
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sig, err := createSignature(h.Alg, key, input)
+	if err != nil {
+		return "", err
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// createSignature creates the JWS signature of the signing input, the
+// counterpart of verifySignature.
+func createSignature(alg string, key crypto.Signer, signingInput string) ([]byte, error) {
+	if alg == "EdDSA" {
+		return key.Sign(rand.Reader, []byte(signingInput), crypto.Hash(0))
+	}
+	hash := hashes[alg[2:]]
+	h := hash.New()
+	h.Write([]byte(signingInput))
+	digest := h.Sum(nil)
+
+	if k, ok := key.(*ecdsa.PrivateKey); ok {
+		// JWS uses the fixed size concatenation of r and s instead of
+		// ASN.1.
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest)
+		if err != nil {
+			return nil, err
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig := make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+		return sig, nil
+	}
+	return key.Sign(rand.Reader, digest, hash)
+}
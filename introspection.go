@@ -0,0 +1,149 @@
+package openidauth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/emanoelxavier/openid2go/openid"
+)
+
+const defaultIntrospectionCacheTTL = 5 * time.Minute
+
+// introspector validates opaque access tokens by posting them to the token
+// introspection endpoint of a provider, see RFC 7662. Active tokens are
+// cached for the TTL, but never beyond their expiry.
+type introspector struct {
+	Provider  providerConfig
+	Endpoint  string
+	Discovery *discovery
+	TTL       time.Duration
+	Storage   storage
+	Client    *providerClient
+}
+
+func newIntrospector(provider providerConfig, ttl time.Duration, cache *fetchCache, store storage) *introspector {
+	endpoint := provider.Introspection
+	if endpoint == introspectionDiscovery {
+		endpoint = ""
+	}
+	return &introspector{
+		Provider:  provider,
+		Endpoint:  endpoint,
+		Discovery: newDiscovery(provider, cache),
+		TTL:       ttl,
+		Storage:   store,
+		Client:    cache.Client,
+	}
+}
+
+// introspectionDiscovery is the value of providerConfig.Introspection when
+// the endpoint is read from the discovery document.
+const introspectionDiscovery = "discovery"
+
+// looksLikeJWT reports whether the token has the three parts of a signed
+// JWT or the five of an encrypted one. Other tokens are opaque and can only
+// be validated by introspection.
+func looksLikeJWT(token string) bool {
+	n := strings.Count(token, ".")
+	return n == 2 || n == 4
+}
+
+// Introspect returns the user the token belongs to if the provider reports
+// it as active.
+func (i *introspector) Introspect(token string) (*openid.User, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := "introspection:" + hex.EncodeToString(sum[:])
+	now := time.Now()
+
+	if value, err := i.Storage.Get(key); err == nil && value != nil {
+		user := &openid.User{}
+		if json.Unmarshal(value, user) == nil {
+			return user, nil
+		}
+	}
+
+	claims, err := i.post(token)
+	if err != nil {
+		return nil, &openid.ValidationError{
+			Code:       openid.ValidationErrorGetOpenIdConfigurationFailure,
+			Message:    "Token introspection failed",
+			Err:        err,
+			HTTPStatus: http.StatusServiceUnavailable,
+		}
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return nil, &openid.ValidationError{
+			Code:       openid.ValidationErrorJwtValidationFailure,
+			Message:    "The token is not active",
+			HTTPStatus: http.StatusUnauthorized,
+		}
+	}
+
+	user := &openid.User{Issuer: i.Provider.Issuer, Claims: claims}
+	if iss, ok := claims["iss"].(string); ok && iss != "" {
+		user.Issuer = iss
+	}
+	if sub, ok := claims["sub"].(string); ok {
+		user.ID = sub
+	}
+
+	expires := now.Add(i.TTL)
+	if exp := claimTime(claims["exp"]); !exp.IsZero() && exp.Before(expires) {
+		expires = exp
+	}
+
+	if ttl := expires.Sub(now); ttl > 0 {
+		if value, err := json.Marshal(user); err == nil {
+			i.Storage.Set(key, value, ttl)
+		}
+	}
+	return user, nil
+}
+
+// post sends the token to the introspection endpoint, authenticating with
+// the client id and secret of the provider.
+func (i *introspector) post(token string) (map[string]interface{}, error) {
+	endpoint := i.Endpoint
+	if endpoint == "" {
+		doc, err := i.Discovery.Document()
+		if err != nil {
+			return nil, err
+		}
+		if doc.IntrospectionEndpoint == "" {
+			return nil, fmt.Errorf("openidauth: issuer %s has no introspection endpoint", i.Provider.Issuer)
+		}
+		endpoint = doc.IntrospectionEndpoint
+	}
+
+	form := url.Values{}
+	form.Set("token", token)
+	form.Set("token_type_hint", "access_token")
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(i.Provider.ClientIds[0]), url.QueryEscape(i.Provider.clientSecret()))
+
+	resp, err := i.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("openidauth: introspection endpoint returned status %d", resp.StatusCode)
+	}
+
+	claims := make(map[string]interface{})
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
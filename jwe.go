@@ -0,0 +1,236 @@
+package openidauth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"math/big"
+	"strings"
+)
+
+// jweHeader is the JOSE header of an encrypted JWT, see RFC 7516.
+type jweHeader struct {
+	Alg string `json:"alg"`
+	Enc string `json:"enc"`
+	Kid string `json:"kid"`
+	Cty string `json:"cty"`
+	Zip string `json:"zip"`
+}
+
+// privateKey is a decryption key.
+type privateKey struct {
+	Kid string
+	Key *rsa.PrivateKey
+}
+
+// decrypter decrypts JWE tokens with the private keys of the middleware.
+// Only nested JWTs are accepted: anyone can encrypt a token to the public
+// key, so the decrypted token must be a signed JWT that is then validated
+// as usual. The keys are RSA keys for RSA-OAEP and RSA-OAEP-256, the content
+// is encrypted with AES GCM.
+type decrypter struct {
+	Keys []privateKey
+}
+
+// newDecrypter loads the keys from the files, which are PEM files or JWKS
+// documents with private keys. It returns nil if there are no files.
+func newDecrypter(files []string) (*decrypter, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+	d := &decrypter{}
+	for _, name := range files {
+		body, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var keys []privateKey
+		if strings.HasPrefix(strings.TrimSpace(string(body)), "{") {
+			keys, err = parsePrivateJWKS(body)
+		} else {
+			keys, err = parsePEMPrivateKeys(body)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("openidauth: %s: %v", name, err)
+		}
+		d.Keys = append(d.Keys, keys...)
+	}
+	return d, nil
+}
+
+// parsePEMPrivateKeys reads the RSA private keys in a PEM file.
+func parsePEMPrivateKeys(body []byte) ([]privateKey, error) {
+	var keys []privateKey
+	for {
+		var block *pem.Block
+		block, body = pem.Decode(body)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, privateKey{Key: key})
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			rsaKey, ok := key.(*rsa.PrivateKey)
+			if !ok {
+				return nil, errors.New("only RSA private keys are supported")
+			}
+			keys = append(keys, privateKey{Key: rsaKey})
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no private key found")
+	}
+	return keys, nil
+}
+
+// parsePrivateJWKS decodes the RSA private keys in a JWKS document. Keys of
+// other types and signing keys are skipped.
+func parsePrivateJWKS(body []byte) ([]privateKey, error) {
+	var set struct {
+		Keys []struct {
+			jsonWebKey
+			D string `json:"d"`
+			P string `json:"p"`
+			Q string `json:"q"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &set); err != nil {
+		return nil, err
+	}
+
+	var keys []privateKey
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || k.Use == "sig" || k.D == "" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", k.Kid, err)
+		}
+		key := &rsa.PrivateKey{PublicKey: *pub.(*rsa.PublicKey)}
+		if key.D, err = decodeBigInt(k.D); err == nil {
+			var p, q *big.Int
+			if p, err = decodeBigInt(k.P); err == nil {
+				q, err = decodeBigInt(k.Q)
+			}
+			key.Primes = []*big.Int{p, q}
+		}
+		if err == nil {
+			err = key.Validate()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", k.Kid, err)
+		}
+		key.Precompute()
+		keys = append(keys, privateKey{Kid: k.Kid, Key: key})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no private key found")
+	}
+	return keys, nil
+}
+
+// decrypt returns the signed JWT nested in an encrypted one.
+func (d *decrypter) decrypt(token string) (string, error) {
+	if d == nil {
+		return "", errors.New("encrypted tokens are not accepted")
+	}
+	if strings.Count(token, ".") != 4 {
+		return "", malformedJWTError("token is not an encrypted JWT")
+	}
+	parts := strings.Split(token, ".")
+	var header jweHeader
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(rawHeader, &header) != nil {
+		return "", malformedJWTError("malformed JWE header")
+	}
+	if header.Zip != "" {
+		return "", fmt.Errorf("compressed tokens are not supported")
+	}
+	var oaepHash hash.Hash
+	switch header.Alg {
+	case "RSA-OAEP":
+		oaepHash = sha1.New()
+	case "RSA-OAEP-256":
+		oaepHash = sha256.New()
+	default:
+		return "", fmt.Errorf("unsupported key encryption algorithm %q", header.Alg)
+	}
+	var keySize int
+	switch header.Enc {
+	case "A128GCM":
+		keySize = 16
+	case "A192GCM":
+		keySize = 24
+	case "A256GCM":
+		keySize = 32
+	default:
+		return "", fmt.Errorf("unsupported content encryption algorithm %q", header.Enc)
+	}
+
+	var decoded [4][]byte
+	for i := range decoded {
+		decoded[i], err = base64.RawURLEncoding.DecodeString(parts[i+1])
+		if err != nil {
+			return "", malformedJWTError("malformed JWE")
+		}
+	}
+	encryptedKey, iv, ciphertext, tag := decoded[0], decoded[1], decoded[2], decoded[3]
+
+	var cek []byte
+	for _, k := range d.Keys {
+		if header.Kid != "" && k.Kid != "" && k.Kid != header.Kid {
+			continue
+		}
+		oaepHash.Reset()
+		cek, err = rsa.DecryptOAEP(oaepHash, rand.Reader, k.Key, encryptedKey, nil)
+		if err == nil {
+			break
+		}
+	}
+	if cek == nil {
+		return "", errors.New("the token is not encrypted with a known key")
+	}
+	if len(cek) != keySize {
+		return "", errors.New("the content encryption key has an invalid size")
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil || len(iv) == 0 {
+		return "", malformedJWTError("malformed JWE initialization vector")
+	}
+	// The additional authenticated data is the encoded header.
+	plaintext, err := gcm.Open(nil, iv, append(ciphertext, tag...), []byte(parts[0]))
+	if err != nil {
+		return "", errors.New("the token can't be decrypted")
+	}
+
+	nested := string(plaintext)
+	if !strings.EqualFold(header.Cty, "JWT") && strings.Count(nested, ".") != 2 {
+		return "", errors.New("the encrypted token does not contain a signed JWT")
+	}
+	return nested, nil
+}
@@ -0,0 +1,105 @@
+package openidauth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+)
+
+// jwtHeader is the JOSE header of a signed JWT.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// rawJWT is a decoded but not yet verified JWT.
+type rawJWT struct {
+	Header       jwtHeader
+	Claims       map[string]interface{}
+	SigningInput string
+	Signature    []byte
+}
+
+// Limits on the decoded header and claims of a JWT, checked before they are
+// decoded and parsed. Real tokens stay far below them.
+const (
+	maxJWTHeaderSize = 8 << 10
+	maxJWTClaimsSize = 64 << 10
+)
+
+// malformedJWTError is returned for tokens that can't be parsed at all.
+type malformedJWTError string
+
+func (e malformedJWTError) Error() string {
+	return string(e)
+}
+
+// checkJWTSize checks the size of the header and claims of a signed JWT
+// without decoding them. Other tokens pass.
+func checkJWTSize(token string) error {
+	if strings.Count(token, ".") != 2 {
+		return nil
+	}
+	parts := strings.SplitN(token, ".", 3)
+	if base64.RawURLEncoding.DecodedLen(len(parts[0])) > maxJWTHeaderSize {
+		return malformedJWTError("JWT header too large")
+	}
+	if base64.RawURLEncoding.DecodedLen(len(parts[1])) > maxJWTClaimsSize {
+		return malformedJWTError("JWT claims too large")
+	}
+	return nil
+}
+
+// parseJWT decodes a JWT in compact serialization without verifying it.
+func parseJWT(token string) (*rawJWT, error) {
+	// Counting first keeps a token of dots from being split into a huge
+	// slice.
+	if strings.Count(token, ".") != 2 {
+		return nil, malformedJWTError("token is not a JWT")
+	}
+	if err := checkJWTSize(token); err != nil {
+		return nil, err
+	}
+	parts := strings.Split(token, ".")
+
+	t := &rawJWT{SigningInput: parts[0] + "." + parts[1]}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, malformedJWTError("malformed JWT header")
+	}
+	if err := json.Unmarshal(header, &t.Header); err != nil {
+		return nil, malformedJWTError("malformed JWT header")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, malformedJWTError("malformed JWT payload")
+	}
+	if err := json.Unmarshal(payload, &t.Claims); err != nil || t.Claims == nil {
+		return nil, malformedJWTError("malformed JWT payload")
+	}
+
+	t.Signature, err = base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, malformedJWTError("malformed JWT signature")
+	}
+	return t, nil
+}
+
+// audiences returns the aud claim, which can be a string or an array.
+func (t *rawJWT) audiences() []string {
+	switch aud := t.Claims["aud"].(type) {
+	case string:
+		return []string{aud}
+	case []interface{}:
+		result := make([]string, 0, len(aud))
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package openidauth
+
+import (
+	"sort"
+
+	"github.com/emanoelxavier/openid2go/openid"
+)
+
+const profileKeycloak = "keycloak"
+
+// keycloakProfile flattens the roles of Keycloak tokens into the roles
+// claim. Keycloak nests the realm roles in realm_access.roles and the roles
+// of each client in resource_access.<client>.roles. Realm roles and the
+// roles of the client ids of the provider are added as they are, the roles
+// of all clients also as <client>:<role>.
+type keycloakProfile struct {
+	ClientIds []string
+}
+
+// normalize adds the roles to the roles claim.
+func (k *keycloakProfile) normalize(u *openid.User) error {
+	var roles []interface{}
+	seen := make(map[string]bool)
+	add := func(role string) {
+		if !seen[role] {
+			seen[role] = true
+			roles = append(roles, role)
+		}
+	}
+
+	switch existing := u.Claims["roles"].(type) {
+	case []interface{}:
+		for _, r := range existing {
+			if s, ok := r.(string); ok {
+				add(s)
+			}
+		}
+	case string:
+		add(existing)
+	}
+
+	if realm, ok := u.Claims["realm_access"].(map[string]interface{}); ok {
+		for _, role := range stringList(realm["roles"]) {
+			add(role)
+		}
+	}
+	if resources, ok := u.Claims["resource_access"].(map[string]interface{}); ok {
+		clients := make([]string, 0, len(resources))
+		for client := range resources {
+			clients = append(clients, client)
+		}
+		sort.Strings(clients)
+		for _, client := range clients {
+			access, ok := resources[client].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			own := false
+			for _, id := range k.ClientIds {
+				if id == client {
+					own = true
+				}
+			}
+			for _, role := range stringList(access["roles"]) {
+				if own {
+					add(role)
+				}
+				add(client + ":" + role)
+			}
+		}
+	}
+
+	if len(roles) > 0 {
+		u.Claims["roles"] = roles
+	}
+	return nil
+}
+
+// stringList returns the strings in a JSON array.
+func stringList(v interface{}) []string {
+	list, _ := v.([]interface{})
+	var strs []string
+	for _, e := range list {
+		if s, ok := e.(string); ok {
+			strs = append(strs, s)
+		}
+	}
+	return strs
+}
@@ -0,0 +1,168 @@
+package openidauth
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often the key files are checked for changes.
+const keyFileCheckInterval = 5 * time.Second
+
+// keySource provides the signing keys of an issuer that doesn't publish a
+// JWKS the middleware can fetch.
+type keySource interface {
+	Keys() ([]publicKey, error)
+}
+
+// keyFiles provides signing keys from local files instead of the JWKS of the
+// issuer, for environments that can't reach the issuer. The files are
+// reloaded when they change.
+type keyFiles struct {
+	JWKSFile string
+	PEMFiles []string
+
+	mu      sync.Mutex
+	checked time.Time
+	mtimes  map[string]time.Time
+	keys    []publicKey
+	err     error
+}
+
+func newKeyFiles(jwksFile string, pemFiles []string) *keyFiles {
+	return &keyFiles{JWKSFile: jwksFile, PEMFiles: pemFiles}
+}
+
+// Keys returns the keys in the files, reloading them if any file has been
+// modified since they were last read.
+func (f *keyFiles) Keys() ([]publicKey, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	if f.mtimes != nil && now.Sub(f.checked) < keyFileCheckInterval {
+		return f.keys, f.err
+	}
+	f.checked = now
+
+	mtimes, err := f.modTimes()
+	if err != nil {
+		// Keep using the keys we have if a file is briefly missing while
+		// it is being replaced.
+		if f.keys != nil {
+			return f.keys, nil
+		}
+		return nil, err
+	}
+	if f.mtimes != nil && sameModTimes(mtimes, f.mtimes) {
+		return f.keys, f.err
+	}
+
+	keys, err := f.load()
+	if err != nil && f.keys != nil {
+		return f.keys, nil
+	}
+	f.mtimes, f.keys, f.err = mtimes, keys, err
+	return keys, err
+}
+
+func (f *keyFiles) files() []string {
+	var files []string
+	if f.JWKSFile != "" {
+		files = append(files, f.JWKSFile)
+	}
+	return append(files, f.PEMFiles...)
+}
+
+func (f *keyFiles) modTimes() (map[string]time.Time, error) {
+	mtimes := make(map[string]time.Time)
+	for _, name := range f.files() {
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		mtimes[name] = info.ModTime()
+	}
+	return mtimes, nil
+}
+
+func sameModTimes(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, t := range a {
+		if !b[name].Equal(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// load reads the keys from all the files.
+func (f *keyFiles) load() ([]publicKey, error) {
+	var keys []publicKey
+	if f.JWKSFile != "" {
+		body, err := ioutil.ReadFile(f.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		jwks, err := parseJWKS(body)
+		if err != nil {
+			return nil, fmt.Errorf("openidauth: %s: %v", f.JWKSFile, err)
+		}
+		keys = append(keys, jwks...)
+	}
+	for _, name := range f.PEMFiles {
+		body, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		pemKeys, err := parsePEMKeys(body)
+		if err != nil {
+			return nil, fmt.Errorf("openidauth: %s: %v", name, err)
+		}
+		keys = append(keys, pemKeys...)
+	}
+	return keys, nil
+}
+
+// parsePEMKeys reads the public keys and certificates in a PEM file.
+func parsePEMKeys(body []byte) ([]publicKey, error) {
+	var keys []publicKey
+	for {
+		var block *pem.Block
+		block, body = pem.Decode(body)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, publicKey{Key: key})
+		case "RSA PUBLIC KEY":
+			key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, publicKey{Key: key})
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, publicKey{Key: cert.PublicKey})
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no public key found")
+	}
+	return keys, nil
+}
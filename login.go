@@ -0,0 +1,739 @@
+package openidauth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/emanoelxavier/openid2go/openid"
+)
+
+const (
+	defaultSessionCookieName = "openidauth_session"
+	defaultCallbackPath      = "/oauth2/callback"
+
+	// Used when no session_lifetime is configured and the ID token does not
+	// carry an exp claim.
+	defaultSessionLifetime = time.Hour
+
+	// How long a user has to complete the login at the provider, unless
+	// configured otherwise.
+	defaultLoginTimeout = 10 * time.Minute
+
+	// Where users go after the login if the page they asked for is not
+	// allowed, unless configured otherwise.
+	defaultLandingPage = "/"
+
+	// The state of a login is bound to the browser by a cookie with this
+	// prefix.
+	stateCookiePrefix = "openidauth_state_"
+)
+
+var defaultLoginScopes = []string{"openid", "profile", "email"}
+
+// loginConfig holds the settings of the interactive login flow.
+type loginConfig struct {
+	CallbackPath string        `json:"callback_path,omitempty"`
+	Scopes       []string      `json:"scopes,omitempty"`
+	Timeout      time.Duration `json:"timeout,omitempty"`
+
+	// After the login the user returns to the page they asked for if it is
+	// allowed by ReturnURLs, and to the landing page otherwise. Entries are
+	// path prefixes on the host of the request like /app, or hosts with an
+	// optional path prefix like *.example.com or docs.example.com/guides.
+	// Without entries only paths on the host of the request are allowed.
+	ReturnURLs  []string `json:"return_urls,omitempty"`
+	LandingPage string   `json:"landing_page,omitempty"`
+
+	// Requests to the logout path end the session. The browser is sent to
+	// the end_session_endpoint of the provider, which returns it to the
+	// post logout redirect.
+	LogoutPath         string `json:"logout_path,omitempty"`
+	PostLogoutRedirect string `json:"post_logout_redirect,omitempty"`
+
+	// The provider posts logout tokens to the back-channel logout path.
+	BackchannelLogoutPath string `json:"backchannel_logout_path,omitempty"`
+
+	// The logout page of the provider loads the front-channel logout path
+	// in an iframe.
+	FrontchannelLogoutPath string `json:"frontchannel_logout_path,omitempty"`
+
+	// The session cookie. Without a key sessions are kept in memory and the
+	// cookie only holds their id. With a key the session is encrypted into
+	// the cookie itself.
+	CookieName      string        `json:"cookie_name,omitempty"`
+	CookieDomain    string        `json:"cookie_domain,omitempty"`
+	CookieSameSite  string        `json:"cookie_samesite,omitempty"`
+	SessionLifetime time.Duration `json:"session_lifetime,omitempty"`
+	SessionKey      string        `json:"session_key,omitempty"`
+	SessionKeyFile  string        `json:"session_key_file,omitempty"`
+	sessionKey      string
+
+	// Sessions not used for the idle timeout end, and no session lasts
+	// longer than the max lifetime, refreshes included.
+	SessionIdleTimeout time.Duration `json:"session_idle_timeout,omitempty"`
+	SessionMaxLifetime time.Duration `json:"session_max_lifetime,omitempty"`
+
+	// A subject has at most SessionLimit sessions, logging in again ends the
+	// oldest. Only sessions kept in the storage can be limited.
+	SessionLimit int `json:"session_limit,omitempty"`
+
+	// Bind binds the sessions to the client fingerprint, set from
+	// Config.Fingerprint.
+	Bind string `json:"-"`
+
+	// With StatelessLogin the logins waiting for the callback are sealed
+	// with the session key into the state parameter instead of being kept
+	// in the storage, so the callback can reach any instance.
+	StatelessLogin bool `json:"stateless_login,omitempty"`
+}
+
+// pendingLogin is a login that has been redirected to the provider and is
+// waiting for the callback.
+type pendingLogin struct {
+	ReturnURL string    `json:"return_url"`
+	Expires   time.Time `json:"expires"`
+	Nonce     string    `json:"nonce"`
+
+	// The PKCE code verifier, sent with the authorization code to prove
+	// that the code is redeemed by the client that asked for it.
+	CodeVerifier string `json:"code_verifier"`
+
+	// The authentication that was asked for to step up.
+	StepUp *authContext `json:"step_up,omitempty"`
+}
+
+// tokenResponse is the response from the token endpoint of the provider.
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	IDToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// loginHandler implements the OpenID Connect Authorization Code flow for
+// browser clients. Unauthenticated users are redirected to the provider and
+// a session cookie is established when they return to the callback path.
+type loginHandler struct {
+	Provider           providerConfig
+	Discovery          *discovery
+	CallbackPath       string
+	Scopes             []string
+	LogoutPath         string
+	PostLogoutRedirect string
+	BackchannelPath    string
+	FrontchannelPath   string
+	Validator          *tokenValidator
+	Sessions           sessionStore
+	Revocations        *revocations
+	Cookie             http.Cookie
+	Lifetime           time.Duration
+	IdleTimeout        time.Duration
+	MaxLifetime        time.Duration
+	Timeout            time.Duration
+	ReturnURLs         []string
+	LandingPage        string
+	Bind               string
+	Storage            storage
+	Client             *providerClient
+
+	// States seals the pending logins into the state parameter. Without it
+	// they are kept in the Storage.
+	States *sealer
+
+	// HostedDomain is passed to Google as the hd parameter, so that only
+	// accounts of the domain are offered.
+	HostedDomain string
+}
+
+func newLoginHandler(provider providerConfig, cfg *loginConfig, validator *tokenValidator, cache *fetchCache, store storage) (*loginHandler, error) {
+	var sessions sessionStore = &serverSessionStore{Storage: store, Limit: cfg.SessionLimit}
+	var states *sealer
+	if cfg.sessionKey != "" {
+		key, err := parseKey(cfg.sessionKey)
+		if err != nil {
+			return nil, fmt.Errorf("openidauth: invalid session_key: %v", err)
+		}
+		if sessions, err = newCookieSessionStore(key); err != nil {
+			return nil, err
+		}
+		if cfg.StatelessLogin {
+			if states, err = newSealer(key, sealLoginState); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sameSite, err := parseSameSite(cfg.CookieSameSite)
+	if err != nil {
+		return nil, fmt.Errorf("openidauth: %v", err)
+	}
+
+	return &loginHandler{
+		Provider:           provider,
+		Discovery:          newDiscovery(provider, cache),
+		CallbackPath:       cfg.CallbackPath,
+		Scopes:             cfg.Scopes,
+		LogoutPath:         cfg.LogoutPath,
+		PostLogoutRedirect: cfg.PostLogoutRedirect,
+		BackchannelPath:    cfg.BackchannelLogoutPath,
+		FrontchannelPath:   cfg.FrontchannelLogoutPath,
+		Validator:          validator,
+		Sessions:           sessions,
+		Revocations:        &revocations{Storage: store},
+		Cookie: http.Cookie{
+			Name:     cfg.CookieName,
+			Domain:   cfg.CookieDomain,
+			Path:     "/",
+			SameSite: sameSite,
+			HttpOnly: true,
+		},
+		Lifetime:    cfg.SessionLifetime,
+		IdleTimeout: cfg.SessionIdleTimeout,
+		MaxLifetime: cfg.SessionMaxLifetime,
+		Timeout:     cfg.Timeout,
+		ReturnURLs:  cfg.ReturnURLs,
+		LandingPage: cfg.LandingPage,
+		Bind:        cfg.Bind,
+		Storage:     store,
+		Client:      cache.Client,
+		States:      states,
+	}, nil
+}
+
+// Session returns the session of the request, or nil if the request does not
+// carry a valid session cookie. An expired session is refreshed with its
+// refresh token if it has one, so the user is not sent to the provider in
+// the middle of their work.
+func (l *loginHandler) Session(w http.ResponseWriter, r *http.Request) *session {
+	cookie, err := r.Cookie(l.Cookie.Name)
+	if err != nil {
+		return nil
+	}
+	sess := l.Sessions.Load(cookie.Value)
+	if sess == nil || l.Revocations.Revoked(sess) {
+		return nil
+	}
+	now := time.Now()
+	// A session used by another client is refreshed at the provider, which
+	// checks that the user may still use it, or ended.
+	moved := l.Bind != "" && sess.Fingerprint != "" && sess.Fingerprint != clientFingerprint(r)
+	if l.timedOut(sess, now) || moved && (l.Bind == bindReject || sess.RefreshToken == "") {
+		l.Sessions.Delete(cookie.Value)
+		l.clearSessionCookie(w, r)
+		return nil
+	}
+	if now.Before(sess.Expires) && !moved {
+		if l.IdleTimeout > 0 && now.Sub(sess.lastSeen()) >= sessionTouchInterval {
+			sess.LastSeen = now
+			if value, err := l.Sessions.Update(cookie.Value, sess); err == nil {
+				l.setSessionCookie(w, r, value, l.cookieExpiry(sess))
+			}
+		}
+		return sess
+	}
+	if sess.RefreshToken == "" {
+		return nil
+	}
+
+	refreshed, err := l.refresh(sess)
+	if err != nil {
+		return nil
+	}
+	refreshed.Fingerprint = l.fingerprint(r)
+	// The refreshed session takes the place of the old one, it does not
+	// count as another session of the subject.
+	value, err := l.Sessions.Update(cookie.Value, refreshed)
+	if err != nil {
+		return nil
+	}
+	l.setSessionCookie(w, r, value, l.cookieExpiry(refreshed))
+	return refreshed
+}
+
+// fingerprint returns the fingerprint to bind a new session to, or nothing
+// if sessions are not bound.
+func (l *loginHandler) fingerprint(r *http.Request) string {
+	if l.Bind == "" {
+		return ""
+	}
+	return clientFingerprint(r)
+}
+
+// timedOut reports whether the session has been idle for too long or has
+// reached its max lifetime.
+func (l *loginHandler) timedOut(sess *session, now time.Time) bool {
+	if l.MaxLifetime > 0 && !now.Before(sess.Created.Add(l.MaxLifetime)) {
+		return true
+	}
+	return l.IdleTimeout > 0 && !now.Before(sess.lastSeen().Add(l.IdleTimeout))
+}
+
+// cookieExpiry returns when the browser can drop the session cookie.
+func (l *loginHandler) cookieExpiry(sess *session) time.Time {
+	expires := sess.Deadline()
+	if l.MaxLifetime > 0 && sess.Created.Add(l.MaxLifetime).Before(expires) {
+		return sess.Created.Add(l.MaxLifetime)
+	}
+	return expires
+}
+
+// refresh gets new tokens for an expired session from the token endpoint.
+func (l *loginHandler) refresh(sess *session) (*session, error) {
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", sess.RefreshToken)
+	tokens, err := l.requestTokens(form)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshed := &session{
+		User:         sess.User,
+		IDToken:      sess.IDToken,
+		RefreshToken: sess.RefreshToken,
+		Created:      sess.Created,
+		LastSeen:     time.Now(),
+	}
+	// Providers may or may not issue a new ID token and rotate the refresh
+	// token.
+	if tokens.IDToken != "" {
+		user, err := l.Validator.ValidateIDToken(tokens.IDToken)
+		if err != nil {
+			return nil, err
+		}
+		if user.ID != sess.User.ID || user.Issuer != sess.User.Issuer {
+			return nil, errors.New("openidauth: refreshed ID token is for another user")
+		}
+		refreshed.User = user
+		refreshed.IDToken = tokens.IDToken
+	}
+	if tokens.RefreshToken != "" {
+		refreshed.RefreshToken = tokens.RefreshToken
+	}
+	refreshed.Expires = l.expiry(refreshed.User, tokens)
+	return refreshed, nil
+}
+
+// expiry returns when a session established with the tokens expires.
+func (l *loginHandler) expiry(user *openid.User, tokens *tokenResponse) time.Time {
+	if l.Lifetime > 0 {
+		return time.Now().Add(l.Lifetime)
+	}
+	if tokens.IDToken != "" {
+		if exp := claimTime(user.Claims["exp"]); !exp.IsZero() {
+			return exp
+		}
+	}
+	if tokens.ExpiresIn > 0 {
+		return time.Now().Add(time.Duration(tokens.ExpiresIn) * time.Second)
+	}
+	return time.Now().Add(defaultSessionLifetime)
+}
+
+// setSessionCookie sends the session cookie to the browser.
+func (l *loginHandler) setSessionCookie(w http.ResponseWriter, r *http.Request, value string, expires time.Time) {
+	cookie := l.Cookie
+	cookie.Value = value
+	cookie.Expires = expires
+	// Browsers drop SameSite=None cookies that are not Secure.
+	cookie.Secure = r.TLS != nil || cookie.SameSite == http.SameSiteNoneMode
+	http.SetCookie(w, &cookie)
+}
+
+// Redirect sends the browser to the authorization endpoint of the provider.
+// It returns to the requested page after the login.
+func (l *loginHandler) Redirect(w http.ResponseWriter, r *http.Request) (int, error) {
+	return l.redirect(w, r, r.URL.RequestURI(), nil)
+}
+
+// redirect starts a login that returns to returnURL. With stepUp the
+// provider is asked for a stronger authentication.
+func (l *loginHandler) redirect(w http.ResponseWriter, r *http.Request, returnURL string, stepUp *authContext) (int, error) {
+	doc, err := l.Discovery.Document()
+	if err != nil {
+		return http.StatusServiceUnavailable, err
+	}
+
+	verifier, err := randomString(32)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	nonce, err := randomString(32)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	state, err := l.saveLogin(&pendingLogin{
+		ReturnURL:    l.returnURL(r, returnURL),
+		Expires:      time.Now().Add(l.Timeout),
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		StepUp:       stepUp,
+	})
+	if err != nil {
+		return http.StatusServiceUnavailable, err
+	}
+
+	// The state is only accepted from the browser that started the login.
+	// The cookie is named after the state so logins in several tabs don't
+	// overwrite each other.
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookiePrefix + state[:8],
+		Value:    state,
+		Path:     l.callbackPath(),
+		MaxAge:   int(l.Timeout / time.Second),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", l.Provider.ClientIds[0])
+	params.Set("redirect_uri", l.redirectURI(r))
+	params.Set("scope", strings.Join(l.Scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", codeChallenge(verifier))
+	params.Set("code_challenge_method", "S256")
+	if l.HostedDomain != "" {
+		params.Set("hd", l.HostedDomain)
+	}
+	if !stepUp.empty() {
+		for name, values := range stepUp.loginParams() {
+			params[name] = values
+		}
+	}
+
+	http.Redirect(w, r, addQuery(doc.AuthorizationEndpoint, params), http.StatusFound)
+	return 0, nil
+}
+
+// saveLogin keeps a login until the callback and returns its state. The
+// state is random and the login is stored, or the login is sealed into the
+// state when it is stateless.
+func (l *loginHandler) saveLogin(login *pendingLogin) (string, error) {
+	value, err := json.Marshal(login)
+	if err != nil {
+		return "", err
+	}
+	if l.States != nil {
+		return l.States.seal(value)
+	}
+	state, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+	return state, l.Storage.Set("login:"+state, value, l.Timeout)
+}
+
+// takeLogin returns the login of the state, or nil if it is unknown or has
+// expired. Stored logins can only be taken once. Sealed logins can't be
+// forgotten, they are bound to the browser by the state cookie, which the
+// callback removes, and expire after the login timeout.
+func (l *loginHandler) takeLogin(state string) (*pendingLogin, error) {
+	var value []byte
+	if l.States != nil {
+		value = l.States.open(state)
+	} else {
+		var err error
+		if value, err = l.Storage.Take("login:" + state); err != nil {
+			return nil, err
+		}
+	}
+	login := &pendingLogin{}
+	if value == nil || json.Unmarshal(value, login) != nil || time.Now().After(login.Expires) {
+		return nil, nil
+	}
+	// Every login has a nonce and a code verifier. Without them the value
+	// isn't a login, and an empty nonce would match an ID token without one.
+	if login.Nonce == "" || login.CodeVerifier == "" {
+		return nil, nil
+	}
+	return login, nil
+}
+
+// ServeCallback handles the redirect back from the provider. It exchanges the
+// authorization code for tokens, validates the ID token and establishes the
+// session.
+func (l *loginHandler) ServeCallback(w http.ResponseWriter, r *http.Request) (int, error) {
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		return http.StatusUnauthorized, fmt.Errorf("openidauth: login failed: %s %s", e, q.Get("error_description"))
+	}
+
+	// Without a state the user wants to log in, for example from a link on
+	// the error page, and returns to the page given in the return parameter.
+	if _, ok := q["state"]; !ok {
+		return l.redirect(w, r, q.Get("return"), nil)
+	}
+
+	state := q.Get("state")
+	if len(state) < 8 {
+		return http.StatusBadRequest, errors.New("openidauth: invalid login state")
+	}
+	cookie, err := r.Cookie(stateCookiePrefix + state[:8])
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		return http.StatusBadRequest, errors.New("openidauth: login state does not belong to this browser")
+	}
+	http.SetCookie(w, &http.Cookie{Name: cookie.Name, Path: l.callbackPath(), MaxAge: -1})
+
+	login, err := l.takeLogin(state)
+	if err != nil {
+		return http.StatusServiceUnavailable, err
+	}
+	if login == nil {
+		return http.StatusBadRequest, errors.New("openidauth: unknown or expired login state")
+	}
+
+	code := q.Get("code")
+	if code == "" {
+		return http.StatusBadRequest, errors.New("openidauth: authorization code missing in callback")
+	}
+
+	tokens, err := l.exchangeCode(code, l.redirectURI(r), login.CodeVerifier)
+	if err != nil {
+		return http.StatusBadGateway, err
+	}
+
+	user, err := l.Validator.ValidateIDToken(tokens.IDToken)
+	if err != nil {
+		return http.StatusUnauthorized, err
+	}
+	if nonce, _ := user.Claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(nonce), []byte(login.Nonce)) != 1 {
+		return http.StatusUnauthorized, errors.New("openidauth: ID token nonce does not match the login")
+	}
+	if err := login.StepUp.check(user); err != nil {
+		// Don't send the user around in circles if the provider can't
+		// authenticate them as required.
+		return http.StatusForbidden, fmt.Errorf("openidauth: the provider did not authenticate the user as required: %v", err)
+	}
+
+	sess := &session{
+		User:         user,
+		IDToken:      tokens.IDToken,
+		RefreshToken: tokens.RefreshToken,
+		Created:      time.Now(),
+		Expires:      l.expiry(user, tokens),
+		Fingerprint:  l.fingerprint(r),
+	}
+	value, err := l.Sessions.Save(sess)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	l.setSessionCookie(w, r, value, l.cookieExpiry(sess))
+	http.Redirect(w, r, login.ReturnURL, http.StatusFound)
+	return 0, nil
+}
+
+// ServeLogout ends the session of the request and sends the browser to the
+// provider to end the session there as well (RP-initiated logout).
+func (l *loginHandler) ServeLogout(w http.ResponseWriter, r *http.Request) (int, error) {
+	var idToken string
+	if cookie, err := r.Cookie(l.Cookie.Name); err == nil {
+		if sess := l.Sessions.Load(cookie.Value); sess != nil {
+			idToken = sess.IDToken
+		}
+		l.Sessions.Delete(cookie.Value)
+	}
+	l.clearSessionCookie(w, r)
+
+	returnURL := l.absoluteURL(r, l.PostLogoutRedirect)
+	doc, err := l.Discovery.Document()
+	if err != nil || doc.EndSessionEndpoint == "" {
+		// The local session is gone, which is the best we can do.
+		http.Redirect(w, r, returnURL, http.StatusFound)
+		return 0, nil
+	}
+
+	params := url.Values{}
+	params.Set("client_id", l.Provider.ClientIds[0])
+	params.Set("post_logout_redirect_uri", returnURL)
+	if idToken != "" {
+		params.Set("id_token_hint", idToken)
+	}
+	http.Redirect(w, r, addQuery(doc.EndSessionEndpoint, params), http.StatusFound)
+	return 0, nil
+}
+
+// clearSessionCookie removes the session cookie from the browser.
+func (l *loginHandler) clearSessionCookie(w http.ResponseWriter, r *http.Request) {
+	cookie := l.Cookie
+	cookie.MaxAge = -1
+	cookie.Secure = r.TLS != nil || cookie.SameSite == http.SameSiteNoneMode
+	http.SetCookie(w, &cookie)
+}
+
+// exchangeCode redeems the authorization code at the token endpoint.
+func (l *loginHandler) exchangeCode(code, redirectURI, verifier string) (*tokenResponse, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURI)
+	form.Set("code_verifier", verifier)
+	tokens, err := l.requestTokens(form)
+	if err != nil {
+		return nil, err
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("openidauth: token endpoint did not return an id_token")
+	}
+	return tokens, nil
+}
+
+// requestTokens posts a grant to the token endpoint.
+func (l *loginHandler) requestTokens(form url.Values) (*tokenResponse, error) {
+	doc, err := l.Discovery.Document()
+	if err != nil {
+		return nil, err
+	}
+
+	form.Set("client_id", l.Provider.ClientIds[0])
+	if secret := l.Provider.clientSecret(); secret != "" {
+		form.Set("client_secret", secret)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, doc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := l.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("openidauth: token endpoint returned status %d", resp.StatusCode)
+	}
+
+	tokens := &tokenResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// redirectURI returns the absolute URL of the callback path for the request.
+func (l *loginHandler) redirectURI(r *http.Request) string {
+	return l.absoluteURL(r, l.CallbackPath)
+}
+
+// absoluteURL returns the URL of a path on the host of the request. Absolute
+// URLs are returned unchanged.
+func (l *loginHandler) absoluteURL(r *http.Request, path string) string {
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		return path
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + path
+}
+
+// returnURL returns where to send the browser after the login: raw if it is
+// allowed, the landing page otherwise. This keeps the login from being used
+// to redirect users to any site.
+func (l *loginHandler) returnURL(r *http.Request, raw string) string {
+	// Browsers read a backslash like a slash, so /\evil.com is another host.
+	if raw == "" || strings.Contains(raw, "\\") {
+		return l.LandingPage
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return l.LandingPage
+	}
+	var host string
+	switch {
+	case u.Scheme == "" && u.Host == "" && strings.HasPrefix(raw, "/") && !strings.HasPrefix(raw, "//"):
+	case (u.Scheme == "https" || u.Scheme == "http") && u.Host != "" && u.User == nil:
+		if !strings.EqualFold(u.Host, r.Host) {
+			host = strings.ToLower(u.Host)
+		}
+	default:
+		return l.LandingPage
+	}
+
+	paths := false
+	for _, entry := range l.ReturnURLs {
+		entryHost, entryPath := splitReturnURL(entry)
+		paths = paths || entryHost == ""
+		if returnHostMatches(entryHost, host) && pathHasPrefix(u.Path, entryPath) {
+			return raw
+		}
+	}
+	if host == "" && !paths {
+		return raw
+	}
+	return l.LandingPage
+}
+
+// splitReturnURL splits an entry of the return URLs into its host, empty for
+// the host of the request, and its path prefix.
+func splitReturnURL(entry string) (host, path string) {
+	if i := strings.Index(entry, "/"); i >= 0 {
+		return strings.ToLower(entry[:i]), entry[i:]
+	}
+	return strings.ToLower(entry), ""
+}
+
+// returnHostMatches reports whether host matches the host of an entry. A
+// leading *. matches any subdomain.
+func returnHostMatches(pattern, host string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
+
+// pathHasPrefix reports whether path is prefix or below it.
+func pathHasPrefix(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// callbackPath returns the path part of the configured callback.
+func (l *loginHandler) callbackPath() string {
+	if u, err := url.Parse(l.CallbackPath); err == nil {
+		return u.Path
+	}
+	return l.CallbackPath
+}
+
+// codeChallenge derives the S256 PKCE code challenge from the verifier.
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// addQuery appends the parameters to a URL that may already have a query.
+func addQuery(endpoint string, params url.Values) string {
+	if strings.Contains(endpoint, "?") {
+		return endpoint + "&" + params.Encode()
+	}
+	return endpoint + "?" + params.Encode()
+}
+
+// claimTime converts a NumericDate claim like exp to a time.
+func claimTime(v interface{}) time.Time {
+	switch t := v.(type) {
+	case float64:
+		return time.Unix(int64(t), 0)
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return time.Unix(i, 0)
+		}
+	}
+	return time.Time{}
+}
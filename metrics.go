@@ -0,0 +1,133 @@
+package openidauth
+
+import (
+	"time"
+
+	"github.com/emanoelxavier/openid2go/openid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "caddy"
+	metricsSubsystem = "openidauth"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "requests_total",
+		Help:      "Requests to protected paths by result, error code, token source and issuer.",
+	}, []string{"result", "code", "source", "issuer"})
+
+	validationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "validation_duration_seconds",
+		Help:      "Time spent validating tokens.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"result"})
+
+	fetchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "fetch_duration_seconds",
+		Help:      "Time spent fetching discovery documents and JWKS from the providers.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, validationDuration, fetchDuration)
+}
+
+// Results used as metric labels.
+const (
+	resultSuccess   = "success"
+	resultFailure   = "failure"
+	resultForbidden = "forbidden"
+)
+
+// observeAuthentication records the outcome of authenticating a request.
+func observeAuthentication(source string, u *openid.User, err error) {
+	result, issuer := resultSuccess, ""
+	if u != nil {
+		issuer = u.Issuer
+	}
+	if err != nil {
+		result = resultFailure
+		if _, ok := err.(*authorizationError); ok {
+			result = resultForbidden
+		}
+	}
+	requestsTotal.WithLabelValues(result, errorCode(err), source, issuer).Inc()
+}
+
+// observeValidation records how long validating a token took.
+func observeValidation(d time.Duration, err error) {
+	result := resultSuccess
+	if err != nil {
+		result = resultFailure
+	}
+	validationDuration.WithLabelValues(result).Observe(d.Seconds())
+}
+
+// observeFetch records how long fetching a document from a provider took.
+func observeFetch(d time.Duration, err error) {
+	result := resultSuccess
+	if err != nil {
+		result = resultFailure
+	}
+	fetchDuration.WithLabelValues(result).Observe(d.Seconds())
+}
+
+// errorCode returns a short, stable name for an authentication error.
+func errorCode(err error) string {
+	switch e := err.(type) {
+	case nil:
+		return ""
+	case *authorizationError:
+		if e.Code != "" {
+			return e.Code
+		}
+		return "access_denied"
+	case *openid.ValidationError:
+		switch e.Code {
+		case openid.ValidationErrorAuthorizationHeaderNotFound:
+			return "token_not_found"
+		case openid.ValidationErrorAuthorizationHeaderWrongFormat,
+			openid.ValidationErrorAuthorizationHeaderWrongSchemeName:
+			return "malformed_header"
+		case openid.ValidationErrorJwtValidationFailure,
+			openid.ValidationErrorJwtValidationUnknownFailure:
+			return "invalid_token"
+		case openid.ValidationErrorInvalidAudienceType,
+			openid.ValidationErrorInvalidAudience,
+			openid.ValidationErrorAudienceNotFound:
+			return "invalid_audience"
+		case openid.ValidationErrorInvalidIssuerType,
+			openid.ValidationErrorInvalidIssuer,
+			openid.ValidationErrorIssuerNotFound:
+			return "invalid_issuer"
+		case openid.ValidationErrorInvalidSubjectType,
+			openid.ValidationErrorInvalidSubject,
+			openid.ValidationErrorSubjectNotFound:
+			return "invalid_subject"
+		case openid.ValidationErrorKidNotFound:
+			return "unknown_kid"
+		case openid.ValidationErrorGetOpenIdConfigurationFailure,
+			openid.ValidationErrorDecodeOpenIdConfigurationFailure,
+			openid.ValidationErrorGetJwksFailure,
+			openid.ValidationErrorDecodeJwksFailure,
+			openid.ValidationErrorEmptyJwk,
+			openid.ValidationErrorEmptyJwkKey,
+			openid.ValidationErrorMarshallingKey,
+			openid.ValidationErrorEmptyProviders:
+			return "provider_error"
+		case openid.ValidationErrorIdTokenEmpty:
+			return "token_not_found"
+		}
+		return "validation_error"
+	}
+	return "internal_error"
+}
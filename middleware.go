@@ -1,61 +1,61 @@
 package openidauth
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/emanoelxavier/openid2go/openid"
-	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-// A function literal that fulfils the requirement of openId.PrivdersGetter
-// It is used to sert up a new provider with the issuer and client ids from
-// the configuration.
-func getProviderFunc(issuer string, clientIds []string) openid.GetProvidersFunc {
-	return func() ([]openid.Provider, error) {
-		provider, err := openid.NewProvider(issuer, clientIds)
-		if err != nil {
-			return nil, err
-		}
-		return []openid.Provider{provider}, nil
-	}
-}
-
-// This struct fulfils the http.Handler interface that the openid.Authenticate
-// function uses. It will be used to store the authenticate result
-// so that we can read it back in this middleware and make decisions
-// based on it.
-type authenticationSuccessHandler struct {
-	Authenticated bool
-}
-
-// After successful validation of a token this handler will be called
-func (t *authenticationSuccessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	t.Authenticated = true
-}
+// errVerificationFailed is returned to Caddy after the response to a
+// request that failed authentication has been written.
+var errVerificationFailed = errors.New("Token verification failed")
 
 // This error handler allows us to customize the response
-func onAuthenticateFailed(e error, rw http.ResponseWriter, r *http.Request) bool {
-	if verr, ok := e.(*openid.ValidationError); ok {
+func (h auth) onAuthenticateFailed(e error, rw http.ResponseWriter, r *http.Request) bool {
+	if derr, ok := e.(*dpopError); ok {
+		status := h.Errors.Status(errorInvalidToken, http.StatusUnauthorized)
+		if status == http.StatusUnauthorized {
+			h.Errors.challenge(rw, "DPoP", "invalid_dpop_proof", derr.Description,
+				authParam{"algs", strings.Join(supportedAlgs, " ")})
+		}
+		h.Errors.Write(rw, r, status, "invalid_dpop_proof", derr.Description)
+	} else if verr, ok := e.(*openid.ValidationError); ok {
 		httpStatus := verr.HTTPStatus
+		code := "invalid_token"
+		class := errorInvalidToken
 
 		switch verr.Code {
 		case openid.ValidationErrorGetOpenIdConfigurationFailure:
 			httpStatus = http.StatusServiceUnavailable
+			code = "temporarily_unavailable"
+			class = errorUnavailable
 		case openid.ValidationErrorAuthorizationHeaderNotFound:
 			// Instead of responding with 400 Bad Response we want to say 401 Unauthorized
 			// and indicate that this resource is protected and that you can authenticate
-			// using a Bearer token. 400 Bad response was set in the validation error from
-			// the underlaying openid code.
+			// using a Bearer token.
 			httpStatus = http.StatusUnauthorized
-			rw.Header().Add("WWW-Authenticate", "Bearer")
+			code = ""
+			class = errorMissingToken
+		case openid.ValidationErrorAuthorizationHeaderWrongFormat:
+			// Rejected before validation, see checkTokenShape.
+			code = "invalid_request"
+			class = errorInvalidRequest
+		}
+		httpStatus = h.Errors.Status(class, httpStatus)
+		if httpStatus == http.StatusUnauthorized {
+			h.Errors.Challenge(rw, code, verr.Message)
+			h.Basic.challenge(rw, h.Errors)
 		}
-		http.Error(rw, verr.Message, httpStatus)
+		h.Errors.Write(rw, r, httpStatus, code, verr.Message)
 	} else {
 		// Not supposed to happen, but if it does we will have some information to go on.
-		rw.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(rw, e.Error())
+		h.Errors.Write(rw, r, http.StatusInternalServerError, "server_error", e.Error())
 	}
 
 	// We have handled the error, so return true to halt the execution so that
@@ -66,35 +66,458 @@ func onAuthenticateFailed(e error, rw http.ResponseWriter, r *http.Request) bool
 // ServeHTTP is the main entry point for the middleware during execution.
 func (h auth) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 
-	// To support having the token as a query parameter we extract it here and
-	// insert it as an Authorization header so that the underlaying code
-	// (which only can use the Authorization header) works.
+	setRequestID(w, r)
+
+	// Never trust identity headers sent by the client.
+	removeClaimHeaders(r, h.ClaimHeaders)
+	h.InternalToken.removeHeader(r)
+	h.HeaderSigner.removeHeaders(r)
+	if h.Webhook != nil {
+		h.Webhook.removeHeaders(r)
+	}
+
+	// Expose the metrics if the middleware is configured to do so.
+	if h.MetricsPath != "" && r.URL.Path == h.MetricsPath {
+		promhttp.Handler().ServeHTTP(w, r)
+		return 0, nil
+	}
+	if h.Health.matches(r) {
+		return h.Health.ServeHTTP(w, r)
+	}
+	if h.Admin.matches(r) {
+		return h.Admin.ServeHTTP(w, r)
+	}
+	if h.Dev.matches(r) {
+		return h.Dev.ServeHTTP(w, r)
+	}
+
+	// The provider redirects the browser back here after an interactive login.
+	if h.Login != nil && r.URL.Path == h.Login.callbackPath() {
+		return h.Login.ServeCallback(w, r)
+	}
+	if h.Login != nil && h.Login.LogoutPath != "" && r.URL.Path == h.Login.LogoutPath {
+		return h.Login.ServeLogout(w, r)
+	}
+	if h.Login != nil && h.Login.BackchannelPath != "" && r.URL.Path == h.Login.BackchannelPath {
+		return h.Login.ServeBackchannelLogout(w, r)
+	}
+	if h.Login != nil && h.Login.FrontchannelPath != "" && r.URL.Path == h.Login.FrontchannelPath {
+		return h.Login.ServeFrontchannelLogout(w, r)
+	}
+
+	// In shadow mode the decisions are only recorded.
+	if h.Shadow {
+		return h.serveShadow(w, r)
+	}
+
+	// Paths listed as exceptions are never protected, even if they are inside
+	// a protected path.
+	path := r.URL.Path
+	if h.ExceptIndex.lookup(path, func(i int) bool { return h.Exceptions[i].Matches(path) }) >= 0 {
+		return h.Next.ServeHTTP(w, r)
+	}
+
+	// If the requested path and method match a rule in the configuration, validate the JWT.
+	// The first matching rule applies.
+	i := h.PathIndex.lookup(path, func(i int) bool { return h.Paths[i].matches(r) })
+	if i < 0 {
+		// pass request if no paths protected with JWT
+		return h.Next.ServeHTTP(w, r)
+	}
+	p := h.Paths[i]
+	if h.Debug {
+		h.debugf(r, "path %s matched", p.Path)
+	}
+	if responder := p.errors(r); responder != nil {
+		h.Errors = responder
+	}
+
+	// Clients that keep failing are turned away before their tokens
+	// cause any work.
+	if wait := h.Limiter.retryAfter(r, nil); wait > 0 {
+		return h.tooManyFailures(w, r, wait)
+	}
+
+	if h.Networks != nil {
+		inside := h.Networks.contains(r)
+		if inside && !h.Networks.RequireBoth {
+			// Trusted networks like health checkers don't need a token.
+			h.AuditLog.Log(r, "", nil, decisionBypass, nil)
+			return h.Next.ServeHTTP(w, r)
+		}
+		if !inside && h.Networks.RequireBoth {
+			err := &authorizationError{Description: "Requests from this network are not allowed"}
+			h.AuditLog.Log(r, "", nil, decisionDeny, err)
+			h.onAuthorizationFailed(err, w, r)
+			return 0, err
+		}
+	}
+
+	// Clients that can't get a token, like CI jobs, may send an API key
+	// on the paths that accept it.
+	if u, err := authenticateAPIKey(r, p, h.APIKeys); u != nil {
+		h.debugf(r, "authenticated by the api key %s", u.ID)
+		return h.serveAuthenticated(w, r, p, tokenSourceAPIKey, u)
+	} else if err != nil && !p.Optional {
+		h.record(r, tokenSourceAPIKey, nil, err)
+		h.onAuthenticateFailed(err, w, r)
+		return 0, errVerificationFailed
+	}
+
+	// The token can be read from several places in the request, in the
+	// configured order. Whatever is found is put in the Authorization
+	// header, which is what the backend sees. A token in a source that
+	// is not configured is never used.
 	// Note that tokens supplied via form data in the request body is NOT supported.
 	// According to the OpenID spec this MAY be implemented, but would require buffering the
 	// full request body to be able to both read it here and forward it to the backend.
-	token := r.URL.Query().Get("access_token")
-	if token != "" {
-		r.Header.Set("Authorization", "Bearer "+token)
+	span := startSpan(r, "openidauth.extract_token")
+	token, source, found := extractToken(r, h.TokenSources)
+	span.SetAttributes(attribute.String("openidauth.token_source", source.Kind), attribute.Bool("openidauth.token_found", found))
+	span.End()
+	if found {
+		// The same parsing as ParseBearer, so that what the fuzz tests
+		// cover is what requests go through.
+		if _, err := parseRawToken(token, authorizationScheme(r), source, h.MaxTokenSize); err != nil {
+			h.record(r, source.Kind, nil, err)
+			h.onAuthenticateFailed(err, w, r)
+			return 0, errVerificationFailed
+		}
+	}
+	if c := h.Credentials.client(r, p); c != nil && !found {
+		// Legacy clients that can't get a token themselves are trusted
+		// by their certificate, and get one from the middleware.
+		t, err := h.Credentials.token(c)
+		if err != nil {
+			h.record(r, tokenSourceClientCredentials, nil, err)
+			if aerr, ok := err.(*authorizationError); ok {
+				h.onAuthorizationFailed(aerr, w, r)
+				return 0, err
+			}
+			h.onAuthenticateFailed(err, w, r)
+			return 0, errVerificationFailed
+		}
+		h.debugf(r, "obtained a token for the certificate client %s", c.Name)
+		token, source, found = t, tokenSource{Kind: tokenSourceClientCredentials}, true
+	}
+	if !found {
+		// Clients that only know Basic authentication get a token for
+		// their credentials.
+		t, ok, err := h.Basic.token(r)
+		if err != nil && !p.Optional {
+			h.record(r, tokenSourceBasic, nil, err)
+			h.onAuthenticateFailed(err, w, r)
+			return 0, errVerificationFailed
+		}
+		if ok && err == nil {
+			token, source, found = t, tokenSource{Kind: tokenSourceBasic}, true
+		}
+	}
+	if h.Debug {
+		if found {
+			h.debugf(r, "token found in %s: %s", source.Kind, tokenSummary(token))
+		} else {
+			h.debugf(r, "no token found")
+		}
+	}
+	removeSubprotocolTokens(r, h.TokenSources)
+	scheme := "Bearer"
+	if found && source.Kind == tokenSourceHeader && source.Name == "" &&
+		strings.EqualFold(authorizationScheme(r), "DPoP") {
+		// Sender-constrained tokens keep their scheme, see dpop.go.
+		scheme = "DPoP"
+	}
+	r.Header.Del("Authorization")
+	if found {
+		r.Header.Set("Authorization", scheme+" "+token)
+	}
+
+	if p.Optional {
+		return h.serveOptional(w, r, p, source.Kind, token, found)
+	}
+
+	// Browsers that have logged in interactively carry a session cookie
+	// instead of a token. Those without either are sent to the provider.
+	if h.Login != nil {
+		if sess := h.Login.Session(w, r); sess != nil {
+			h.debugf(r, "authenticated by the session cookie")
+			return h.serveAuthenticated(w, r, p, "session", sess.User)
+		}
+		// WebSocket clients can't follow the redirect, they get 401.
+		if p.redirects(r) && r.Header.Get("Authorization") == "" && (r.Method == http.MethodGet || r.Method == http.MethodHead) &&
+			!isWebSocketUpgrade(r) {
+			h.AuditLog.Log(r, "", nil, decisionRedirect, nil)
+			return h.Login.Redirect(w, r)
+		}
+	}
+
+	// Opaque tokens can't be validated locally, ask the provider.
+	if found && p.HMAC == "" && len(h.Introspectors) > 0 && !looksLikeJWT(token) {
+		return h.serveIntrospected(w, r, p, source.Kind, token)
+	}
+
+	// Path matches. Authenticate
+	if !found {
+		// onAuthenticateFailed turns this into 401 with a Bearer challenge.
+		err := validationError(openid.ValidationErrorAuthorizationHeaderNotFound, http.StatusBadRequest,
+			"No token found in the request", nil)
+		h.record(r, "", nil, err)
+		h.onAuthenticateFailed(err, w, r)
+		return 0, errVerificationFailed
 	}
 
-	// If the requested path matches a path in the configuration, validate the JWT
-	for _, p := range h.Paths {
-		if !httpserver.Path(r.URL.Path).Matches(p) {
-			continue
+	u, err := h.validate(r, p, token)
+	if err != nil {
+		h.record(r, source.Kind, nil, err)
+		if h.FailOpen && providerUnavailable(err) {
+			// The operator prefers serving unauthenticated requests to
+			// serving none while the provider is down.
+			return h.Next.ServeHTTP(w, r)
 		}
+		// We return 0 to indicate that the response has already been written.
+		h.onAuthenticateFailed(err, w, r)
+		return 0, errVerificationFailed
+	}
+
+	// Authenticated so check authorization and call next middleware
+	return h.serveAuthenticated(w, r, p, source.Kind, u)
+}
+
+// serveAuthenticated checks that the authenticated user fulfils the
+// requirements of the path and calls the next middleware if it does.
+// The source is where the credentials were found and is used for metrics.
+func (h auth) serveAuthenticated(w http.ResponseWriter, r *http.Request, rule *pathRule, source string, u *openid.User) (int, error) {
+	if wait := h.Limiter.retryAfter(r, u); wait > 0 {
+		return h.tooManyFailures(w, r, wait)
+	}
+	var err error
+	if source != tokenSourceAPIKey {
+		// API keys are not issued by a provider.
+		err = h.Tenants.check(r, u)
+		if err == nil {
+			err = rule.checkIssuer(u)
+		}
+	}
+	if err == nil && hasToken(source) {
+		err = h.DPoP.verify(r, bearerToken(r), u)
+	}
+	if err == nil && hasToken(source) {
+		err = checkCertificateBinding(r, u, rule.CertBound)
+	}
+	if err == nil {
+		err = h.DenyList.Denied(u, bearerToken(r))
+	}
+	if err != nil {
+		h.record(r, source, u, err)
+		h.onAuthenticateFailed(err, w, r)
+		return 0, errVerificationFailed
+	}
 
-		// Path matches. Authenticate
-		authHandler := authenticationSuccessHandler{false}
-		openid.Authenticate(h.Configuration, &authHandler).ServeHTTP(w, r)
-		if !authHandler.Authenticated {
-			// The success handler was not called, so it failed.
-			// We return 0 to indicate that the response has already been written.
-			return 0, errors.New("Token verification failed")
+	var exchanged string
+	if source == "session" {
+		err = h.Login.checkCSRF(r, rule.CSRF)
+	}
+	if err == nil {
+		err = h.authorize(r, rule, u)
+	}
+	if err == nil && hasToken(source) && rule.HMAC == "" {
+		exchanged, err = h.Exchange.exchange(bearerToken(r), u)
+	}
+	h.record(r, source, u, err)
+	if err != nil {
+		if aerr, ok := err.(*authorizationError); ok {
+			if aerr.StepUp != nil && source == "session" && (r.Method == http.MethodGet || r.Method == http.MethodHead) &&
+				!isWebSocketUpgrade(r) {
+				// Send the browser back to the provider to authenticate
+				// as the path requires.
+				return h.Login.redirect(w, r, r.URL.RequestURI(), aerr.StepUp)
+			}
+			h.onAuthorizationFailed(aerr, w, r)
+			return 0, err
+		}
+		return http.StatusInternalServerError, err
+	}
+	if h.DenyList != nil && h.DenyList.AdminPath != "" && r.URL.Path == h.DenyList.AdminPath {
+		return h.DenyList.ServeAdmin(w, r)
+	}
+	u = mapClaims(u, h.ClaimMappings)
+	setClaimHeaders(r, u, h.ClaimHeaders)
+	h.HeaderSigner.sign(r, time.Now())
+	if err := h.InternalToken.set(r, u); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	r = setPlaceholders(r, u)
+	if rule.Revalidate > 0 && hasToken(source) {
+		var cancel context.CancelFunc
+		r, cancel = h.watchConnection(r, rule.Revalidate, u, bearerToken(r))
+		defer cancel()
+	}
+	if source == "session" {
+		h.Login.setCSRFCookie(w, r, rule.CSRF)
+	}
+	forwardToken(r, h.TokenSources, h.StripToken, exchanged)
+	return h.Next.ServeHTTP(w, r)
+}
+
+// hasToken reports whether the request was authenticated by a token, and
+// not by the session cookie or an API key.
+func hasToken(source string) bool {
+	return source != "session" && source != tokenSourceAPIKey
+}
+
+// forwardToken removes the token of the client from the request if it
+// must not reach the backend, and passes on the exchanged token instead if
+// there is one.
+func forwardToken(r *http.Request, sources []tokenSource, strip bool, exchanged string) {
+	if strip || exchanged != "" {
+		stripToken(r, sources)
+	}
+	if exchanged != "" {
+		r.Header.Set("Authorization", "Bearer "+exchanged)
+	}
+}
+
+// record updates the metrics and the audit log with the outcome of
+// authenticating and authorizing a request.
+func (h auth) record(r *http.Request, source string, u *openid.User, err error) {
+	observeAuthentication(source, u, err)
+	h.Limiter.record(r, u, err)
+	decision := decisionAllow
+	if err != nil {
+		decision = decisionDeny
+	}
+	if h.Debug {
+		if err != nil {
+			h.debugf(r, "decision %s: %v, %s", decision, err, userSummary(u))
+		} else {
+			h.debugf(r, "decision %s, %s", decision, userSummary(u))
 		}
-		// Authenticated so call next middleware
+	}
+	h.AuditLog.Log(r, source, u, decision, err)
+}
+
+// serveIntrospected validates an opaque token at the introspection endpoints
+// of the providers. The first provider that reports the token as active
+// wins.
+func (h auth) serveIntrospected(w http.ResponseWriter, r *http.Request, rule *pathRule, source string, token string) (int, error) {
+	u, err := h.introspect(r, token)
+	if err == nil {
+		return h.serveAuthenticated(w, r, rule, source, u)
+	}
+	h.record(r, source, nil, err)
+	if h.FailOpen && providerUnavailable(err) {
 		return h.Next.ServeHTTP(w, r)
 	}
+	h.onAuthenticateFailed(err, w, r)
+	return 0, errVerificationFailed
+}
+
+// validate validates the token with the validator of the path.
+func (h auth) validate(r *http.Request, rule *pathRule, token string) (*openid.User, error) {
+	span := startSpan(r, "openidauth.validate_token")
+	start := time.Now()
+	var u *openid.User
+	var err error
+	if c, ok := h.validatorFor(rule).(*cachingValidator); ok && c.Bind != "" {
+		u, err = c.ValidateFrom(token, clientFingerprint(r))
+	} else {
+		u, err = h.validatorFor(rule).Validate(token)
+	}
+	observeValidation(time.Since(start), err)
+	if u != nil {
+		span.SetAttributes(attribute.String("openidauth.issuer", u.Issuer))
+	}
+	endSpan(span, err)
+	if err != nil {
+		h.debugf(r, "token rejected: %v", err)
+	}
+	return u, err
+}
+
+// introspect asks the providers about an opaque token.
+func (h auth) introspect(r *http.Request, token string) (*openid.User, error) {
+	span := startSpan(r, "openidauth.introspect")
+	start := time.Now()
+	var err error
+	for _, i := range h.Introspectors {
+		var u *openid.User
+		u, err = i.Introspect(token)
+		if err == nil {
+			observeValidation(time.Since(start), nil)
+			span.SetAttributes(attribute.String("openidauth.issuer", u.Issuer))
+			endSpan(span, nil)
+			return u, nil
+		}
+	}
+	observeValidation(time.Since(start), err)
+	endSpan(span, err)
+	return nil, err
+}
 
-	// pass request if no paths protected with JWT or the code above falls through
+// serveOptional handles a path where authentication is optional. Users with
+// a valid session or token get the claim headers and placeholders as usual.
+// Everyone else, including those whose token is invalid or who don't meet
+// the requirements, is passed on anonymously.
+func (h auth) serveOptional(w http.ResponseWriter, r *http.Request, rule *pathRule, source string, token string, found bool) (int, error) {
+	var u *openid.User
+	if h.Login != nil {
+		if sess := h.Login.Session(w, r); sess != nil && h.Login.checkCSRF(r, rule.CSRF) == nil {
+			u, source = sess.User, "session"
+		}
+	}
+	if u == nil && found {
+		if rule.HMAC == "" && len(h.Introspectors) > 0 && !looksLikeJWT(token) {
+			u, _ = h.introspect(r, token)
+		} else {
+			u, _ = h.validate(r, rule, token)
+		}
+	}
+
+	if u != nil && source != "session" &&
+		(h.DPoP.verify(r, bearerToken(r), u) != nil || checkCertificateBinding(r, u, rule.CertBound) != nil) {
+		u = nil
+	}
+	authenticated := u != nil && h.Tenants.check(r, u) == nil && rule.checkIssuer(u) == nil &&
+		h.DenyList.Denied(u, bearerToken(r)) == nil && h.authorize(r, rule, u) == nil
+	var exchanged string
+	if authenticated && source != "session" && rule.HMAC == "" {
+		var err error
+		exchanged, err = h.Exchange.exchange(bearerToken(r), u)
+		authenticated = err == nil
+	}
+	if authenticated {
+		h.record(r, source, u, nil)
+		if source == "session" {
+			h.Login.setCSRFCookie(w, r, rule.CSRF)
+		}
+		u = mapClaims(u, h.ClaimMappings)
+		setClaimHeaders(r, u, h.ClaimHeaders)
+		h.HeaderSigner.sign(r, time.Now())
+		// Without the identity token the backend sees an anonymous request.
+		h.InternalToken.set(r, u)
+		r = setPlaceholders(r, u)
+	} else {
+		// Don't let the backend mistake an invalid token for a valid one.
+		r.Header.Del("Authorization")
+	}
+	forwardToken(r, h.TokenSources, h.StripToken, exchanged)
 	return h.Next.ServeHTTP(w, r)
 }
+
+// bearerToken returns the token in the Authorization header, where the
+// token found in the request has been put.
+func bearerToken(r *http.Request) string {
+	v := r.Header.Get("Authorization")
+	if i := strings.IndexByte(v, ' '); i > 0 {
+		return v[i+1:]
+	}
+	return v
+}
+
+// validatorFor returns the validator for the tokens of a path.
+func (h auth) validatorFor(rule *pathRule) validator {
+	if rule.HMAC != "" {
+		return h.HMACValidators[rule.HMAC]
+	}
+	return h.Validator
+}
@@ -0,0 +1,133 @@
+package openidauth
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newBenchMiddleware creates the middleware protecting /api/ with tokens of
+// a provider whose key is read from a file, and returns it with a valid
+// token of the provider.
+func newBenchMiddleware(tb testing.TB, configure func(*Config)) (*Middleware, string) {
+	rsaKey, _, _ := generateKeys(tb)
+	der, err := x509.MarshalPKIXPublicKey(rsaKey.Public())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "openidauth")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { os.RemoveAll(dir) })
+	file := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		tb.Fatal(err)
+	}
+
+	matcher, err := newPathMatcher("/api/")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	cfg := &Config{
+		Providers: []providerConfig{{Issuer: "https://issuer.example.com", ClientIds: []string{"api"}, PublicKeyFiles: []string{file}}},
+		Paths:     []*pathRule{{Path: matcher}},
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+	next := HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		return http.StatusOK, nil
+	})
+	m, err := New(cfg, next)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	token := signJWT(tb, "RS256", "", rsaKey, map[string]interface{}{
+		"iss": "https://issuer.example.com",
+		"aud": "api",
+		"sub": "user",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	return m, token
+}
+
+// benchmarkRequest serves the request over and over and fails if the
+// middleware does not respond with the status.
+func benchmarkRequest(b *testing.B, m *Middleware, r *http.Request, status int) {
+	w := &discardWriter{header: make(http.Header)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if code, _ := m.ServeHTTP(w, r); code != status {
+			b.Fatalf("got status %d, want %d", code, status)
+		}
+	}
+}
+
+// TestServeHTTPUnprotectedAllocs checks that requests for paths that are
+// not protected pass the middleware without allocating.
+func TestServeHTTPUnprotectedAllocs(t *testing.T) {
+	m, _ := newBenchMiddleware(t, nil)
+	r := httptest.NewRequest("GET", "/static/app.js", nil)
+	r.Header.Set(requestIDHeader, "bench")
+	w := &discardWriter{header: make(http.Header)}
+	allocs := testing.AllocsPerRun(100, func() {
+		if code, _ := m.ServeHTTP(w, r); code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", code, http.StatusOK)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("got %v allocations per request, want 0", allocs)
+	}
+}
+
+func BenchmarkServeHTTP(b *testing.B) {
+	b.Run("unprotected", func(b *testing.B) {
+		m, _ := newBenchMiddleware(b, nil)
+		r := httptest.NewRequest("GET", "/static/app.js", nil)
+		r.Header.Set(requestIDHeader, "bench")
+		benchmarkRequest(b, m, r, http.StatusOK)
+	})
+	b.Run("unprotected_400_paths", func(b *testing.B) {
+		m, _ := newBenchMiddleware(b, func(cfg *Config) {
+			for i := 0; i < 400; i++ {
+				matcher, err := newPathMatcher(fmt.Sprintf("/service%d/v*/", i))
+				if err != nil {
+					b.Fatal(err)
+				}
+				cfg.Paths = append(cfg.Paths, &pathRule{Path: matcher})
+			}
+		})
+		r := httptest.NewRequest("GET", "/service400/v1/items", nil)
+		r.Header.Set(requestIDHeader, "bench")
+		benchmarkRequest(b, m, r, http.StatusOK)
+	})
+	b.Run("missing_token", func(b *testing.B) {
+		m, _ := newBenchMiddleware(b, nil)
+		r := httptest.NewRequest("GET", "/api/items", nil)
+		r.Header.Set(requestIDHeader, "bench")
+		benchmarkRequest(b, m, r, 0)
+	})
+	b.Run("valid_token", func(b *testing.B) {
+		m, token := newBenchMiddleware(b, nil)
+		r := httptest.NewRequest("GET", "/api/items", nil)
+		r.Header.Set(requestIDHeader, "bench")
+		r.Header.Set("Authorization", "Bearer "+token)
+		benchmarkRequest(b, m, r, http.StatusOK)
+	})
+	b.Run("valid_token_cached", func(b *testing.B) {
+		m, token := newBenchMiddleware(b, func(cfg *Config) { cfg.ValidationCacheTTL = time.Minute })
+		r := httptest.NewRequest("GET", "/api/items", nil)
+		r.Header.Set(requestIDHeader, "bench")
+		r.Header.Set("Authorization", "Bearer "+token)
+		benchmarkRequest(b, m, r, http.StatusOK)
+	})
+}
@@ -0,0 +1,37 @@
+package openidauth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/emanoelxavier/openid2go/openid"
+)
+
+// checkCertificateBinding verifies that a token bound to a client
+// certificate with the cnf.x5t#S256 claim is presented over a mutual TLS
+// connection with that certificate, see RFC 8705. With required the token
+// must be bound. Caddy must terminate TLS and ask for client certificates.
+func checkCertificateBinding(r *http.Request, u *openid.User, required bool) error {
+	var thumbprint string
+	if cnf, ok := u.Claims["cnf"].(map[string]interface{}); ok {
+		thumbprint, _ = cnf["x5t#S256"].(string)
+	}
+	if thumbprint == "" {
+		if required {
+			return validationError(openid.ValidationErrorJwtValidationFailure, http.StatusUnauthorized,
+				"The token must be bound to a client certificate", nil)
+		}
+		return nil
+	}
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return validationError(openid.ValidationErrorJwtValidationFailure, http.StatusUnauthorized,
+			"The token is bound to a client certificate, but none was presented", nil)
+	}
+	sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != thumbprint {
+		return validationError(openid.ValidationErrorJwtValidationFailure, http.StatusUnauthorized,
+			"The token is bound to another client certificate", nil)
+	}
+	return nil
+}
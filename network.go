@@ -0,0 +1,58 @@
+package openidauth
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedNetworks changes how requests from the networks are treated on
+// protected paths. They skip the token validation, or with RequireBoth,
+// requests must come from the networks and have a valid token. The client
+// address is the remote address of the connection, headers like
+// X-Forwarded-For are not trusted.
+type trustedNetworks struct {
+	Networks    []*net.IPNet
+	RequireBoth bool
+}
+
+// parseCIDRs parses networks in CIDR notation. Single addresses are
+// accepted as networks of one address.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, value := range cidrs {
+		cidr := value
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("openidauth: invalid network %q in bypass_cidr", value)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// contains reports whether the request comes from one of the networks.
+func (t *trustedNetworks) contains(r *http.Request) bool {
+	host := r.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range t.Networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
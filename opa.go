@@ -0,0 +1,90 @@
+package openidauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/emanoelxavier/openid2go/openid"
+)
+
+const defaultOPATimeout = 5 * time.Second
+
+// opaAuthorizer asks Open Policy Agent whether a request is allowed. URL is
+// the data API endpoint of the decision, like
+// http://localhost:8181/v1/data/httpapi/authz. The decision is either a
+// boolean or an object with an allow member and an optional reason.
+type opaAuthorizer struct {
+	URL    string
+	Client *http.Client
+}
+
+func newOPAAuthorizer(url string, timeout time.Duration) *opaAuthorizer {
+	if timeout <= 0 {
+		timeout = defaultOPATimeout
+	}
+	return &opaAuthorizer{URL: url, Client: &http.Client{Timeout: timeout}}
+}
+
+// authorize returns an authorizationError if OPA denies the request, or if
+// it can't be asked.
+func (o *opaAuthorizer) authorize(r *http.Request, u *openid.User) error {
+	allowed, reason, err := o.decide(newAuthzInput(r, u))
+	if err != nil {
+		return &authorizationError{
+			Code:        "temporarily_unavailable",
+			Description: "The authorization service is unavailable",
+			Unavailable: true,
+		}
+	}
+	if !allowed {
+		if reason == "" {
+			reason = "The request is not allowed by the authorization policy"
+		}
+		return &authorizationError{Description: reason}
+	}
+	return nil
+}
+
+// decide queries the decision for the input.
+func (o *opaAuthorizer) decide(input *authzInput) (bool, string, error) {
+	body, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return false, "", err
+	}
+	resp, err := o.Client.Post(o.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return false, "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, "", fmt.Errorf("openidauth: OPA returned %s", resp.Status)
+	}
+
+	var result struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return false, "", err
+	}
+	// An undefined decision has no result and denies the request.
+	var allowed bool
+	if json.Unmarshal(result.Result, &allowed) == nil {
+		return allowed, "", nil
+	}
+	var decision struct {
+		Allow  bool   `json:"allow"`
+		Reason string `json:"reason"`
+	}
+	if json.Unmarshal(result.Result, &decision) == nil {
+		return decision.Allow, decision.Reason, nil
+	}
+	return false, "", nil
+}
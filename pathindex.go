@@ -0,0 +1,162 @@
+package openidauth
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// pathIndex finds the first of a list of path patterns that matches a
+// request path without trying every pattern. The literal beginnings of the
+// patterns, the prefix itself or the part of a glob before the first
+// wildcard, are kept in a radix tree. Only the patterns whose beginning is
+// a prefix of the path are tried, and regular expressions, which can match
+// anywhere, are always tried. The time to find the patterns depends on the
+// length of the path, not on the number of patterns.
+type pathIndex struct {
+	root radixNode
+	fold bool
+}
+
+// radixNode is a node of the radix tree. The prefix is the part of the key
+// that leads from the parent to the node, and patterns are the indexes of
+// the patterns whose key ends at the node, in ascending order.
+type radixNode struct {
+	prefix   string
+	patterns []int
+	children []*radixNode
+}
+
+// newPathIndex indexes the patterns. Caddy compares prefixes in lower case
+// if its paths are not case-sensitive, the keys are then lower case too.
+func newPathIndex(patterns []pathMatcher) *pathIndex {
+	x := &pathIndex{fold: !CaseSensitivePath}
+	for i, m := range patterns {
+		for _, key := range indexKeys(m.Pattern) {
+			if x.fold {
+				key = strings.ToLower(key)
+			}
+			x.root.insert(key, i)
+		}
+	}
+	return x
+}
+
+// indexKeys returns the keys of a pattern: the literal text every path it
+// matches starts with. Caddy compares the cleaned paths with cleaned
+// prefixes, so prefixes are also indexed in their cleaned form.
+func indexKeys(pattern string) []string {
+	switch {
+	case strings.HasPrefix(pattern, "~"):
+		return []string{""}
+	case strings.ContainsAny(pattern, "*?"):
+		return []string{pattern[:strings.IndexAny(pattern, "*?")]}
+	case pattern == "" || pattern == "/":
+		// Caddy matches every path with the root.
+		return []string{""}
+	}
+	if clean := cleanPath(pattern); clean != pattern {
+		return []string{pattern, clean}
+	}
+	return []string{pattern}
+}
+
+// cleanPath cleans a path like Caddy does before comparing it with a
+// prefix, keeping the trailing slash.
+func cleanPath(p string) string {
+	clean := path.Clean(p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		if clean == p[:len(p)-1] {
+			return p
+		}
+		clean += "/"
+	}
+	return clean
+}
+
+// lookup calls try with the indexes of the patterns that may match the
+// path, and returns the smallest index for which it returns true, or -1 if
+// there is none. try checks that the pattern really matches, and anything
+// else the caller requires, like the method of the request.
+func (x *pathIndex) lookup(p string, try func(int) bool) int {
+	if x.fold {
+		p = strings.ToLower(p)
+	}
+	best := -1
+	x.root.search(p, try, &best)
+	if clean := cleanPath(p); clean != p {
+		x.root.search(clean, try, &best)
+	}
+	return best
+}
+
+// insert adds the index of a pattern with the key below the node.
+func (n *radixNode) insert(key string, i int) {
+	for key != "" {
+		child := n.child(key[0])
+		if child == nil {
+			n.add(&radixNode{prefix: key, patterns: []int{i}})
+			return
+		}
+		common := 0
+		for common < len(key) && common < len(child.prefix) && key[common] == child.prefix[common] {
+			common++
+		}
+		if common < len(child.prefix) {
+			// Split the edge where the keys part.
+			split := &radixNode{prefix: child.prefix[:common], children: []*radixNode{child}}
+			n.children[n.childIndex(key[0])] = split
+			child.prefix = child.prefix[common:]
+			child = split
+		}
+		n, key = child, key[common:]
+	}
+	if len(n.patterns) == 0 || n.patterns[len(n.patterns)-1] != i {
+		n.patterns = append(n.patterns, i)
+	}
+}
+
+// search tries the patterns of the nodes along the key, and lowers best to
+// the smallest index try accepts.
+func (n *radixNode) search(key string, try func(int) bool, best *int) {
+	for {
+		for _, i := range n.patterns {
+			if *best >= 0 && i >= *best {
+				break
+			}
+			if try(i) {
+				*best = i
+				break
+			}
+		}
+		if key == "" {
+			return
+		}
+		if n = n.child(key[0]); n == nil || !strings.HasPrefix(key, n.prefix) {
+			return
+		}
+		key = key[len(n.prefix):]
+	}
+}
+
+// childIndex returns the position of the child whose prefix starts with c,
+// or where it would be inserted. The children are sorted by that byte.
+func (n *radixNode) childIndex(c byte) int {
+	return sort.Search(len(n.children), func(i int) bool { return n.children[i].prefix[0] >= c })
+}
+
+// child returns the child whose prefix starts with c, or nil.
+func (n *radixNode) child(c byte) *radixNode {
+	if i := n.childIndex(c); i < len(n.children) && n.children[i].prefix[0] == c {
+		return n.children[i]
+	}
+	return nil
+}
+
+// add inserts a new child, keeping the children sorted.
+func (n *radixNode) add(child *radixNode) {
+	i := n.childIndex(child.prefix[0])
+	n.children = append(n.children, nil)
+	copy(n.children[i+1:], n.children[i:])
+	n.children[i] = child
+}
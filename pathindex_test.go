@@ -0,0 +1,55 @@
+package openidauth
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// TestPathIndex compares the index with trying the patterns in order, for
+// random prefixes, globs and regular expressions.
+func TestPathIndex(t *testing.T) {
+	parts := []string{"/", "a", "b", "A", "..", ".", "*", "**", "?", "//", "ab", "x/"}
+	random := func(rng *rand.Rand, n int) string {
+		s := ""
+		for i := 0; i < n; i++ {
+			s += parts[rng.Intn(len(parts))]
+		}
+		return s
+	}
+	defer func(sensitive bool) { CaseSensitivePath = sensitive }(CaseSensitivePath)
+	for _, sensitive := range []bool{true, false} {
+		CaseSensitivePath = sensitive
+		rng := rand.New(rand.NewSource(1))
+		for round := 0; round < 1000; round++ {
+			var patterns []pathMatcher
+			for n := 1 + rng.Intn(12); len(patterns) < n; {
+				pattern := "/" + random(rng, rng.Intn(5))
+				switch rng.Intn(20) {
+				case 0:
+					pattern = "~^/a+" + random(rng, 1)
+				case 1:
+					pattern = "~b"
+				case 2:
+					pattern = ""
+				}
+				if m, err := newPathMatcher(pattern); err == nil {
+					patterns = append(patterns, m)
+				}
+			}
+			x := newPathIndex(patterns)
+			for i := 0; i < 50; i++ {
+				path := "/" + random(rng, rng.Intn(6))
+				want := -1
+				for j, m := range patterns {
+					if m.Matches(path) {
+						want = j
+						break
+					}
+				}
+				if got := x.lookup(path, func(j int) bool { return patterns[j].Matches(path) }); got != want {
+					t.Fatalf("case-sensitive %v, patterns %v: %q matched %d, want %d", sensitive, patterns, path, got, want)
+				}
+			}
+		}
+	}
+}
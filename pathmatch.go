@@ -0,0 +1,127 @@
+package openidauth
+
+import (
+	"encoding/json"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// CaseSensitivePath makes prefixes match request paths case-sensitively.
+// Like in Caddy they don't by default, the caddy1 package sets it to the
+// setting of Caddy v1.
+var CaseSensitivePath = false
+
+// pathMatcher matches request paths against a configured pattern. There are
+// three kinds of patterns:
+//
+//	/api/             prefix, like the rest of Caddy
+//	/api/v*/private/**  glob, * matches within a segment and ** across segments
+//	~^/api/v[0-9]+/   regular expression, when prefixed with ~
+//
+// Globs and regular expressions are matched against the cleaned path, the
+// same one prefixes are compared with, so that /api/v1//private/x or
+// /api/v1/./private/x can't get around /api/v*/private/**. They ignore case
+// unless CaseSensitivePath is set.
+type pathMatcher struct {
+	Pattern string
+	re      *regexp.Regexp
+	fold    *regexp.Regexp
+}
+
+func newPathMatcher(pattern string) (pathMatcher, error) {
+	m := pathMatcher{Pattern: pattern}
+	var expr string
+	switch {
+	case strings.HasPrefix(pattern, "~"):
+		expr = pattern[1:]
+	case strings.ContainsAny(pattern, "*?"):
+		expr = globToRegexp(pattern)
+	default:
+		return m, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return m, err
+	}
+	m.re = re
+	m.fold = regexp.MustCompile("(?i)" + expr)
+	return m, nil
+}
+
+// Matches reports whether the request path matches the pattern.
+func (m pathMatcher) Matches(path string) bool {
+	if m.re == nil {
+		return hasPathPrefix(path, m.Pattern)
+	}
+	if CaseSensitivePath {
+		return m.re.MatchString(cleanPath(path))
+	}
+	return m.fold.MatchString(cleanPath(path))
+}
+
+// hasPathPrefix reports whether the path starts with the prefix, after both
+// have been cleaned keeping their trailing slash, the way Caddy matches
+// paths.
+func hasPathPrefix(p, prefix string) bool {
+	if prefix == "" || prefix == "/" {
+		return true
+	}
+	clean := func(s string) string {
+		if strings.HasSuffix(s, "/") {
+			return path.Clean(s) + "/"
+		}
+		return path.Clean(s)
+	}
+	p, prefix = clean(p), clean(prefix)
+	if CaseSensitivePath {
+		return strings.HasPrefix(p, prefix)
+	}
+	return strings.HasPrefix(strings.ToLower(p), strings.ToLower(prefix))
+}
+
+func (m pathMatcher) String() string {
+	return m.Pattern
+}
+
+// MarshalJSON encodes the matcher as its pattern.
+func (m pathMatcher) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.Pattern)
+}
+
+// UnmarshalJSON decodes a pattern and compiles it.
+func (m *pathMatcher) UnmarshalJSON(b []byte) error {
+	var pattern string
+	if err := json.Unmarshal(b, &pattern); err != nil {
+		return err
+	}
+	matcher, err := newPathMatcher(pattern)
+	if err != nil {
+		return err
+	}
+	*m = matcher
+	return nil
+}
+
+// globToRegexp converts a glob pattern to an anchored regular expression.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
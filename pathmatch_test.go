@@ -0,0 +1,46 @@
+package openidauth
+
+import "testing"
+
+// TestPathMatcherCleansPath checks that globs and regular expressions can't
+// be bypassed with paths that Caddy cleans before serving them.
+func TestPathMatcherCleansPath(t *testing.T) {
+	defer func(sensitive bool) { CaseSensitivePath = sensitive }(CaseSensitivePath)
+	tests := []struct {
+		pattern   string
+		path      string
+		sensitive bool
+		want      bool
+	}{
+		{pattern: "/api/v*/private/**", path: "/api/v1/private/x", want: true},
+		{pattern: "/api/v*/private/**", path: "/api/v1//private/x", want: true},
+		{pattern: "/api/v*/private/**", path: "/api/v1/./private/x", want: true},
+		{pattern: "/api/v*/private/**", path: "/api/v1/public/../private/x", want: true},
+		{pattern: "/api/v*/private/**", path: "/API/v1/private/x", want: true},
+		{pattern: "/api/v*/private/**", path: "/API/v1/private/x", sensitive: true, want: false},
+		{pattern: "/api/v*/private/**", path: "/api/v1/public/x", want: false},
+		{pattern: "~^/api/v[0-9]+/private/", path: "/api/v1//private/x", want: true},
+		{pattern: "~^/api/v[0-9]+/private/", path: "/api/v1/./private/x", want: true},
+		{pattern: "~^/api/v[0-9]+/private/", path: "/Api/V1/Private/x", want: true},
+		{pattern: "~^/api/v[0-9]+/private/", path: "/Api/V1/Private/x", sensitive: true, want: false},
+	}
+	for _, tt := range tests {
+		CaseSensitivePath = tt.sensitive
+		m, err := newPathMatcher(tt.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m.Matches(tt.path); got != tt.want {
+			t.Errorf("%s, case-sensitive %v: %q matched %v, want %v", tt.pattern, tt.sensitive, tt.path, got, tt.want)
+		}
+		patterns := []pathMatcher{m}
+		want := -1
+		if tt.want {
+			want = 0
+		}
+		x := newPathIndex(patterns)
+		if got := x.lookup(tt.path, func(i int) bool { return patterns[i].Matches(tt.path) }); got != want {
+			t.Errorf("%s, case-sensitive %v: index found %d for %q, want %d", tt.pattern, tt.sensitive, got, tt.path, want)
+		}
+	}
+}
@@ -0,0 +1,422 @@
+package openidauth
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/emanoelxavier/openid2go/openid"
+)
+
+// policy is a boolean expression over the claims of the token and the
+// request, like
+//
+//	claims.email endswith "@example.com" && "admin" in claims.groups
+//
+// Values are claims (claims.name, nested objects with claims.a.b), request
+// attributes (request.method, request.path, request.host and
+// request.header.Name), strings, numbers, true, false and null. Words that
+// are none of these are strings, so the quotes the Caddyfile removes are not
+// needed. The operators are ==, !=, <, <=, >, >=, in, contains, startswith,
+// endswith, matches (a regular expression), !, && and ||, with parentheses
+// for grouping. A value on its own is true unless it is missing, false, null,
+// empty or 0.
+type policy struct {
+	Name string
+	Expr string
+	root policyNode
+}
+
+// newPolicy parses an expression.
+func newPolicy(name, expr string) (*policy, error) {
+	tokens, err := lexPolicy(expr)
+	if err != nil {
+		return nil, fmt.Errorf("openidauth: policy %s: %v", name, err)
+	}
+	p := &policyParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("openidauth: policy %s: %v", name, err)
+	}
+	return &policy{Name: name, Expr: expr, root: root}, nil
+}
+
+// joinPolicyArgs turns the arguments of a Caddyfile directive back into an
+// expression. Arguments with spaces were quoted in the Caddyfile and are
+// quoted again.
+func joinPolicyArgs(args []string) string {
+	parts := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\"") {
+			arg = strconv.Quote(arg)
+		}
+		parts[i] = arg
+	}
+	return strings.Join(parts, " ")
+}
+
+// Allows reports whether the user may make the request.
+func (p *policy) Allows(r *http.Request, u *openid.User) bool {
+	return truthy(p.root.eval(&policyEnv{r: r, u: u}))
+}
+
+// authorize returns an authorizationError if the policy denies the request.
+func (p *policy) authorize(r *http.Request, u *openid.User) error {
+	if p.Allows(r, u) {
+		return nil
+	}
+	return &authorizationError{Description: fmt.Sprintf("The request is not allowed by the policy %s", p.Name)}
+}
+
+type policyEnv struct {
+	r *http.Request
+	u *openid.User
+}
+
+type policyNode interface {
+	eval(env *policyEnv) interface{}
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n literalNode) eval(env *policyEnv) interface{} {
+	return n.value
+}
+
+// claimNode is a claim, or a member of an object claim.
+type claimNode struct {
+	path []string
+}
+
+func (n claimNode) eval(env *policyEnv) interface{} {
+	var v interface{} = env.u.Claims
+	for _, name := range n.path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[name]
+	}
+	return v
+}
+
+// requestNode is an attribute of the request.
+type requestNode struct {
+	attr   string
+	header string
+}
+
+func (n requestNode) eval(env *policyEnv) interface{} {
+	switch n.attr {
+	case "method":
+		return env.r.Method
+	case "path":
+		return env.r.URL.Path
+	case "host":
+		return env.r.Host
+	case "header":
+		return env.r.Header.Get(n.header)
+	}
+	return nil
+}
+
+type notNode struct {
+	x policyNode
+}
+
+func (n notNode) eval(env *policyEnv) interface{} {
+	return !truthy(n.x.eval(env))
+}
+
+type logicalNode struct {
+	and  bool
+	x, y policyNode
+}
+
+func (n logicalNode) eval(env *policyEnv) interface{} {
+	if n.and {
+		return truthy(n.x.eval(env)) && truthy(n.y.eval(env))
+	}
+	return truthy(n.x.eval(env)) || truthy(n.y.eval(env))
+}
+
+type compareNode struct {
+	op   string
+	x, y policyNode
+	re   *regexp.Regexp
+}
+
+func (n compareNode) eval(env *policyEnv) interface{} {
+	x, y := n.x.eval(env), n.y.eval(env)
+	switch n.op {
+	case "==":
+		return equal(x, y)
+	case "!=":
+		return !equal(x, y)
+	case "in":
+		return contains(y, x)
+	case "contains":
+		return contains(x, y)
+	case "startswith":
+		return x != nil && strings.HasPrefix(claimString(x), claimString(y))
+	case "endswith":
+		return x != nil && strings.HasSuffix(claimString(x), claimString(y))
+	case "matches":
+		re := n.re
+		if re == nil {
+			var err error
+			if re, err = regexp.Compile(claimString(y)); err != nil {
+				return false
+			}
+		}
+		return x != nil && re.MatchString(claimString(x))
+	}
+	a, aok := number(x)
+	b, bok := number(y)
+	if !aok || !bok {
+		return false
+	}
+	switch n.op {
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+	return false
+}
+
+// equal compares values. Numbers in strings are compared as numbers and
+// other values by their string form, so that words in the expression match
+// claims of other types.
+func equal(x, y interface{}) bool {
+	if x == nil || y == nil {
+		return x == nil && y == nil
+	}
+	if a, ok := number(x); ok {
+		if b, ok := number(y); ok {
+			return a == b
+		}
+	}
+	return claimString(x) == claimString(y)
+}
+
+// contains reports whether the list has the element, or the string has the
+// substring.
+func contains(list, elem interface{}) bool {
+	switch l := list.(type) {
+	case []interface{}:
+		for _, v := range l {
+			if equal(v, elem) {
+				return true
+			}
+		}
+		return false
+	case string:
+		return elem != nil && strings.Contains(l, claimString(elem))
+	}
+	return false
+}
+
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func truthy(v interface{}) bool {
+	switch t := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return t
+	case string:
+		return t != ""
+	case float64:
+		return t != 0
+	case []interface{}:
+		return len(t) > 0
+	case map[string]interface{}:
+		return len(t) > 0
+	}
+	return true
+}
+
+type policyToken struct {
+	text   string
+	quoted bool
+}
+
+// lexPolicy splits an expression into tokens.
+func lexPolicy(expr string) ([]policyToken, error) {
+	var tokens []policyToken
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"':
+			end := i + 1
+			for ; end < len(expr) && expr[end] != '"'; end++ {
+				if expr[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(expr) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			s, err := strconv.Unquote(expr[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string %s", expr[i:end+1])
+			}
+			tokens = append(tokens, policyToken{text: s, quoted: true})
+			i = end + 1
+		case strings.HasPrefix(expr[i:], "&&"), strings.HasPrefix(expr[i:], "||"),
+			strings.HasPrefix(expr[i:], "=="), strings.HasPrefix(expr[i:], "!="),
+			strings.HasPrefix(expr[i:], "<="), strings.HasPrefix(expr[i:], ">="):
+			tokens = append(tokens, policyToken{text: expr[i : i+2]})
+			i += 2
+		case strings.IndexByte("()!<>", c) >= 0:
+			tokens = append(tokens, policyToken{text: expr[i : i+1]})
+			i++
+		default:
+			end := i
+			for end < len(expr) && !strings.ContainsRune(" \t\n\r\"()!<>&|=", rune(expr[end])) {
+				end++
+			}
+			if end == i {
+				return nil, fmt.Errorf("unexpected %q", expr[i:i+1])
+			}
+			tokens = append(tokens, policyToken{text: expr[i:end]})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+var policyOperators = map[string]bool{
+	"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true,
+	"in": true, "contains": true, "startswith": true, "endswith": true, "matches": true,
+}
+
+type policyParser struct {
+	tokens []policyToken
+	pos    int
+}
+
+func (p *policyParser) peek() string {
+	if p.pos < len(p.tokens) && !p.tokens[p.pos].quoted {
+		return p.tokens[p.pos].text
+	}
+	return ""
+}
+
+func (p *policyParser) parseOr() (policyNode, error) {
+	x, err := p.parseAnd()
+	for err == nil && p.peek() == "||" {
+		p.pos++
+		var y policyNode
+		if y, err = p.parseAnd(); err == nil {
+			x = logicalNode{x: x, y: y}
+		}
+	}
+	return x, err
+}
+
+func (p *policyParser) parseAnd() (policyNode, error) {
+	x, err := p.parseUnary()
+	for err == nil && p.peek() == "&&" {
+		p.pos++
+		var y policyNode
+		if y, err = p.parseUnary(); err == nil {
+			x = logicalNode{and: true, x: x, y: y}
+		}
+	}
+	return x, err
+}
+
+func (p *policyParser) parseUnary() (policyNode, error) {
+	if p.peek() == "!" {
+		p.pos++
+		x, err := p.parseUnary()
+		return notNode{x: x}, err
+	}
+	x, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	op := p.peek()
+	if !policyOperators[op] {
+		return x, nil
+	}
+	p.pos++
+	y, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	n := compareNode{op: op, x: x, y: y}
+	if lit, ok := y.(literalNode); ok && op == "matches" {
+		if n.re, err = regexp.Compile(claimString(lit.value)); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func (p *policyParser) parsePrimary() (policyNode, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	if t.quoted {
+		return literalNode{value: t.text}, nil
+	}
+	switch {
+	case t.text == "(":
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return x, nil
+	case t.text == "true":
+		return literalNode{value: true}, nil
+	case t.text == "false":
+		return literalNode{value: false}, nil
+	case t.text == "null":
+		return literalNode{value: nil}, nil
+	case strings.HasPrefix(t.text, "claims."):
+		return claimNode{path: strings.Split(strings.TrimPrefix(t.text, "claims."), ".")}, nil
+	case strings.HasPrefix(t.text, "request.header."):
+		return requestNode{attr: "header", header: strings.TrimPrefix(t.text, "request.header.")}, nil
+	case t.text == "request.method", t.text == "request.path", t.text == "request.host":
+		return requestNode{attr: strings.TrimPrefix(t.text, "request.")}, nil
+	case strings.HasPrefix(t.text, "request."):
+		return nil, fmt.Errorf("unknown request attribute %q", t.text)
+	case t.text == ")" || policyOperators[t.text] || t.text == "&&" || t.text == "||" || t.text == "!":
+		return nil, fmt.Errorf("unexpected %q", t.text)
+	}
+	if f, err := strconv.ParseFloat(t.text, 64); err == nil {
+		return literalNode{value: f}, nil
+	}
+	return literalNode{value: t.text}, nil
+}
@@ -0,0 +1,159 @@
+package openidauth
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/emanoelxavier/openid2go/openid"
+)
+
+// At most this many clients and users have their failures remembered.
+const maxFailureEntries = 100000
+
+// failureLimiter bans clients and users with too many failed
+// authentications, so guessing tokens can't make the middleware validate
+// tokens and fetch keys without limit. A client IP, or a user whose token
+// is valid but whose DPoP proofs keep failing, is banned for Ban after Max
+// failures within Window. IPv6 clients are counted by their /64, which
+// they can change addresses within. The failures are counted by each Caddy
+// instance.
+type failureLimiter struct {
+	Max    int
+	Window time.Duration
+	Ban    time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*failureEntry
+}
+
+type failureEntry struct {
+	Failures    int
+	WindowStart time.Time
+	BannedUntil time.Time
+}
+
+func newFailureLimiter(max int, window, ban time.Duration) *failureLimiter {
+	if ban == 0 {
+		ban = window
+	}
+	return &failureLimiter{Max: max, Window: window, Ban: ban, entries: make(map[string]*failureEntry)}
+}
+
+// limiterKeys returns the keys the failures of a request are counted by.
+func limiterKeys(r *http.Request, u *openid.User) []string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if addr := net.ParseIP(ip); addr != nil && addr.To4() == nil {
+		ip = addr.Mask(net.CIDRMask(64, 128)).String() + "/64"
+	}
+	keys := []string{"ip:" + ip}
+	if u != nil {
+		keys = append(keys, "sub:"+u.Issuer+" "+u.ID)
+	}
+	return keys
+}
+
+// retryAfter returns how long the client or user is still banned, or 0.
+func (l *failureLimiter) retryAfter(r *http.Request, u *openid.User) time.Duration {
+	if l == nil {
+		return 0
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var wait time.Duration
+	for _, key := range limiterKeys(r, u) {
+		if e, ok := l.entries[key]; ok && now.Before(e.BannedUntil) && e.BannedUntil.Sub(now) > wait {
+			wait = e.BannedUntil.Sub(now)
+		}
+	}
+	return wait
+}
+
+// record counts the failure of a request, if it is one.
+func (l *failureLimiter) record(r *http.Request, u *openid.User, err error) {
+	if l == nil || !countsAsFailure(err) {
+		return
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range limiterKeys(r, u) {
+		e, ok := l.entries[key]
+		if !ok {
+			if len(l.entries) >= maxFailureEntries {
+				l.expire(now)
+			}
+			if len(l.entries) >= maxFailureEntries {
+				// Every entry is a ban, which must not be lifted to
+				// make room.
+				continue
+			}
+			e = &failureEntry{WindowStart: now}
+			l.entries[key] = e
+		}
+		if now.Sub(e.WindowStart) > l.Window {
+			e.Failures, e.WindowStart = 0, now
+		}
+		e.Failures++
+		if e.Failures >= l.Max {
+			e.BannedUntil = now.Add(l.Ban)
+			e.Failures, e.WindowStart = 0, now
+		}
+	}
+}
+
+// expire forgets the entries that no longer matter, and if that doesn't
+// make room, counted failures that haven't led to a ban. Active bans are
+// never forgotten, or a client could lift its ban by failing from enough
+// other addresses.
+func (l *failureLimiter) expire(now time.Time) {
+	for key, e := range l.entries {
+		if now.Sub(e.WindowStart) > l.Window && !now.Before(e.BannedUntil) {
+			delete(l.entries, key)
+		}
+	}
+	for key, e := range l.entries {
+		if len(l.entries) < maxFailureEntries {
+			return
+		}
+		if !now.Before(e.BannedUntil) {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// countsAsFailure reports whether the error is a failed authentication the
+// client is responsible for: a token, DPoP proof or credentials that are
+// invalid. Requests without credentials and providers that are unavailable
+// don't count, and neither do authenticated requests that are denied, by
+// the rules, a policy or a missing CSRF token.
+func countsAsFailure(err error) bool {
+	if err == nil || providerUnavailable(err) {
+		return false
+	}
+	switch e := err.(type) {
+	case *openid.ValidationError:
+		return e.Code != openid.ValidationErrorAuthorizationHeaderNotFound
+	case *dpopError:
+		return true
+	}
+	return false
+}
+
+// errTooManyFailures is returned for requests of banned clients and users.
+var errTooManyFailures = errors.New("Too many failed authentication attempts")
+
+// tooManyFailures answers the request of a banned client or user.
+func (h auth) tooManyFailures(w http.ResponseWriter, r *http.Request, wait time.Duration) (int, error) {
+	w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+	status := h.Errors.Status(errorRateLimited, http.StatusTooManyRequests)
+	h.Errors.Write(w, r, status, "", errTooManyFailures.Error())
+	return 0, errTooManyFailures
+}
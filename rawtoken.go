@@ -0,0 +1,79 @@
+package openidauth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/emanoelxavier/openid2go/openid"
+)
+
+// RawToken is a token found in a request, decoded as far as that is possible
+// without keys but not validated. Nothing in it can be trusted.
+type RawToken struct {
+	// Value is the token as it was sent.
+	Value string
+	// Scheme is the scheme of the Authorization header, Bearer or DPoP.
+	Scheme string
+	// Header is the JOSE header of a signed or encrypted JWT, nil for
+	// opaque tokens.
+	Header map[string]interface{}
+	// Claims are the claims of a signed JWT. The claims of an encrypted
+	// JWT can only be read after it has been decrypted.
+	Claims map[string]interface{}
+	// Encrypted is set for encrypted JWTs.
+	Encrypted bool
+}
+
+// ParseBearer extracts the token from the Authorization header of the
+// request and decodes it like the middleware does before validating it. It
+// fails for requests without a Bearer or DPoP token, for tokens larger than
+// the default max_token_size, and for JWTs that can't be decoded.
+func ParseBearer(r *http.Request) (RawToken, error) {
+	source := tokenSource{Kind: tokenSourceHeader}
+	value := source.token(r)
+	if value == "" {
+		return RawToken{}, validationError(openid.ValidationErrorAuthorizationHeaderNotFound, http.StatusUnauthorized,
+			"No bearer token in the Authorization header", nil)
+	}
+	return parseRawToken(value, authorizationScheme(r), source, defaultMaxTokenSize)
+}
+
+// parseRawToken checks the shape of a token and decodes it if it is a JWT.
+// ServeHTTP runs every token it extracts through it before validation.
+func parseRawToken(value, scheme string, source tokenSource, max int) (RawToken, error) {
+	if err := checkTokenShape(value, source, max); err != nil {
+		return RawToken{}, err
+	}
+	t := RawToken{Value: value, Scheme: scheme}
+	switch strings.Count(value, ".") {
+	case 2:
+		jwt, err := parseJWT(value)
+		if err != nil {
+			return RawToken{}, validationError(openid.ValidationErrorJwtValidationFailure, http.StatusUnauthorized,
+				"The token is malformed", err)
+		}
+		t.Header, t.Claims = decodeSegment(strings.SplitN(value, ".", 2)[0]), jwt.Claims
+	case 4:
+		t.Header, t.Encrypted = decodeSegment(strings.SplitN(value, ".", 2)[0]), true
+		if t.Header == nil {
+			return RawToken{}, validationError(openid.ValidationErrorJwtValidationFailure, http.StatusUnauthorized,
+				"The token is malformed", malformedJWTError("malformed JWE header"))
+		}
+	}
+	return t, nil
+}
+
+// decodeSegment decodes a base64url encoded JSON object, or returns nil.
+func decodeSegment(segment string) map[string]interface{} {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return nil
+	}
+	var v map[string]interface{}
+	if json.Unmarshal(b, &v) != nil {
+		return nil
+	}
+	return v
+}
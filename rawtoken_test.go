@@ -0,0 +1,104 @@
+package openidauth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// encodeSegment encodes a JWT segment.
+func encodeSegment(s string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+// FuzzParseBearer feeds arbitrary Authorization headers to ParseBearer,
+// which must never panic and must only decode what it accepts.
+//
+//	go test -run '^$' -fuzz FuzzParseBearer
+func FuzzParseBearer(f *testing.F) {
+	jwt := encodeSegment(`{"alg":"RS256","kid":"1"}`) + "." + encodeSegment(`{"sub":"a","exp":1}`) + ".c2ln"
+	for _, seed := range []string{
+		"",
+		"Bearer ",
+		"Bearer opaque-token",
+		"DPoP " + jwt,
+		"Bearer " + jwt,
+		"Bearer " + encodeSegment(`{"alg":"RSA-OAEP","enc":"A256GCM"}`) + ".a.b.c.d",
+		"Bearer " + encodeSegment(`{"alg":"RS256"}`) + "." + encodeSegment(`[1,2]`) + ".",
+		"Bearer " + encodeSegment(`null`) + "." + encodeSegment(`null`) + ".",
+		"Bearer ....",
+		"Bearer ......",
+		"Bearer %%%.%%%.%%%",
+		"Basic dXNlcjpwYXNz",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, header string) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", header)
+		tok, err := ParseBearer(r)
+		if err != nil {
+			return
+		}
+		if tok.Value == "" || len(tok.Value) > defaultMaxTokenSize {
+			t.Fatalf("accepted token %q", tok.Value)
+		}
+		switch strings.Count(tok.Value, ".") {
+		case 2:
+			if tok.Claims == nil {
+				t.Fatalf("signed JWT %q accepted without claims", tok.Value)
+			}
+		case 4:
+			if !tok.Encrypted || tok.Header == nil {
+				t.Fatalf("encrypted JWT %q accepted without header", tok.Value)
+			}
+		default:
+			if tok.Header != nil || tok.Claims != nil {
+				t.Fatalf("opaque token %q decoded", tok.Value)
+			}
+		}
+	})
+}
+
+// FuzzVerifyProof runs tokens through the steps a DPoP proof goes through
+// before its claims are checked: decoding, reading the key from the header
+// and verifying the signature with it. None of them may panic.
+//
+//	go test -run '^$' -fuzz FuzzVerifyProof
+func FuzzVerifyProof(f *testing.F) {
+	for _, jwk := range []string{
+		`{"kty":"RSA","n":"","e":""}`,
+		`{"kty":"RSA","n":"AQAB","e":"AQ"}`,
+		`{"kty":"EC","crv":"P-256","x":"AA","y":"AA"}`,
+		`{"kty":"OKP","crv":"Ed25519","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}`,
+	} {
+		for _, alg := range []string{"RS256", "PS384", "ES256", "EdDSA", "HS256", "none"} {
+			header := `{"typ":"dpop+jwt","alg":"` + alg + `","jwk":` + jwk + `}`
+			f.Add(encodeSegment(header) + "." + encodeSegment(`{"htm":"GET"}`) + "." + encodeSegment("signature"))
+		}
+	}
+	f.Fuzz(func(t *testing.T, token string) {
+		if checkJWTSize(token) != nil {
+			return
+		}
+		jwt, err := parseJWT(token)
+		if err != nil {
+			return
+		}
+		var header dpopProofHeader
+		raw, _ := base64.RawURLEncoding.DecodeString(strings.SplitN(token, ".", 2)[0])
+		if json.Unmarshal(raw, &header) != nil || header.JWK == nil {
+			return
+		}
+		key, err := header.JWK.publicKey()
+		if err != nil || key == nil {
+			return
+		}
+		header.JWK.thumbprint()
+		if isSupportedAlg(header.Alg) {
+			verifySignature(header.Alg, key, jwt.SigningInput, jwt.Signature)
+		}
+	})
+}
@@ -0,0 +1,77 @@
+package openidauth
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/emanoelxavier/openid2go/openid"
+)
+
+// ClaimValidator checks the claims of a validated token for a request. A
+// non-nil error denies the request with 403 Forbidden, the error text is
+// the description of the failure.
+type ClaimValidator func(claims map[string]interface{}, r *http.Request) error
+
+var (
+	validatorsMu sync.RWMutex
+	validators   = make(map[string]ClaimValidator)
+)
+
+// RegisterValidator makes a claim validator available under name, so that
+// custom builds can add their own checks. It is meant to be called from the
+// init function of the package that provides the validator. A site uses it
+// with the validate directive:
+//
+//	validate tenant-license
+//
+// RegisterValidator panics if name is empty or already registered.
+func RegisterValidator(name string, v ClaimValidator) {
+	validatorsMu.Lock()
+	defer validatorsMu.Unlock()
+	if name == "" {
+		panic("openidauth: claim validator must have a name")
+	}
+	if v == nil {
+		panic("openidauth: claim validator " + name + " is nil")
+	}
+	if _, dup := validators[name]; dup {
+		panic("openidauth: claim validator " + name + " is already registered")
+	}
+	validators[name] = v
+}
+
+// registeredValidator returns the claim validator registered as name.
+func registeredValidator(name string) (ClaimValidator, bool) {
+	validatorsMu.RLock()
+	defer validatorsMu.RUnlock()
+	v, ok := validators[name]
+	return v, ok
+}
+
+// ValidatorNames returns the names of the registered claim validators.
+func ValidatorNames() []string {
+	validatorsMu.RLock()
+	defer validatorsMu.RUnlock()
+	names := make([]string, 0, len(validators))
+	for name := range validators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// namedValidator is a registered claim validator used by a site.
+type namedValidator struct {
+	Name string
+	Func ClaimValidator
+}
+
+// authorize runs the validator, turning its error into an
+// authorizationError.
+func (v namedValidator) authorize(r *http.Request, u *openid.User) error {
+	if err := v.Func(u.Claims, r); err != nil {
+		return &authorizationError{Description: err.Error()}
+	}
+	return nil
+}
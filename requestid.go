@@ -0,0 +1,37 @@
+package openidauth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+)
+
+// requestIDHeader carries the id that correlates a request with its entries
+// in the audit log and the logs of the backend. It is in canonical form, so
+// that looking it up doesn't allocate.
+const requestIDHeader = "X-Request-Id"
+
+// validRequestID restricts the ids accepted from clients, so they can't be
+// used to forge log entries.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// setRequestID makes sure the request has an id. The id sent by the client
+// or a proxy in front of Caddy is kept, otherwise a random one is created.
+// The id is passed on to the backend and sent back in the response.
+func setRequestID(w http.ResponseWriter, r *http.Request) {
+	ids := r.Header[requestIDHeader]
+	if len(ids) == 0 || !validRequestID.MatchString(ids[0]) {
+		b := make([]byte, 16)
+		rand.Read(b)
+		ids = []string{hex.EncodeToString(b)}
+		r.Header[requestIDHeader] = ids
+	}
+	// The response shares the value with the request, neither changes it.
+	w.Header()[requestIDHeader] = ids[:1:1]
+}
+
+// requestID returns the id of the request.
+func requestID(r *http.Request) string {
+	return r.Header.Get(requestIDHeader)
+}
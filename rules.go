@@ -0,0 +1,414 @@
+package openidauth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/emanoelxavier/openid2go/openid"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// pathRule is a protected path and the authorization requirements for it.
+// Without Methods the rule applies to all request methods.
+// Tokens are validated with the named shared secret if HMAC is set, and
+// against the OpenID providers otherwise.
+// Optional paths let requests without a valid token through anonymously.
+// Policy is the name of a policy the request must also satisfy.
+// With Issuers only the tokens of those providers are accepted.
+// ACR, AMR and MaxAuthAge require a strong or recent authentication of the
+// user, see authContext.
+// CertBound paths only accept tokens bound to the client certificate of the
+// request.
+// The connections of paths with Revalidate are closed when the token
+// expires or is revoked, for streaming responses.
+// APIKeys are the names of the static API keys accepted instead of tokens.
+// Clients are the names of the certificate clients that get a token from
+// the middleware if they have none.
+// OnFailure chooses how failures are answered: redirect sends browsers
+// without credentials to the login, status answers with the status in the
+// configured error format, json always with JSON and page:<file> always with
+// the page. Auto, the default with the login, redirects browsers and
+// answers API clients with JSON, see isBrowser.
+// Challenge replaces the Bearer scheme of the WWW-Authenticate challenges,
+// none leaves them out of the responses.
+// CSRF protects the unsafe requests authenticated by the session cookie
+// with a custom header or a double submitted cookie, see checkCSRF.
+type pathRule struct {
+	Path     pathMatcher `json:"path"`
+	Methods  []string    `json:"methods,omitempty"`
+	Scopes   []string    `json:"scopes,omitempty"`
+	HMAC     string      `json:"hmac,omitempty"`
+	Optional bool        `json:"optional,omitempty"`
+	Policy   string      `json:"policy,omitempty"`
+	Issuers  []string    `json:"issuers,omitempty"`
+	ACR      []string    `json:"acr,omitempty"`
+	AMR      []string    `json:"amr,omitempty"`
+
+	MaxAuthAge time.Duration `json:"max_auth_age,omitempty"`
+	CertBound  bool          `json:"cert_bound,omitempty"`
+	Revalidate time.Duration `json:"revalidate,omitempty"`
+	APIKeys    []string      `json:"api_keys,omitempty"`
+	Clients    []string      `json:"client_credentials,omitempty"`
+	OnFailure  string        `json:"on_failure,omitempty"`
+	Challenge  string        `json:"challenge,omitempty"`
+	CSRF       string        `json:"csrf,omitempty"`
+
+	// The issuers with their aliases and the responders of the failures,
+	// filled in by newAuth.
+	accepted     []string
+	responder    *errorResponder
+	apiResponder *errorResponder
+}
+
+// parsePathRule parses the arguments of a path directive:
+//
+//	path /admin/ scope=admin:read,admin:write
+//	path /api/v*/private/** scope=private
+//	path /docs/ methods=POST,PUT,DELETE
+//	path /internal/ hmac=internal
+//	path /blog/ mode=optional
+//	path /manage/ policy=admins
+//	path /api/partner/ issuer=https://partners.example.com
+//	path /admin/ acr=phr,phrh amr=mfa
+//	path /payments/confirm max_auth_age=5m
+//	path /payments/ binding=mtls
+//	path /events/ revalidate=1m
+//	path /deploy/ api_keys=ci-runner,deployer
+//	path /billing/ client_credentials=billing
+//	path /api/ on_failure=json
+//	path /app/ on_failure=auto
+//	path /mobile/ challenge=none
+//	path /app/ csrf=double_submit
+//	path /downloads/ on_failure=page:/etc/caddy/downloads.html
+func parsePathRule(c Dispenser) (*pathRule, error) {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return nil, c.ArgErr()
+	}
+	matcher, err := newPathMatcher(args[0])
+	if err != nil {
+		return nil, c.Errf("openidauth: invalid path %q: %v", args[0], err)
+	}
+	rule := &pathRule{Path: matcher}
+	for _, arg := range args[1:] {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, c.Errf("openidauth: expected option=value, got %q", arg)
+		}
+		switch kv[0] {
+		case "methods":
+			for _, m := range strings.Split(kv[1], ",") {
+				rule.Methods = append(rule.Methods, strings.ToUpper(m))
+			}
+		case "hmac":
+			rule.HMAC = kv[1]
+		case "scope":
+			rule.Scopes = append(rule.Scopes, strings.Split(kv[1], ",")...)
+		case "policy":
+			rule.Policy = kv[1]
+		case "issuer":
+			rule.Issuers = append(rule.Issuers, kv[1])
+		case "acr":
+			rule.ACR = append(rule.ACR, strings.Split(kv[1], ",")...)
+		case "amr":
+			rule.AMR = append(rule.AMR, strings.Split(kv[1], ",")...)
+		case "max_auth_age":
+			age, err := time.ParseDuration(kv[1])
+			if err != nil || age < time.Second {
+				return nil, c.Errf("openidauth: invalid max_auth_age %q", kv[1])
+			}
+			rule.MaxAuthAge = age
+		case "revalidate":
+			interval, err := time.ParseDuration(kv[1])
+			if err != nil || interval < time.Second {
+				return nil, c.Errf("openidauth: invalid revalidate interval %q", kv[1])
+			}
+			rule.Revalidate = interval
+		case "api_keys":
+			rule.APIKeys = append(rule.APIKeys, strings.Split(kv[1], ",")...)
+		case "client_credentials":
+			rule.Clients = append(rule.Clients, strings.Split(kv[1], ",")...)
+		case "on_failure":
+			if kv[1] != failureAuto && kv[1] != failureRedirect && kv[1] != failureStatus && kv[1] != failureJSON &&
+				(!strings.HasPrefix(kv[1], failurePage) || kv[1] == failurePage) {
+				return nil, c.Errf("openidauth: unknown failure mode %q", kv[1])
+			}
+			rule.OnFailure = kv[1]
+		case "challenge":
+			if !isToken(kv[1]) {
+				return nil, c.Errf("openidauth: invalid challenge scheme %q", kv[1])
+			}
+			rule.Challenge = kv[1]
+		case "csrf":
+			if kv[1] != csrfHeader && kv[1] != csrfDoubleSubmit {
+				return nil, c.Errf("openidauth: unknown csrf protection %q", kv[1])
+			}
+			rule.CSRF = kv[1]
+		case "binding":
+			if kv[1] != "mtls" {
+				return nil, c.Errf("openidauth: unknown token binding %q", kv[1])
+			}
+			rule.CertBound = true
+		case "mode":
+			switch kv[1] {
+			case "required":
+				rule.Optional = false
+			case "optional":
+				rule.Optional = true
+			default:
+				return nil, c.Errf("openidauth: unknown path mode %q", kv[1])
+			}
+		default:
+			return nil, c.Errf("openidauth: unknown path option %q", kv[0])
+		}
+	}
+	return rule, nil
+}
+
+// matches reports whether the rule applies to the request.
+func (rule *pathRule) matches(r *http.Request) bool {
+	if !rule.Path.Matches(r.URL.Path) {
+		return false
+	}
+	if len(rule.Methods) == 0 {
+		return true
+	}
+	for _, m := range rule.Methods {
+		if m == r.Method {
+			return true
+		}
+	}
+	return false
+}
+
+// redirects reports whether the request is sent to the login if it has no
+// credentials.
+func (rule *pathRule) redirects(r *http.Request) bool {
+	return rule.OnFailure == failureRedirect || rule.OnFailure == failureAuto && isBrowser(r)
+}
+
+// errors returns the responder of the failures of the request.
+func (rule *pathRule) errors(r *http.Request) *errorResponder {
+	if rule.OnFailure == failureAuto && !isBrowser(r) {
+		return rule.apiResponder
+	}
+	return rule.responder
+}
+
+// checkIssuer returns an error if the user was authenticated by a provider
+// the rule does not accept.
+func (rule *pathRule) checkIssuer(u *openid.User) error {
+	if len(rule.accepted) == 0 {
+		return nil
+	}
+	for _, iss := range rule.accepted {
+		if issuerMatches(iss, u.Issuer) {
+			return nil
+		}
+	}
+	return validationError(openid.ValidationErrorInvalidIssuer, http.StatusUnauthorized,
+		fmt.Sprintf("The token issuer %s is not trusted for this path", u.Issuer), nil)
+}
+
+// claimRequirement requires the claim to have one of the values. For array
+// claims like groups it is enough that one element matches.
+type claimRequirement struct {
+	Claim  string   `json:"claim"`
+	Values []string `json:"values"`
+}
+
+// parseClaimRequirement parses the arguments of a require_claim directive:
+//
+//	require_claim groups sysadmins admins
+func parseClaimRequirement(c Dispenser) (claimRequirement, error) {
+	args := c.RemainingArgs()
+	if len(args) < 2 {
+		return claimRequirement{}, c.ArgErr()
+	}
+	return claimRequirement{Claim: args[0], Values: args[1:]}, nil
+}
+
+// matches reports whether the user has the claim with one of the values.
+func (req claimRequirement) matches(u *openid.User) bool {
+	var values []interface{}
+	switch v := u.Claims[req.Claim].(type) {
+	case nil:
+		return false
+	case []interface{}:
+		values = v
+	default:
+		values = []interface{}{v}
+	}
+	for _, v := range values {
+		s := claimString(v)
+		for _, want := range req.Values {
+			if s == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authorizeClaims checks that the user fulfils all the claim requirements.
+func authorizeClaims(reqs []claimRequirement, u *openid.User) error {
+	for _, req := range reqs {
+		if !req.matches(u) {
+			return &authorizationError{
+				Description: fmt.Sprintf("The token claim %s does not have any of the required values", req.Claim),
+			}
+		}
+	}
+	return nil
+}
+
+// authorizeHostedDomain checks that the user is an account of one of the
+// Google Workspace domains in the hd claim, if any are required. Only
+// Workspace accounts have the claim, the email address is not enough as
+// any Google account can have an address of any domain.
+func authorizeHostedDomain(domains []string, u *openid.User) error {
+	if len(domains) == 0 {
+		return nil
+	}
+	hd, _ := u.Claims["hd"].(string)
+	for _, d := range domains {
+		if hd != "" && strings.EqualFold(hd, d) {
+			return nil
+		}
+	}
+	return &authorizationError{Description: "The account is not a member of an allowed hosted domain"}
+}
+
+// authorizationError is returned when a valid token does not fulfil the
+// requirements of a path. Code is the RFC 6750 error code, if there is one
+// for the failure. Unavailable is set when the decision could not be made
+// because an external authorization service is down. StepUp is the
+// authentication the user needs to access the path.
+type authorizationError struct {
+	Code        string
+	Description string
+	Scope       string
+	Unavailable bool
+	StepUp      *authContext
+}
+
+func (e *authorizationError) Error() string {
+	return e.Description
+}
+
+// authContext returns the authentication the rule requires.
+func (rule *pathRule) authContext() *authContext {
+	return &authContext{ACR: rule.ACR, AMR: rule.AMR, MaxAge: rule.MaxAuthAge}
+}
+
+// authorize checks that the user fulfils the requirements of the rule.
+func (rule *pathRule) authorize(u *openid.User) error {
+	if err := rule.authContext().check(u); err != nil {
+		return err
+	}
+	if len(rule.Scopes) > 0 {
+		granted := tokenScopes(u)
+		for _, s := range rule.Scopes {
+			if !granted[s] {
+				return &authorizationError{
+					Code:        "insufficient_scope",
+					Description: fmt.Sprintf("The token is missing the scope %s", s),
+					Scope:       strings.Join(rule.Scopes, " "),
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// authorize checks that the user may make the request: the hosted domain,
+// the claim requirements, the require policies, the scopes and policy of the rule,
+// the registered claim validators, and finally OPA and the webhook.
+func (h auth) authorize(r *http.Request, rule *pathRule, u *openid.User) (err error) {
+	span := startSpan(r, "openidauth.authorize", attribute.String("enduser.id", u.ID))
+	defer func() { endSpan(span, err) }()
+
+	if err := authorizeHostedDomain(h.HostedDomains, u); err != nil {
+		return err
+	}
+	if err := authorizeClaims(h.RequiredClaims, u); err != nil {
+		return err
+	}
+	for _, p := range h.Require {
+		if err := p.authorize(r, u); err != nil {
+			return err
+		}
+	}
+	if err := rule.authorize(u); err != nil {
+		return err
+	}
+	if rule.Policy != "" {
+		if err := h.Policies[rule.Policy].authorize(r, u); err != nil {
+			return err
+		}
+	}
+	for _, v := range h.Validators {
+		if err := v.authorize(r, u); err != nil {
+			return err
+		}
+	}
+	if h.OPA != nil {
+		if err := h.OPA.authorize(r, u); err != nil {
+			return err
+		}
+	}
+	if h.Webhook != nil {
+		return h.Webhook.authorize(r, u)
+	}
+	return nil
+}
+
+// tokenScopes returns the scopes granted to the token. They are read from
+// the space separated scope claim, or the scp claim used by Azure AD and
+// Okta which can be either a string or an array.
+func tokenScopes(u *openid.User) map[string]bool {
+	scopes := make(map[string]bool)
+	for _, name := range []string{"scope", "scp"} {
+		switch v := u.Claims[name].(type) {
+		case string:
+			for _, s := range strings.Fields(v) {
+				scopes[s] = true
+			}
+		case []interface{}:
+			for _, s := range v {
+				if str, ok := s.(string); ok {
+					scopes[str] = true
+				}
+			}
+		}
+	}
+	return scopes
+}
+
+// onAuthorizationFailed writes the response for a valid token that is not
+// allowed to access the path.
+func (h auth) onAuthorizationFailed(e *authorizationError, rw http.ResponseWriter, r *http.Request) {
+	class, status := errorForbidden, http.StatusForbidden
+	switch {
+	case e.Unavailable:
+		class, status = errorUnavailable, http.StatusServiceUnavailable
+	case e.StepUp != nil:
+		class, status = errorStepUp, http.StatusUnauthorized
+	case e.Code == "insufficient_scope":
+		class = errorInsufficientScope
+	}
+	status = h.Errors.Status(class, status)
+	if e.Code != "" && (status == http.StatusForbidden || status == http.StatusUnauthorized) {
+		var params []authParam
+		if e.Scope != "" {
+			params = append(params, authParam{"scope", e.Scope})
+		}
+		if e.StepUp != nil {
+			params = append(params, e.StepUp.challengeParams()...)
+		}
+		h.Errors.Challenge(rw, e.Code, e.Description, params...)
+	}
+	h.Errors.Write(rw, r, status, e.Code, e.Description)
+}
@@ -0,0 +1,96 @@
+package openidauth
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// envPlaceholder is a secret given as the name of an environment variable.
+var envPlaceholder = regexp.MustCompile(`^\{env\.([A-Za-z_][A-Za-z0-9_]*)\}$`)
+
+// expandEnv returns the value of the environment variable if the value is
+// a {env.NAME} placeholder, and the value itself otherwise.
+func expandEnv(value string) (string, error) {
+	m := envPlaceholder.FindStringSubmatch(value)
+	if m == nil {
+		return value, nil
+	}
+	v := os.Getenv(m[1])
+	if v == "" {
+		return "", fmt.Errorf("environment variable %s is empty", m[1])
+	}
+	return v, nil
+}
+
+// secretFile reads a secret from a file, like the secrets mounted by Docker
+// or Kubernetes. Like the key files it is read again when it changes, so
+// rotated secrets are picked up without a reload. Surrounding whitespace is
+// ignored.
+type secretFile struct {
+	Path string
+
+	mu      sync.Mutex
+	checked time.Time
+	mtime   time.Time
+	value   string
+}
+
+// Value returns the secret. The last secret read is kept if the file
+// becomes unreadable.
+func (f *secretFile) Value() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	if f.value != "" && now.Sub(f.checked) < keyFileCheckInterval {
+		return f.value, nil
+	}
+	f.checked = now
+
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		if f.value != "" {
+			return f.value, nil
+		}
+		return "", err
+	}
+	if f.value != "" && info.ModTime().Equal(f.mtime) {
+		return f.value, nil
+	}
+	body, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		if f.value != "" {
+			return f.value, nil
+		}
+		return "", err
+	}
+	value := strings.TrimSpace(string(body))
+	if value == "" {
+		if f.value != "" {
+			return f.value, nil
+		}
+		return "", fmt.Errorf("%s is empty", f.Path)
+	}
+	f.mtime, f.value = info.ModTime(), value
+	return value, nil
+}
+
+// readSecret returns a secret given in the configuration, literally or as a
+// {env.NAME} placeholder, or read from the file. Only one of them can be
+// given. Unlike client_secret_file, the file is only read when the
+// configuration is loaded.
+func readSecret(value, file string) (string, error) {
+	if file == "" {
+		return expandEnv(value)
+	}
+	if value != "" {
+		return "", errors.New("both a secret and a secret file are given")
+	}
+	return (&secretFile{Path: file}).Value()
+}
@@ -0,0 +1,360 @@
+package openidauth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emanoelxavier/openid2go/openid"
+)
+
+// Browsers refuse cookies larger than about 4KB.
+const maxCookieSize = 4000
+
+// session is the state kept for a browser after a successful interactive
+// login.
+type session struct {
+	User         *openid.User `json:"user"`
+	IDToken      string       `json:"id_token,omitempty"`
+	RefreshToken string       `json:"refresh_token,omitempty"`
+	Created      time.Time    `json:"created"`
+	Expires      time.Time    `json:"expires"`
+
+	// When the session was last used, updated at most every
+	// sessionTouchInterval. Sessions from before idle timeouts don't have
+	// it and count as used when they were created.
+	LastSeen time.Time `json:"last_seen,omitempty"`
+
+	// The fingerprint of the client the session is bound to, if any.
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// How often the last use of a session is recorded, which is the precision of
+// the idle timeout. Recording every request would write the storage or send a
+// new cookie with each of them.
+const sessionTouchInterval = time.Minute
+
+// How long after it expired a session with a refresh token is kept so it
+// can be refreshed instead of sending the user to the provider again.
+const refreshWindow = 24 * time.Hour
+
+// Deadline returns when the session can no longer be used, not even to
+// refresh it.
+func (s *session) Deadline() time.Time {
+	if s.RefreshToken != "" {
+		return s.Expires.Add(refreshWindow)
+	}
+	return s.Expires
+}
+
+// lastSeen returns when the session was last used.
+func (s *session) lastSeen() time.Time {
+	if s.LastSeen.IsZero() {
+		return s.Created
+	}
+	return s.LastSeen
+}
+
+// sessionStore keeps the sessions of interactive logins. The value of the
+// session cookie identifies the session in the store.
+type sessionStore interface {
+	// Load returns the session for the cookie value, or nil if it does not
+	// exist or is past its deadline. Expired sessions that can still be
+	// refreshed are returned.
+	Load(value string) *session
+	// Save stores the session and returns the value for the cookie.
+	Save(sess *session) (string, error)
+	// Update stores a changed session under the cookie value and returns
+	// the value for the cookie, which may be the same.
+	Update(value string, sess *session) (string, error)
+	// Delete removes the session for the cookie value.
+	Delete(value string)
+}
+
+// serverSessionStore keeps sessions in the storage, keyed by a random id
+// that is the value of the session cookie. The sessions of every subject are
+// listed in the storage too. With a Limit a subject has at most that many
+// sessions, a new one ends the oldest.
+type serverSessionStore struct {
+	Storage storage
+	Limit   int
+}
+
+// subjectSession is an entry of the list of the sessions of a subject.
+type subjectSession struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+}
+
+// Load returns the session for id, or nil if it does not exist or is past its
+// deadline.
+func (s *serverSessionStore) Load(id string) *session {
+	value, err := s.Storage.Get("session:" + id)
+	if err != nil || value == nil {
+		return nil
+	}
+	sess := &session{}
+	if err := json.Unmarshal(value, sess); err != nil || sess.User == nil {
+		return nil
+	}
+	if time.Now().After(sess.Deadline()) {
+		return nil
+	}
+	return sess
+}
+
+// Save stores the session and returns the id to put in the session cookie.
+func (s *serverSessionStore) Save(sess *session) (string, error) {
+	id, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+	return s.Update(id, sess)
+}
+
+// Update stores the session under its id, which stays the same.
+func (s *serverSessionStore) Update(id string, sess *session) (string, error) {
+	value, err := json.Marshal(sess)
+	if err != nil {
+		return "", err
+	}
+	if err := s.Storage.Set("session:"+id, value, time.Until(sess.Deadline())); err != nil {
+		return "", err
+	}
+	if err := s.track(id, sess); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// List returns the sessions of the subject by id.
+func (s *serverSessionStore) List(iss, sub string) (map[string]*session, error) {
+	value, err := s.Storage.Get(subjectKey(iss, sub))
+	if err != nil {
+		return nil, err
+	}
+	var list []subjectSession
+	if value != nil {
+		json.Unmarshal(value, &list)
+	}
+	sessions := make(map[string]*session, len(list))
+	for _, e := range list {
+		if sess := s.Load(e.ID); sess != nil {
+			sessions[e.ID] = sess
+		}
+	}
+	return sessions, nil
+}
+
+// track adds the session to the list of the sessions of its subject and ends
+// the oldest ones beyond the limit. Sessions that ended otherwise are dropped
+// from the list. Logins of the subject at the same moment on several
+// instances may miss each other, the next update corrects that.
+func (s *serverSessionStore) track(id string, sess *session) error {
+	sessions, err := s.List(sess.User.Issuer, sess.User.ID)
+	if err != nil {
+		return err
+	}
+	active := []subjectSession{{ID: id, Created: sess.Created}}
+	for other, o := range sessions {
+		if other != id {
+			active = append(active, subjectSession{ID: other, Created: o.Created})
+		}
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].Created.After(active[j].Created) })
+	if s.Limit > 0 && len(active) > s.Limit {
+		for _, e := range active[s.Limit:] {
+			s.Delete(e.ID)
+		}
+		active = active[:s.Limit]
+	}
+
+	value, err := json.Marshal(active)
+	if err != nil {
+		return err
+	}
+	return s.Storage.Set(subjectKey(sess.User.Issuer, sess.User.ID), value, time.Until(sess.Deadline()))
+}
+
+// Delete removes the session with the given id.
+func (s *serverSessionStore) Delete(id string) {
+	s.Storage.Delete("session:" + id)
+}
+
+// subjectKey returns the key of the list of the sessions of a subject.
+func subjectKey(iss, sub string) string {
+	return "sessions:" + iss + " " + sub
+}
+
+// sessionHandle identifies a session in the admin API. The id itself is not
+// shown, it would let anyone who sees it take the session over.
+func sessionHandle(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+// sealer encrypts and authenticates values with AES-GCM, so they can be
+// handed to the browser and trusted when they come back. The purpose is
+// authenticated with every value, so that a value sealed for one purpose,
+// like a session cookie, can't be passed off as another, like a login
+// state, even though both are sealed with the same key.
+type sealer struct {
+	aead    cipher.AEAD
+	purpose []byte
+}
+
+// Purposes of sealed values.
+const (
+	sealSession    = "session"
+	sealLoginState = "login state"
+	sealBasicToken = "basic token"
+)
+
+func newSealer(key []byte, purpose string) (*sealer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead: aead, purpose: []byte(purpose)}, nil
+}
+
+// seal encrypts plaintext into a URL safe value. The random nonce comes
+// first, so values of the same plaintext differ from the first character.
+func (s *sealer) seal(plaintext []byte) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(s.aead.Seal(nonce, nonce, plaintext, s.purpose)), nil
+}
+
+// open decrypts a value made by seal. It returns nil if the value was not
+// sealed with the key for the same purpose or has been tampered with.
+func (s *sealer) open(value string) []byte {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(sealed) < s.aead.NonceSize() {
+		return nil
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	plaintext, err := s.aead.Open(nil, nonce, ciphertext, s.purpose)
+	if err != nil {
+		return nil
+	}
+	return plaintext
+}
+
+// cookieSessionStore keeps the whole session in the cookie, encrypted and
+// authenticated with AES-GCM. Nothing is stored on the server, so sessions
+// work across Caddy instances that share the key.
+type cookieSessionStore struct {
+	*sealer
+}
+
+func newCookieSessionStore(key []byte) (*cookieSessionStore, error) {
+	s, err := newSealer(key, sealSession)
+	if err != nil {
+		return nil, err
+	}
+	return &cookieSessionStore{sealer: s}, nil
+}
+
+// Load decrypts the session in the cookie value.
+func (s *cookieSessionStore) Load(value string) *session {
+	plaintext := s.open(value)
+	if plaintext == nil {
+		return nil
+	}
+
+	sess := &session{}
+	if err := json.Unmarshal(plaintext, sess); err != nil || sess.User == nil {
+		return nil
+	}
+	if time.Now().After(sess.Deadline()) {
+		return nil
+	}
+	return sess
+}
+
+// Save encrypts the session into the cookie value.
+func (s *cookieSessionStore) Save(sess *session) (string, error) {
+	plaintext, err := json.Marshal(sess)
+	if err != nil {
+		return "", err
+	}
+	value, err := s.seal(plaintext)
+	if err != nil {
+		return "", err
+	}
+	if len(value) > maxCookieSize {
+		return "", fmt.Errorf("openidauth: session of %d bytes does not fit in a cookie", len(value))
+	}
+	return value, nil
+}
+
+// Update encrypts the changed session into a new cookie value.
+func (s *cookieSessionStore) Update(value string, sess *session) (string, error) {
+	return s.Save(sess)
+}
+
+// Delete does nothing, the cookie is removed from the browser.
+func (s *cookieSessionStore) Delete(value string) {}
+
+// parseKey decodes a 16, 24 or 32 byte AES key given in hex or base64.
+func parseKey(s string) ([]byte, error) {
+	if key, err := hex.DecodeString(s); err == nil {
+		return checkKeySize(key)
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return checkKeySize(key)
+	}
+	if key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "=")); err == nil {
+		return checkKeySize(key)
+	}
+	return nil, errors.New("key must be hex or base64 encoded")
+}
+
+func checkKeySize(key []byte) ([]byte, error) {
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, fmt.Errorf("key must be 16, 24 or 32 bytes, not %d", len(key))
+}
+
+// parseSameSite converts the configured SameSite attribute.
+func parseSameSite(s string) (http.SameSite, error) {
+	switch strings.ToLower(s) {
+	case "", "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return 0, fmt.Errorf("unknown SameSite value %q", s)
+}
+
+// randomString returns n cryptographically random bytes encoded as URL safe
+// base64.
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,54 @@
+package openidauth
+
+import (
+	"net/http"
+)
+
+// Modes of the middleware.
+const (
+	modeEnforce = "enforce"
+	modeShadow  = "shadow"
+)
+
+// serveShadow handles a request in shadow mode: the middleware decides as
+// usual, and the decision is recorded in the metrics and the audit log, but
+// the request is always passed on. Allowed requests get the claim headers
+// like in enforce mode, the others are passed on as they came in. What the
+// middleware would have responded is discarded.
+func (h auth) serveShadow(w http.ResponseWriter, r *http.Request) (int, error) {
+	original := r.Clone(r.Context())
+	discarded := &discardWriter{header: make(http.Header)}
+	forwarded := false
+
+	enforcing := h
+	enforcing.Shadow = false
+	enforcing.Next = HandlerFunc(func(_ http.ResponseWriter, r *http.Request) (int, error) {
+		forwarded = true
+		// Keep the headers that are not part of a rejection, like
+		// refreshed session cookies.
+		for k, v := range discarded.header {
+			w.Header()[k] = v
+		}
+		return h.Next.ServeHTTP(w, r)
+	})
+	status, err := enforcing.ServeHTTP(discarded, r)
+	if forwarded {
+		return status, err
+	}
+	return h.Next.ServeHTTP(w, original)
+}
+
+// discardWriter swallows the response the middleware would have sent.
+type discardWriter struct {
+	header http.Header
+}
+
+func (d *discardWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (d *discardWriter) WriteHeader(int) {}
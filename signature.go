@@ -0,0 +1,95 @@
+package openidauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	_ "crypto/sha256" // register the hash functions used by the algorithms
+	_ "crypto/sha512"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// defaultAllowedAlgs are the algorithms accepted when allowed_algs is not
+// configured. none and the symmetric algorithms are never allowed by
+// default.
+var defaultAllowedAlgs = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}
+
+// supportedAlgs are all the algorithms tokens can be signed with. RSA-PSS
+// and EdDSA (Ed25519) must be enabled with allowed_algs or signing_algs.
+var supportedAlgs = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "PS256", "PS384", "PS512", "EdDSA"}
+
+// isSupportedAlg reports whether tokens signed with alg can be verified.
+func isSupportedAlg(alg string) bool {
+	for _, a := range supportedAlgs {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// hashes maps the JWS algorithm suffix to the hash function.
+var hashes = map[string]crypto.Hash{
+	"256": crypto.SHA256,
+	"384": crypto.SHA384,
+	"512": crypto.SHA512,
+}
+
+// verifySignature checks the JWS signature of the signing input with the
+// key, see RFC 7518 section 3 and RFC 8037 for EdDSA.
+func verifySignature(alg string, key crypto.PublicKey, signingInput string, sig []byte) error {
+	if alg == "EdDSA" {
+		k, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return errors.New("key is not an Ed25519 key")
+		}
+		if !ed25519.Verify(k, []byte(signingInput), sig) {
+			return errors.New("invalid EdDSA signature")
+		}
+		return nil
+	}
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	hash, ok := hashes[alg[2:]]
+	if !ok {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signingInput))
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key is not an RSA key")
+		}
+		return rsa.VerifyPKCS1v15(k, hash, digest, sig)
+	case "PS":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key is not an RSA key")
+		}
+		return rsa.VerifyPSS(k, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case "ES":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("key is not an EC key")
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid ECDSA signature size")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("invalid ECDSA signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %q", alg)
+}
@@ -0,0 +1,267 @@
+package openidauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// sign creates the JWS signature of the signing input with the private key.
+func sign(t testing.TB, alg string, key crypto.Signer, signingInput string) []byte {
+	t.Helper()
+	if alg == "EdDSA" {
+		return ed25519.Sign(key.(ed25519.PrivateKey), []byte(signingInput))
+	}
+	hash := hashes[alg[2:]]
+	h := hash.New()
+	h.Write([]byte(signingInput))
+	digest := h.Sum(nil)
+
+	var sig []byte
+	var err error
+	switch alg[:2] {
+	case "RS":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), hash, digest)
+	case "PS":
+		sig, err = rsa.SignPSS(rand.Reader, key.(*rsa.PrivateKey), hash, digest,
+			&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case "ES":
+		k := key.(*ecdsa.PrivateKey)
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest)
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+// signJWT creates a JWT with the claims signed with the private key.
+func signJWT(t testing.TB, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(jwtHeader{Alg: alg, Kid: kid, Typ: "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return input + "." + base64.RawURLEncoding.EncodeToString(sign(t, alg, key, input))
+}
+
+func generateKeys(t testing.TB) (rsaKey *rsa.PrivateKey, ecKeys map[string]*ecdsa.PrivateKey, edKey ed25519.PrivateKey) {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKeys = make(map[string]*ecdsa.PrivateKey)
+	for alg, curve := range map[string]elliptic.Curve{"ES256": elliptic.P256(), "ES384": elliptic.P384(), "ES512": elliptic.P521()} {
+		if ecKeys[alg], err = ecdsa.GenerateKey(curve, rand.Reader); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, edKey, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	return rsaKey, ecKeys, edKey
+}
+
+func TestVerifySignature(t *testing.T) {
+	rsaKey, ecKeys, edKey := generateKeys(t)
+	otherRSA, otherEC, otherEd := generateKeys(t)
+	keys := func(alg string, rsaKey *rsa.PrivateKey, ecKeys map[string]*ecdsa.PrivateKey, edKey ed25519.PrivateKey) crypto.Signer {
+		switch alg[:2] {
+		case "RS", "PS":
+			return rsaKey
+		case "ES":
+			return ecKeys[alg]
+		}
+		return edKey
+	}
+
+	const input = "eyJhbGciOiJub25lIn0.eyJzdWIiOiJ1c2VyIn0"
+	for _, alg := range supportedAlgs {
+		t.Run(alg, func(t *testing.T) {
+			key := keys(alg, rsaKey, ecKeys, edKey)
+			sig := sign(t, alg, key, input)
+			if err := verifySignature(alg, key.Public(), input, sig); err != nil {
+				t.Errorf("valid signature rejected: %v", err)
+			}
+			if err := verifySignature(alg, key.Public(), input+"x", sig); err == nil {
+				t.Error("signature of another input accepted")
+			}
+			other := keys(alg, otherRSA, otherEC, otherEd)
+			if err := verifySignature(alg, other.Public(), input, sig); err == nil {
+				t.Error("signature verified with another key")
+			}
+		})
+	}
+
+	// A key of another family never verifies a signature.
+	if err := verifySignature("EdDSA", rsaKey.Public(), input, sign(t, "EdDSA", edKey, input)); err == nil {
+		t.Error("EdDSA signature verified with an RSA key")
+	}
+	if err := verifySignature("PS256", edKey.Public(), input, sign(t, "PS256", rsaKey, input)); err == nil {
+		t.Error("PS256 signature verified with an Ed25519 key")
+	}
+	// RS256 and PS256 use the same keys but different paddings.
+	if err := verifySignature("RS256", rsaKey.Public(), input, sign(t, "PS256", rsaKey, input)); err == nil {
+		t.Error("PS256 signature accepted as RS256")
+	}
+	if err := verifySignature("HS256", rsaKey.Public(), input, nil); err == nil {
+		t.Error("unsupported algorithm accepted")
+	}
+}
+
+func TestParseJWKSEd25519(t *testing.T) {
+	_, _, edKey := generateKeys(t)
+	pub := edKey.Public().(ed25519.PublicKey)
+	body, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "OKP", "crv": "Ed25519", "kid": "ed", "x": base64.RawURLEncoding.EncodeToString(pub)},
+		},
+	})
+	keys, err := parseJWKS(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Kid != "ed" {
+		t.Fatalf("got keys %+v", keys)
+	}
+	if k, ok := keys[0].Key.(ed25519.PublicKey); !ok || !k.Equal(pub) {
+		t.Errorf("got key %#v, want %#v", keys[0].Key, pub)
+	}
+
+	body, _ = json.Marshal(map[string]interface{}{"keys": []map[string]string{{"kty": "OKP", "crv": "Ed25519", "x": "AAAA"}}})
+	if _, err := parseJWKS(body); err == nil {
+		t.Error("Ed25519 key of the wrong size accepted")
+	}
+
+	// Keys with curves that are not supported are skipped.
+	body, _ = json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "OKP", "crv": "X25519", "kid": "x", "x": base64.RawURLEncoding.EncodeToString(pub)},
+			{"kty": "OKP", "crv": "Ed448", "kid": "ed448", "x": base64.RawURLEncoding.EncodeToString(make([]byte, 57))},
+			{"kty": "EC", "crv": "secp256k1", "kid": "k", "x": "AQ", "y": "AQ"},
+			{"kty": "OKP", "crv": "Ed25519", "kid": "ed", "x": base64.RawURLEncoding.EncodeToString(pub)},
+		},
+	})
+	keys, err = parseJWKS(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Kid != "ed" {
+		t.Errorf("got keys %+v, want only ed", keys)
+	}
+}
+
+func TestParsePEMKeysEd25519(t *testing.T) {
+	_, _, edKey := generateKeys(t)
+	der, err := x509.MarshalPKIXPublicKey(edKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := parsePEMKeys(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := keys[0].Key.(ed25519.PublicKey); len(keys) != 1 || !ok {
+		t.Errorf("got keys %+v", keys)
+	}
+}
+
+func TestValidateSigningAlgs(t *testing.T) {
+	rsaKey, ecKeys, edKey := generateKeys(t)
+	dir, err := ioutil.TempDir("", "openidauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var files []string
+	for name, key := range map[string]crypto.PublicKey{"rsa": rsaKey.Public(), "ec": ecKeys["ES256"].Public(), "ed": edKey.Public()} {
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := filepath.Join(dir, name+".pem")
+		if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+
+	providers := []providerConfig{
+		{Issuer: "https://default.example.com", ClientIds: []string{"api"}, PublicKeyFiles: files},
+		{Issuer: "https://modern.example.com", ClientIds: []string{"api"}, PublicKeyFiles: files,
+			SigningAlgs: []string{"EdDSA", "PS256"}},
+	}
+	v := newTokenValidator(providers, 0, defaultAllowedAlgs, nil)
+
+	tests := []struct {
+		issuer string
+		alg    string
+		key    crypto.Signer
+		valid  bool
+	}{
+		{"https://default.example.com", "RS256", rsaKey, true},
+		{"https://default.example.com", "ES256", ecKeys["ES256"], true},
+		{"https://default.example.com", "PS256", rsaKey, false},
+		{"https://default.example.com", "EdDSA", edKey, false},
+		{"https://modern.example.com", "EdDSA", edKey, true},
+		{"https://modern.example.com", "PS256", rsaKey, true},
+		{"https://modern.example.com", "RS256", rsaKey, false},
+		{"https://modern.example.com", "ES256", ecKeys["ES256"], false},
+	}
+	for _, tt := range tests {
+		token := signJWT(t, tt.alg, "", tt.key, map[string]interface{}{
+			"iss": tt.issuer,
+			"aud": "api",
+			"sub": "user",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		})
+		u, err := v.Validate(token)
+		if tt.valid && (err != nil || u.ID != "user") {
+			t.Errorf("%s token of %s rejected: %v", tt.alg, tt.issuer, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%s token of %s accepted", tt.alg, tt.issuer)
+		}
+	}
+}
+
+func TestPrepareSigningAlgs(t *testing.T) {
+	matcher, err := newPathMatcher("/api/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := func(algs []string) *Config {
+		return &Config{
+			Providers: []providerConfig{{Issuer: "https://issuer.example.com", ClientIds: []string{"api"}, SigningAlgs: algs}},
+			Paths:     []*pathRule{{Path: matcher}},
+		}
+	}
+	for _, algs := range [][]string{{"EdDSA"}, {"PS256", "PS384", "PS512"}} {
+		if err := config(algs).prepare(); err != nil {
+			t.Errorf("signing_algs %v rejected: %v", algs, err)
+		}
+	}
+	for _, algs := range [][]string{{"none"}, {"HS256"}, {"Ed448"}} {
+		if err := config(algs).prepare(); err == nil {
+			t.Errorf("signing_algs %v accepted", algs)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package openidauth
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emanoelxavier/openid2go/openid"
+)
+
+// authContext is the strength of the authentication a path requires: the
+// user must have authenticated at one of the ACR levels (acr claim) and
+// with one of the AMR methods (amr claim), like mfa, no longer than MaxAge
+// ago (auth_time claim). A path that is not satisfied asks for step-up
+// authentication as in RFC 9470.
+type authContext struct {
+	ACR    []string      `json:"acr,omitempty"`
+	AMR    []string      `json:"amr,omitempty"`
+	MaxAge time.Duration `json:"max_age,omitempty"`
+}
+
+// empty reports whether nothing is required.
+func (c *authContext) empty() bool {
+	return c == nil || len(c.ACR) == 0 && len(c.AMR) == 0 && c.MaxAge == 0
+}
+
+// check returns an authorizationError asking for step-up authentication if
+// the user does not satisfy the requirements.
+func (c *authContext) check(u *openid.User) error {
+	if c.empty() {
+		return nil
+	}
+	if len(c.ACR) > 0 {
+		acr, _ := u.Claims["acr"].(string)
+		if !containsString(c.ACR, acr) {
+			return c.stepUp("The authentication level of the user is not sufficient")
+		}
+	}
+	if len(c.AMR) > 0 {
+		found := false
+		for _, method := range stringList(u.Claims["amr"]) {
+			found = found || containsString(c.AMR, method)
+		}
+		if !found {
+			return c.stepUp(fmt.Sprintf("The user must authenticate with %s", strings.Join(c.AMR, " or ")))
+		}
+	}
+	if c.MaxAge > 0 {
+		authTime := claimTime(u.Claims["auth_time"])
+		if authTime.IsZero() || time.Since(authTime) > c.MaxAge {
+			return c.stepUp("The user must authenticate again")
+		}
+	}
+	return nil
+}
+
+func (c *authContext) stepUp(description string) *authorizationError {
+	return &authorizationError{
+		Code:        "insufficient_user_authentication",
+		Description: description,
+		StepUp:      c,
+	}
+}
+
+// loginParams returns the parameters that ask the provider for the
+// required authentication. There is no standard parameter for AMR methods,
+// the provider is asked to authenticate the user again instead.
+func (c *authContext) loginParams() url.Values {
+	params := url.Values{}
+	if len(c.ACR) > 0 {
+		params.Set("acr_values", strings.Join(c.ACR, " "))
+	} else if len(c.AMR) > 0 {
+		params.Set("prompt", "login")
+	}
+	if c.MaxAge > 0 {
+		params.Set("max_age", strconv.Itoa(int(c.MaxAge/time.Second)))
+	}
+	return params
+}
+
+// challengeParams returns the RFC 9470 parameters of the WWW-Authenticate
+// challenge.
+func (c *authContext) challengeParams() []authParam {
+	var params []authParam
+	if len(c.ACR) > 0 {
+		params = append(params, authParam{"acr_values", strings.Join(c.ACR, " ")})
+	}
+	if c.MaxAge > 0 {
+		params = append(params, authParam{"max_age", strconv.Itoa(int(c.MaxAge / time.Second))})
+	}
+	return params
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
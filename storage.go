@@ -0,0 +1,360 @@
+package openidauth
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Storage keeps the state of the middleware: sessions, pending logins,
+// logouts, introspection results and the deny list. The memory storage only
+// serves a single Caddy instance, Redis and the storage of Caddy v2 share
+// the state between the instances of a cluster, so a login can end on
+// another instance than the one it started on. Other backends are set with
+// Config.StorageBackend.
+type Storage interface {
+	// Get returns the value of the key, or nil if there is none.
+	Get(key string) ([]byte, error)
+	// Set stores the value. It expires after the TTL, unless that is 0.
+	Set(key string, value []byte, ttl time.Duration) error
+	// SetIfAbsent stores the value unless the key exists, atomically, and
+	// reports whether it did.
+	SetIfAbsent(key string, value []byte, ttl time.Duration) (bool, error)
+	// Take returns the value of the key and deletes it, atomically, for
+	// state that may only be used once. It returns nil if there is none.
+	Take(key string) ([]byte, error)
+	Delete(key string) error
+	// DeletePrefix deletes all the keys with the prefix and returns how
+	// many there were.
+	DeletePrefix(prefix string) (int, error)
+	Close() error
+}
+
+type storage = Storage
+
+// storageCaddy is the storage URL of the storage of Caddy v2, which the
+// Caddy v2 module passes in Config.StorageBackend.
+const storageCaddy = "caddy"
+
+// Storages are shared by the middlewares with the same storage URL. When the
+// configuration is reloaded the new middleware gets the storage of the old
+// one before that is stopped, so sessions and other state in memory survive
+// the reload.
+var (
+	sharedStoragesMu sync.Mutex
+	sharedStorages   = make(map[string]*sharedStorage)
+)
+
+// sharedStorage is a storage used by several middlewares. It is closed when
+// the last of them closes it.
+type sharedStorage struct {
+	storage
+	url  string
+	refs int
+}
+
+// acquireStorage returns the storage for the URL, creating it if no other
+// middleware uses it.
+func acquireStorage(rawurl string) (storage, error) {
+	if rawurl == "" {
+		rawurl = "memory"
+	}
+	sharedStoragesMu.Lock()
+	defer sharedStoragesMu.Unlock()
+	s, ok := sharedStorages[rawurl]
+	if !ok {
+		store, err := newStorage(rawurl)
+		if err != nil {
+			return nil, err
+		}
+		s = &sharedStorage{storage: store, url: rawurl}
+		sharedStorages[rawurl] = s
+	}
+	s.refs++
+	return s, nil
+}
+
+func (s *sharedStorage) Close() error {
+	sharedStoragesMu.Lock()
+	defer sharedStoragesMu.Unlock()
+	s.refs--
+	if s.refs > 0 {
+		return nil
+	}
+	delete(sharedStorages, s.url)
+	return s.storage.Close()
+}
+
+// newStorage creates the storage for the URL. Without one the state is kept
+// in memory.
+func newStorage(rawurl string) (storage, error) {
+	switch {
+	case rawurl == "" || rawurl == "memory":
+		return newMemoryStorage(), nil
+	case strings.HasPrefix(rawurl, "redis://") || strings.HasPrefix(rawurl, "rediss://"):
+		return newRedisStorage(rawurl)
+	case rawurl == storageCaddy:
+		return nil, fmt.Errorf("openidauth: storage %s is only available in Caddy v2", rawurl)
+	}
+	return nil, fmt.Errorf("openidauth: unsupported storage %q", rawurl)
+}
+
+// maxMemoryItems caps the number of values in the memory storage, so that
+// state created by unauthenticated requests, like pending logins, can't
+// exhaust the memory.
+const maxMemoryItems = 1 << 20
+
+// errStorageFull is returned when the memory storage is full of values
+// that never expire.
+var errStorageFull = errors.New("openidauth: the memory storage is full")
+
+type memoryItem struct {
+	Key     string
+	Value   []byte
+	Expires time.Time
+
+	// The position in the expiry heap, -1 for values that don't expire.
+	index int
+}
+
+// memoryStorage keeps the state in a map. The values that expire are also
+// kept in a heap ordered by their expiry, expired ones are removed from its
+// top on every write. When the storage is full, the value that expires
+// first makes room for the new one.
+type memoryStorage struct {
+	mu     sync.Mutex
+	items  map[string]*memoryItem
+	expiry expiryHeap
+	max    int
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{items: make(map[string]*memoryItem), max: maxMemoryItems}
+}
+
+func (s *memoryStorage) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.items[key]
+	if !ok {
+		return nil, nil
+	}
+	if !item.Expires.IsZero() && time.Now().After(item.Expires) {
+		s.remove(item)
+		return nil, nil
+	}
+	return item.Value, nil
+}
+
+func (s *memoryStorage) Set(key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.set(key, value, ttl, time.Now())
+}
+
+func (s *memoryStorage) SetIfAbsent(key string, value []byte, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if item, ok := s.items[key]; ok && (item.Expires.IsZero() || !now.After(item.Expires)) {
+		return false, nil
+	}
+	return true, s.set(key, value, ttl, now)
+}
+
+// set stores the value, the lock must be held.
+func (s *memoryStorage) set(key string, value []byte, ttl time.Duration, now time.Time) error {
+	s.expire(now)
+	item, ok := s.items[key]
+	if !ok {
+		if len(s.items) >= s.max {
+			if len(s.expiry) == 0 {
+				return errStorageFull
+			}
+			s.remove(s.expiry[0])
+		}
+		item = &memoryItem{Key: key, index: -1}
+		s.items[key] = item
+	}
+	item.Value, item.Expires = value, time.Time{}
+	if ttl > 0 {
+		item.Expires = now.Add(ttl)
+	}
+	switch {
+	case item.index >= 0 && ttl > 0:
+		heap.Fix(&s.expiry, item.index)
+	case item.index >= 0:
+		heap.Remove(&s.expiry, item.index)
+	case ttl > 0:
+		heap.Push(&s.expiry, item)
+	}
+	return nil
+}
+
+func (s *memoryStorage) Take(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.items[key]
+	if !ok {
+		return nil, nil
+	}
+	s.remove(item)
+	if !item.Expires.IsZero() && time.Now().After(item.Expires) {
+		return nil, nil
+	}
+	return item.Value, nil
+}
+
+func (s *memoryStorage) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if item, ok := s.items[key]; ok {
+		s.remove(item)
+	}
+	return nil
+}
+
+func (s *memoryStorage) DeletePrefix(prefix string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for k, item := range s.items {
+		if strings.HasPrefix(k, prefix) {
+			s.remove(item)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// expire removes the values that have expired.
+func (s *memoryStorage) expire(now time.Time) {
+	for len(s.expiry) > 0 && now.After(s.expiry[0].Expires) {
+		s.remove(s.expiry[0])
+	}
+}
+
+// remove removes the item from the map and the expiry heap.
+func (s *memoryStorage) remove(item *memoryItem) {
+	delete(s.items, item.Key)
+	if item.index >= 0 {
+		heap.Remove(&s.expiry, item.index)
+	}
+}
+
+// expiryHeap implements heap.Interface for the items that expire, the
+// first to expire on top.
+type expiryHeap []*memoryItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].Expires.Before(h[j].Expires) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	item := x.(*memoryItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	item.index = -1
+	*h = old[:len(old)-1]
+	return item
+}
+
+func (s *memoryStorage) Close() error {
+	return nil
+}
+
+// Prefix of all the keys in Redis, so the database can be shared.
+const redisKeyPrefix = "openidauth:"
+
+// redisStorage keeps the state in Redis.
+type redisStorage struct {
+	client *redis.Client
+}
+
+func newRedisStorage(rawurl string) (*redisStorage, error) {
+	opts, err := redis.ParseURL(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("openidauth: invalid storage URL: %v", err)
+	}
+	return &redisStorage{client: redis.NewClient(opts)}, nil
+}
+
+func (s *redisStorage) Get(key string) ([]byte, error) {
+	value, err := s.client.Get(redisKeyPrefix + key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return value, err
+}
+
+func (s *redisStorage) Set(key string, value []byte, ttl time.Duration) error {
+	return s.client.Set(redisKeyPrefix+key, value, ttl).Err()
+}
+
+func (s *redisStorage) SetIfAbsent(key string, value []byte, ttl time.Duration) (bool, error) {
+	return s.client.SetNX(redisKeyPrefix+key, value, ttl).Result()
+}
+
+// Take reads and deletes the key in a transaction, so that of two callers
+// only one gets the value.
+func (s *redisStorage) Take(key string) ([]byte, error) {
+	var get *redis.StringCmd
+	_, err := s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		get = pipe.Get(redisKeyPrefix + key)
+		pipe.Del(redisKeyPrefix + key)
+		return nil
+	})
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return get.Bytes()
+}
+
+func (s *redisStorage) Delete(key string) error {
+	return s.client.Del(redisKeyPrefix + key).Err()
+}
+
+// DeletePrefix scans for the keys instead of using KEYS, which would block
+// the server.
+func (s *redisStorage) DeletePrefix(prefix string) (int, error) {
+	var cursor uint64
+	n := 0
+	for {
+		keys, next, err := s.client.Scan(cursor, redisKeyPrefix+prefix+"*", 1000).Result()
+		if err != nil {
+			return n, err
+		}
+		if len(keys) > 0 {
+			if err := s.client.Del(keys...).Err(); err != nil {
+				return n, err
+			}
+			n += len(keys)
+		}
+		if next == 0 {
+			return n, nil
+		}
+		cursor = next
+	}
+}
+
+func (s *redisStorage) Close() error {
+	return s.client.Close()
+}
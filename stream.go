@@ -0,0 +1,44 @@
+package openidauth
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/emanoelxavier/openid2go/openid"
+)
+
+// watchConnection returns the request with a context that is canceled when
+// the token expires, or when the token or its user is found on the deny
+// list, which is checked every interval. Canceling the context ends long
+// lived responses like Server-Sent Events and long polling, which would
+// otherwise outlive the token by hours. The returned function must be
+// called when the request is done.
+func (h auth) watchConnection(r *http.Request, interval time.Duration, u *openid.User, token string) (*http.Request, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(r.Context())
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var expired <-chan time.Time
+		if exp := claimTime(u.Claims["exp"]); !exp.IsZero() {
+			timer := time.NewTimer(time.Until(exp))
+			defer timer.Stop()
+			expired = timer.C
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-expired:
+				cancel()
+				return
+			case <-ticker.C:
+				if h.DenyList.Denied(u, token) != nil {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	return r.WithContext(ctx), cancel
+}
@@ -0,0 +1,72 @@
+package openidauth
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/emanoelxavier/openid2go/openid"
+)
+
+// tenantRouter restricts the issuers accepted for a request to those of its
+// tenant. The tenant is the host of the request, or the value of Header if
+// it is set. Providers configured for some tenants are only trusted for
+// those, providers without tenants are trusted for the requests of all
+// other tenants. The issuers may be patterns.
+type tenantRouter struct {
+	Header  string
+	Tenants map[string][]string
+	Shared  []string
+}
+
+// newTenantRouter returns nil if no provider is restricted to tenants.
+func newTenantRouter(providers []providerConfig, header string) *tenantRouter {
+	t := &tenantRouter{Header: header, Tenants: make(map[string][]string)}
+	for _, p := range providers {
+		if len(p.Tenants) == 0 {
+			t.Shared = append(t.Shared, providerIssuers(p)...)
+			continue
+		}
+		for _, tenant := range p.Tenants {
+			key := strings.ToLower(tenant)
+			t.Tenants[key] = append(t.Tenants[key], providerIssuers(p)...)
+		}
+	}
+	if len(t.Tenants) == 0 {
+		return nil
+	}
+	return t
+}
+
+// tenant returns the tenant of the request.
+func (t *tenantRouter) tenant(r *http.Request) string {
+	if t.Header != "" {
+		return strings.ToLower(strings.TrimSpace(r.Header.Get(t.Header)))
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// check returns an error if the user was authenticated by an issuer that
+// is not trusted for the tenant of the request.
+func (t *tenantRouter) check(r *http.Request, u *openid.User) error {
+	if t == nil {
+		return nil
+	}
+	tenant := t.tenant(r)
+	issuers, ok := t.Tenants[tenant]
+	if !ok {
+		issuers = t.Shared
+	}
+	for _, iss := range issuers {
+		if issuerMatches(iss, u.Issuer) {
+			return nil
+		}
+	}
+	return validationError(openid.ValidationErrorInvalidIssuer, http.StatusUnauthorized,
+		fmt.Sprintf("The token issuer %s is not trusted for %s", u.Issuer, tenant), nil)
+}
@@ -0,0 +1,155 @@
+package openidauth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emanoelxavier/openid2go/openid"
+)
+
+const (
+	grantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	tokenTypeAccessToken   = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// tokenExchanger exchanges the token of a request at the token endpoint of
+// its issuer for a token for the backend, see RFC 8693. The backend only
+// gets the new token, issued for Audience with Scopes, never the one of the
+// client. The middleware authenticates with the client id and secret of
+// the provider. Exchanged tokens are kept in Storage until shortly before
+// they expire.
+type tokenExchanger struct {
+	Audience  string
+	Scopes    []string
+	Providers []providerConfig
+	Cache     *fetchCache
+	Storage   storage
+
+	mu          sync.Mutex
+	discoveries map[string]*discovery
+}
+
+// Exchanged tokens are used until this long before they expire.
+const tokenExchangeMargin = 10 * time.Second
+
+// exchange returns the token for the backend. It returns an empty string
+// if tokens are not exchanged.
+func (e *tokenExchanger) exchange(token string, u *openid.User) (string, error) {
+	if e == nil || token == "" {
+		return "", nil
+	}
+	sum := sha256.Sum256([]byte(e.Audience + "\x00" + token))
+	key := "exchange:" + hex.EncodeToString(sum[:])
+	if value, err := e.Storage.Get(key); err == nil && value != nil {
+		return string(value), nil
+	}
+
+	var provider *providerConfig
+	for i := range e.Providers {
+		for _, iss := range providerIssuers(e.Providers[i]) {
+			if provider == nil && issuerMatches(iss, u.Issuer) {
+				provider = &e.Providers[i]
+			}
+		}
+	}
+	if provider == nil {
+		return "", &authorizationError{Code: "access_denied", Description: "The token can't be exchanged for the backend"}
+	}
+
+	tokens, status, err := e.post(*provider, u.Issuer, token)
+	if err != nil {
+		if status == http.StatusBadRequest || status == http.StatusUnauthorized {
+			// The provider refuses to issue a token for the backend to
+			// this client.
+			return "", &authorizationError{Code: "access_denied", Description: "The token can't be exchanged for the backend"}
+		}
+		return "", &authorizationError{
+			Code:        "temporarily_unavailable",
+			Description: "The token exchange failed",
+			Unavailable: true,
+		}
+	}
+
+	if ttl := time.Duration(tokens.ExpiresIn)*time.Second - tokenExchangeMargin; ttl > 0 {
+		e.Storage.Set(key, []byte(tokens.AccessToken), ttl)
+	}
+	return tokens.AccessToken, nil
+}
+
+// discoveryOf returns the discovery of the issuer, which is kept for the
+// following exchanges. Like the validators of issuers matching a pattern,
+// at most maxDynamicIssuers are kept.
+func (e *tokenExchanger) discoveryOf(p providerConfig, issuer string) *discovery {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if d, ok := e.discoveries[issuer]; ok {
+		return d
+	}
+	if e.discoveries == nil {
+		e.discoveries = make(map[string]*discovery)
+	}
+	if len(e.discoveries) >= maxDynamicIssuers {
+		for iss := range e.discoveries {
+			delete(e.discoveries, iss)
+			break
+		}
+	}
+	p.Issuer = issuer
+	d := newDiscovery(p, e.Cache)
+	e.discoveries[issuer] = d
+	return d
+}
+
+// post sends the token exchange request to the token endpoint of the
+// issuer. The status is that of the response, or 0 if there was none.
+func (e *tokenExchanger) post(p providerConfig, issuer, token string) (*tokenResponse, int, error) {
+	doc, err := e.discoveryOf(p, issuer).Document()
+	if err != nil {
+		return nil, 0, err
+	}
+	if doc.TokenEndpoint == "" {
+		return nil, 0, fmt.Errorf("openidauth: issuer %s has no token endpoint", issuer)
+	}
+
+	form := url.Values{
+		"grant_type":           {grantTypeTokenExchange},
+		"subject_token":        {token},
+		"subject_token_type":   {tokenTypeAccessToken},
+		"requested_token_type": {tokenTypeAccessToken},
+		"audience":             {e.Audience},
+	}
+	if len(e.Scopes) > 0 {
+		form.Set("scope", strings.Join(e.Scopes, " "))
+	}
+	req, err := http.NewRequest(http.MethodPost, doc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.ClientIds[0]), url.QueryEscape(p.clientSecret()))
+
+	resp, err := e.Cache.Client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode, fmt.Errorf("openidauth: token endpoint returned status %d", resp.StatusCode)
+	}
+	tokens := &tokenResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(tokens); err != nil {
+		return nil, resp.StatusCode, err
+	}
+	if tokens.AccessToken == "" {
+		return nil, resp.StatusCode, fmt.Errorf("openidauth: token endpoint returned no access token")
+	}
+	return tokens, resp.StatusCode, nil
+}
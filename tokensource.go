@@ -0,0 +1,261 @@
+package openidauth
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/emanoelxavier/openid2go/openid"
+)
+
+// Kinds of places a token can be read from.
+const (
+	tokenSourceHeader      = "header"
+	tokenSourceQuery       = "query"
+	tokenSourceCookie      = "cookie"
+	tokenSourceSubprotocol = "subprotocol"
+)
+
+// tokenSource is a place in the request the token is read from. Name is the
+// header, query parameter or cookie name. A header source without a name is
+// the Authorization header. Browsers can't set headers on WebSocket
+// connections, so they pass the token as a subprotocol instead, the one
+// after the subprotocol Name in the Sec-WebSocket-Protocol header.
+type tokenSource struct {
+	Kind string `json:"kind"`
+	Name string `json:"name,omitempty"`
+}
+
+// defaultMaxTokenSize is the limit on the size of tokens, unless configured
+// otherwise. Tokens with many claims, like the groups of Azure AD, reach a
+// few kilobytes.
+const defaultMaxTokenSize = 16 << 10
+
+// defaultTokenSources are used when no token_source is configured.
+var defaultTokenSources = []tokenSource{
+	{Kind: tokenSourceHeader},
+	{Kind: tokenSourceQuery, Name: "access_token"},
+}
+
+// parseTokenSource parses the arguments of a token_source directive:
+//
+//	token_source header [name]
+//	token_source query [name]
+//	token_source cookie name
+//	token_source subprotocol [name]
+func parseTokenSource(c Dispenser) (tokenSource, error) {
+	args := c.RemainingArgs()
+	if len(args) == 0 || len(args) > 2 {
+		return tokenSource{}, c.ArgErr()
+	}
+	src := tokenSource{Kind: args[0]}
+	if len(args) == 2 {
+		src.Name = args[1]
+	}
+	switch src.Kind {
+	case tokenSourceHeader:
+		if strings.EqualFold(src.Name, "Authorization") {
+			src.Name = ""
+		}
+	case tokenSourceQuery:
+		if src.Name == "" {
+			src.Name = "access_token"
+		}
+	case tokenSourceCookie:
+		if src.Name == "" {
+			return tokenSource{}, c.ArgErr()
+		}
+	case tokenSourceSubprotocol:
+		if src.Name == "" {
+			src.Name = "access_token"
+		}
+	default:
+		return tokenSource{}, c.Errf("openidauth: unknown token source %q", src.Kind)
+	}
+	return src, nil
+}
+
+// String returns the source in the same form as it is configured.
+func (s tokenSource) String() string {
+	if s.Name == "" {
+		return s.Kind
+	}
+	return s.Kind + " " + s.Name
+}
+
+// token returns the token in the request from this source, or an empty
+// string if there is none.
+func (s tokenSource) token(r *http.Request) string {
+	switch s.Kind {
+	case tokenSourceHeader:
+		name := s.Name
+		if name == "" {
+			name = "Authorization"
+		}
+		v := r.Header.Get(name)
+		if len(v) > 7 && strings.EqualFold(v[:7], "bearer ") {
+			return strings.TrimSpace(v[7:])
+		}
+		if s.Name == "" {
+			// The Authorization header is only used with the Bearer and
+			// DPoP schemes.
+			if len(v) > 5 && strings.EqualFold(v[:5], "dpop ") {
+				return strings.TrimSpace(v[5:])
+			}
+			return ""
+		}
+		return strings.TrimSpace(v)
+	case tokenSourceQuery:
+		return r.URL.Query().Get(s.Name)
+	case tokenSourceCookie:
+		if cookie, err := r.Cookie(s.Name); err == nil {
+			return cookie.Value
+		}
+	case tokenSourceSubprotocol:
+		if !isWebSocketUpgrade(r) {
+			return ""
+		}
+		protocols := subprotocols(r)
+		for i, p := range protocols {
+			if p == s.Name && i+1 < len(protocols) {
+				return protocols[i+1]
+			}
+		}
+	}
+	return ""
+}
+
+// isWebSocketUpgrade reports whether the request opens a WebSocket.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// subprotocols returns the subprotocols the client asks for.
+func subprotocols(r *http.Request) []string {
+	var protocols []string
+	for _, v := range r.Header["Sec-Websocket-Protocol"] {
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				protocols = append(protocols, p)
+			}
+		}
+	}
+	return protocols
+}
+
+// removeSubprotocolTokens removes the tokens passed as subprotocols, and the
+// subprotocols announcing them, so the backend doesn't pick one of them as
+// the protocol of the connection. The backend never sees these tokens.
+func removeSubprotocolTokens(r *http.Request, sources []tokenSource) {
+	for _, s := range sources {
+		if s.Kind != tokenSourceSubprotocol || !isWebSocketUpgrade(r) {
+			continue
+		}
+		protocols := subprotocols(r)
+		var kept []string
+		for i := 0; i < len(protocols); i++ {
+			if protocols[i] == s.Name {
+				i++
+				continue
+			}
+			kept = append(kept, protocols[i])
+		}
+		if len(kept) == len(protocols) {
+			continue
+		}
+		r.Header.Del("Sec-Websocket-Protocol")
+		if len(kept) > 0 {
+			r.Header.Set("Sec-Websocket-Protocol", strings.Join(kept, ", "))
+		}
+	}
+}
+
+// extractToken returns the token from the first source in the list that has
+// one.
+func extractToken(r *http.Request, sources []tokenSource) (string, tokenSource, bool) {
+	for _, s := range sources {
+		if token := s.token(r); token != "" {
+			return token, s, true
+		}
+	}
+	return "", tokenSource{}, false
+}
+
+// checkTokenShape rejects tokens that can't be real before anything parses
+// them: tokens larger than max, tokens with more segments than an encrypted
+// JWT and JWTs with too large claims. Oversized tokens in headers and
+// cookies are answered like oversized headers with 431, the others with 400.
+func checkTokenShape(token string, source tokenSource, max int) error {
+	if len(token) > max {
+		status := http.StatusRequestHeaderFieldsTooLarge
+		if source.Kind == tokenSourceQuery {
+			status = http.StatusBadRequest
+		}
+		return validationError(openid.ValidationErrorAuthorizationHeaderWrongFormat, status,
+			"The token is too large", nil)
+	}
+	if strings.Count(token, ".") > 4 {
+		return validationError(openid.ValidationErrorAuthorizationHeaderWrongFormat, http.StatusBadRequest,
+			"The token has too many segments", nil)
+	}
+	if err := checkJWTSize(token); err != nil {
+		return validationError(openid.ValidationErrorAuthorizationHeaderWrongFormat, http.StatusBadRequest,
+			"The token is malformed", err)
+	}
+	return nil
+}
+
+// stripToken removes the token from every place it can be passed in, so it
+// never reaches the backend. Besides the configured sources that is the
+// Authorization header and the access_token query parameter.
+func stripToken(r *http.Request, sources []tokenSource) {
+	r.Header.Del("Authorization")
+	query := r.URL.Query()
+	strippedQuery := false
+	if _, ok := query["access_token"]; ok {
+		query.Del("access_token")
+		strippedQuery = true
+	}
+	var cookies []string
+	for _, s := range sources {
+		switch s.Kind {
+		case tokenSourceHeader:
+			if s.Name != "" {
+				r.Header.Del(s.Name)
+			}
+		case tokenSourceQuery:
+			if _, ok := query[s.Name]; ok {
+				query.Del(s.Name)
+				strippedQuery = true
+			}
+		case tokenSourceCookie:
+			cookies = append(cookies, s.Name)
+		}
+	}
+	if strippedQuery {
+		r.URL.RawQuery = query.Encode()
+		r.RequestURI = r.URL.RequestURI()
+	}
+	if len(cookies) > 0 {
+		removeCookies(r, cookies)
+	}
+}
+
+// removeCookies removes the named cookies from the Cookie header.
+func removeCookies(r *http.Request, names []string) {
+	var kept []*http.Cookie
+	for _, c := range r.Cookies() {
+		remove := false
+		for _, name := range names {
+			if c.Name == name {
+				remove = true
+			}
+		}
+		if !remove {
+			kept = append(kept, c)
+		}
+	}
+	r.Header.Del("Cookie")
+	for _, c := range kept {
+		r.AddCookie(c)
+	}
+}
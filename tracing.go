@@ -0,0 +1,47 @@
+package openidauth
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The spans are created with the global tracer provider, which is a no-op
+// until the application, or Caddy's tracing module, sets one.
+var tracer = otel.Tracer("github.com/greenpau/openidauth")
+
+// startSpan starts a span for a step of handling the request. It is a child
+// of the span of the request if Caddy traces it, otherwise of the trace
+// context sent by the client.
+func startSpan(r *http.Request, name string, attrs ...attribute.KeyValue) trace.Span {
+	ctx := r.Context()
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(r.Header))
+	}
+	_, span := tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+	return span
+}
+
+// endSpan ends the span with the outcome of the step.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, errorCode(err))
+	}
+	span.End()
+}
+
+// startFetchSpan starts the span of fetching a document from a provider.
+// The documents are cached for all requests and refreshed in the
+// background, so fetches have traces of their own.
+func startFetchSpan(url string) trace.Span {
+	_, span := tracer.Start(context.Background(), "openidauth.fetch",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("http.url", url)))
+	return span
+}
@@ -0,0 +1,157 @@
+package openidauth
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/emanoelxavier/openid2go/openid"
+)
+
+const (
+	// Bounds on the number of tokens remembered, so a flood of distinct
+	// tokens can't exhaust memory.
+	maxValidTokens     = 10000
+	maxMalformedTokens = 1000
+
+	// How long a malformed token is remembered.
+	malformedTokenTTL = time.Minute
+)
+
+type cachedUser struct {
+	User    *openid.User
+	Expires time.Time
+
+	// The fingerprint of the client that first used the token.
+	Fingerprint string
+}
+
+type cachedError struct {
+	Err     error
+	Expires time.Time
+}
+
+// cachingValidator remembers the results of another validator, so the same
+// token is not verified again on every request. Valid tokens are remembered
+// for the TTL but never beyond their exp. Tokens that are not even well
+// formed are remembered for a minute. With Bind the remembered results are
+// bound to the client that first used the token, see ValidateFrom.
+type cachingValidator struct {
+	Validator validator
+	TTL       time.Duration
+	Bind      string
+
+	mu        sync.Mutex
+	valid     map[[sha256.Size]byte]cachedUser
+	malformed map[[sha256.Size]byte]cachedError
+}
+
+func newCachingValidator(v validator, ttl time.Duration) *cachingValidator {
+	return &cachingValidator{
+		Validator: v,
+		TTL:       ttl,
+		valid:     make(map[[sha256.Size]byte]cachedUser),
+		malformed: make(map[[sha256.Size]byte]cachedError),
+	}
+}
+
+// Validate returns the remembered result for the token, or validates it.
+func (c *cachingValidator) Validate(token string) (*openid.User, error) {
+	return c.ValidateFrom(token, "")
+}
+
+// ValidateFrom is Validate for a token sent by the client with the
+// fingerprint. A token remembered for another client is validated again
+// with Bind revalidate, and rejected with Bind reject.
+func (c *cachingValidator) ValidateFrom(token, fingerprint string) (*openid.User, error) {
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+
+	c.mu.Lock()
+	if entry, ok := c.valid[key]; ok && now.Before(entry.Expires) {
+		c.mu.Unlock()
+		if c.Bind == "" || fingerprint == "" || entry.Fingerprint == "" || entry.Fingerprint == fingerprint {
+			return entry.User, nil
+		}
+		if c.Bind == bindReject {
+			return nil, validationError(openid.ValidationErrorJwtValidationFailure, http.StatusUnauthorized,
+				"The token is used by another client", nil)
+		}
+		// Keep the entry of the first client.
+		return c.Validator.Validate(token)
+	}
+	if entry, ok := c.malformed[key]; ok && now.Before(entry.Expires) {
+		c.mu.Unlock()
+		return nil, entry.Err
+	}
+	c.mu.Unlock()
+
+	u, err := c.Validator.Validate(token)
+	switch {
+	case err == nil:
+		expires := now.Add(c.TTL)
+		if exp := claimTime(u.Claims["exp"]); !exp.IsZero() && exp.Before(expires) {
+			expires = exp
+		}
+		c.mu.Lock()
+		if len(c.valid) >= maxValidTokens {
+			evict(c.valid, now)
+		}
+		c.valid[key] = cachedUser{User: u, Expires: expires, Fingerprint: fingerprint}
+		c.mu.Unlock()
+	case isMalformed(err):
+		c.mu.Lock()
+		if len(c.malformed) >= maxMalformedTokens {
+			for k := range c.malformed {
+				delete(c.malformed, k)
+			}
+		}
+		c.malformed[key] = cachedError{Err: err, Expires: now.Add(malformedTokenTTL)}
+		c.mu.Unlock()
+	}
+	return u, err
+}
+
+// Len returns the number of remembered valid and malformed tokens.
+func (c *cachingValidator) Len() (valid, malformed int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.valid), len(c.malformed)
+}
+
+// Flush forgets all the tokens.
+func (c *cachingValidator) Flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.valid) + len(c.malformed)
+	c.valid = make(map[[sha256.Size]byte]cachedUser)
+	c.malformed = make(map[[sha256.Size]byte]cachedError)
+	return n
+}
+
+// evict makes room in a full cache of valid tokens. Expired entries are
+// removed first, then arbitrary ones.
+func evict(entries map[[sha256.Size]byte]cachedUser, now time.Time) {
+	for k, v := range entries {
+		if now.After(v.Expires) {
+			delete(entries, k)
+		}
+	}
+	for k := range entries {
+		if len(entries) < maxValidTokens {
+			return
+		}
+		delete(entries, k)
+	}
+}
+
+// isMalformed reports whether validation failed because the token could not
+// be parsed.
+func isMalformed(err error) bool {
+	if verr, ok := err.(*openid.ValidationError); ok {
+		_, ok = verr.Err.(malformedJWTError)
+		return ok
+	}
+	return false
+}
@@ -0,0 +1,497 @@
+package openidauth
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emanoelxavier/openid2go/openid"
+)
+
+// validator validates a token and returns the user it identifies.
+type validator interface {
+	Validate(token string) (*openid.User, error)
+}
+
+// tokenValidator validates JWTs issued by the configured providers. The
+// signing keys are read from the JWKS of the issuer through the fetch cache.
+// Leeway is the clock skew tolerated when validating exp, nbf and iat.
+// Tokens signed with an algorithm not in AllowedAlgs, or the signing
+// algorithms of their provider if it has some, are rejected.
+// Providers whose issuer is a pattern accept any issuer it matches, each
+// one gets its own issuerValidator when its first token arrives.
+// Encrypted tokens are decrypted with the Decrypter first.
+type tokenValidator struct {
+	Issuers     []*issuerValidator
+	Patterns    []providerConfig
+	Leeway      time.Duration
+	AllowedAlgs []string
+	Cache       *fetchCache
+	Decrypter   *decrypter
+
+	mu      sync.Mutex
+	dynamic map[string]*issuerValidator
+}
+
+// issuerValidator validates the tokens of one provider.
+// The keys are read from LocalKeys instead of the JWKS if it is set.
+// The users are adapted by the Profile of the provider, if it has one.
+type issuerValidator struct {
+	Provider  providerConfig
+	Discovery *discovery
+	Cache     *fetchCache
+	LocalKeys keySource
+	Profile   profile
+
+	mu        sync.Mutex
+	jwksBody  []byte
+	keys      []publicKey
+	refetched time.Time
+}
+
+// profile adapts the middleware to the quirks of a provider. It completes
+// the users of validated tokens.
+type profile interface {
+	normalize(u *openid.User) error
+}
+
+// newProfile returns the profile of the provider, or nil if it has none.
+func newProfile(p providerConfig, cache *fetchCache) profile {
+	switch p.Profile {
+	case profileAzure:
+		return newAzureProfile(p, cache.Client)
+	case profileKeycloak:
+		return &keycloakProfile{ClientIds: p.ClientIds}
+	case profileCognito:
+		return cognitoProfile{}
+	}
+	return nil
+}
+
+// At most this many issuers matching a pattern are remembered. Beyond that
+// an arbitrary one is forgotten for each new issuer, along with its cached
+// documents, so tokens made up with random issuers can't exhaust the memory.
+const maxDynamicIssuers = 1000
+
+// The JWKS is fetched again at most this often because of tokens with an
+// unknown kid, so such tokens can't be used to flood the provider.
+const jwksRefetchInterval = 30 * time.Second
+
+func newTokenValidator(providers []providerConfig, leeway time.Duration, allowedAlgs []string, cache *fetchCache) *tokenValidator {
+	v := &tokenValidator{
+		Leeway:      leeway,
+		AllowedAlgs: allowedAlgs,
+		Cache:       cache,
+		dynamic:     make(map[string]*issuerValidator),
+	}
+	for _, p := range providers {
+		for _, iss := range providerIssuers(p) {
+			p.Issuer = iss
+			if isIssuerPattern(iss) {
+				v.Patterns = append(v.Patterns, p)
+			} else {
+				v.Issuers = append(v.Issuers, newIssuerValidator(p, cache))
+			}
+		}
+	}
+	return v
+}
+
+func newIssuerValidator(p providerConfig, cache *fetchCache) *issuerValidator {
+	i := &issuerValidator{
+		Provider:  p,
+		Discovery: newDiscovery(p, cache),
+		Cache:     cache,
+		Profile:   newProfile(p, cache),
+	}
+	if p.JWKSFile != "" || len(p.PublicKeyFiles) > 0 {
+		i.LocalKeys = newKeyFiles(p.JWKSFile, p.PublicKeyFiles)
+	}
+	return i
+}
+
+// providerIssuers returns the issuers whose tokens the provider accepts.
+// Azure AD issues tokens from two versions of its endpoints.
+func providerIssuers(p providerConfig) []string {
+	issuers := []string{p.Issuer}
+	if p.Profile == profileAzure {
+		if alias := azureIssuerAlias(p.Issuer); alias != "" {
+			issuers = append(issuers, alias)
+		}
+	}
+	return issuers
+}
+
+// isIssuerPattern reports whether the configured issuer is a pattern.
+func isIssuerPattern(issuer string) bool {
+	return strings.Contains(issuer, "*")
+}
+
+var (
+	issuerPatternsMu sync.Mutex
+	issuerPatterns   = make(map[string]*regexp.Regexp)
+)
+
+// issuerMatches reports whether the issuer matches the configured one. A *
+// in a pattern stands for one or more letters, digits, dots, dashes or
+// underscores, so it can match a tenant id in the path or a label of the
+// host, but never reach into another host or path.
+func issuerMatches(pattern, issuer string) bool {
+	if !isIssuerPattern(pattern) {
+		return pattern == issuer
+	}
+	issuerPatternsMu.Lock()
+	re, ok := issuerPatterns[pattern]
+	if !ok {
+		parts := strings.Split(pattern, "*")
+		for i, part := range parts {
+			parts[i] = regexp.QuoteMeta(part)
+		}
+		re = regexp.MustCompile("^" + strings.Join(parts, "[A-Za-z0-9._-]+") + "$")
+		issuerPatterns[pattern] = re
+	}
+	issuerPatternsMu.Unlock()
+	return re.MatchString(issuer)
+}
+
+// dynamicIssuer returns the validator for an issuer that matches one of the
+// patterns, or nil if none does.
+func (v *tokenValidator) dynamicIssuer(issuer string) *issuerValidator {
+	for _, p := range v.Patterns {
+		if !issuerMatches(p.Issuer, issuer) {
+			continue
+		}
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		if i, ok := v.dynamic[issuer]; ok {
+			return i
+		}
+		if len(v.dynamic) >= maxDynamicIssuers {
+			for iss, evicted := range v.dynamic {
+				delete(v.dynamic, iss)
+				// Its documents would otherwise stay in the cache and
+				// be refreshed for good.
+				v.Cache.Remove(evicted.Discovery.fetchedURLs()...)
+				break
+			}
+		}
+		p.Issuer = issuer
+		i := newIssuerValidator(p, v.Cache)
+		v.dynamic[issuer] = i
+		return i
+	}
+	return nil
+}
+
+// validationError creates the error returned for an invalid token.
+func validationError(code openid.ValidationErrorCode, status int, message string, err error) *openid.ValidationError {
+	return &openid.ValidationError{Code: code, Message: message, Err: err, HTTPStatus: status}
+}
+
+// tokenKind is the kind of token being validated.
+type tokenKind int
+
+const (
+	accessToken tokenKind = iota
+	idToken
+	logoutToken
+)
+
+// Validate verifies the token and returns the user it identifies. A token
+// is accepted if any of the providers validates it.
+func (v *tokenValidator) Validate(token string) (*openid.User, error) {
+	return v.validate(token, accessToken)
+}
+
+// ValidateIDToken verifies an ID token. It is issued for the client, so the
+// client ids are accepted as audiences even if other audiences are
+// configured for access tokens.
+func (v *tokenValidator) ValidateIDToken(token string) (*openid.User, error) {
+	return v.validate(token, idToken)
+}
+
+// ValidateLogoutToken verifies the signature, audience and times of a
+// logout token like those of an ID token. A logout token may leave out sub
+// if it has a sid, the ID of the user returned is then empty. The claims
+// specific to logout tokens are checked by the caller.
+func (v *tokenValidator) ValidateLogoutToken(token string) (*openid.User, error) {
+	return v.validate(token, logoutToken)
+}
+
+func (v *tokenValidator) validate(token string, kind tokenKind) (*openid.User, error) {
+	if strings.Count(token, ".") == 4 {
+		nested, err := v.Decrypter.decrypt(token)
+		if err != nil {
+			return nil, validationError(openid.ValidationErrorJwtValidationFailure, http.StatusUnauthorized,
+				"Failed to decrypt the token", err)
+		}
+		token = nested
+	}
+
+	t, err := parseJWT(token)
+	if err != nil {
+		return nil, validationError(openid.ValidationErrorJwtValidationFailure, http.StatusUnauthorized,
+			"Failed to parse the token", err)
+	}
+	// Logout tokens should be typed explicitly, so that they can't be
+	// confused with other tokens of the provider.
+	if kind == logoutToken && t.Header.Typ != "" && !strings.EqualFold(strings.TrimPrefix(t.Header.Typ, "application/"), "logout+jwt") {
+		return nil, validationError(openid.ValidationErrorJwtValidationFailure, http.StatusUnauthorized,
+			fmt.Sprintf("The token type %q is not logout+jwt", t.Header.Typ), nil)
+	}
+
+	iss, found := t.Claims["iss"]
+	if !found {
+		return nil, validationError(openid.ValidationErrorIssuerNotFound, http.StatusUnauthorized,
+			"The token does not contain the iss claim", nil)
+	}
+	issuer, ok := iss.(string)
+	if !ok {
+		return nil, validationError(openid.ValidationErrorInvalidIssuerType, http.StatusUnauthorized,
+			"The iss claim of the token is not a string", nil)
+	}
+
+	var i *issuerValidator
+	for _, iv := range v.Issuers {
+		if iv.Provider.Issuer == issuer {
+			i = iv
+			break
+		}
+	}
+	if i == nil {
+		i = v.dynamicIssuer(issuer)
+	}
+	if i == nil {
+		return nil, validationError(openid.ValidationErrorInvalidIssuer, http.StatusUnauthorized,
+			fmt.Sprintf("The token issuer %s is not trusted", issuer), nil)
+	}
+	if !i.allowed(t.Header.Alg, v.AllowedAlgs) {
+		return nil, validationError(openid.ValidationErrorJwtValidationFailure, http.StatusUnauthorized,
+			fmt.Sprintf("The token signing algorithm %q is not allowed", t.Header.Alg), nil)
+	}
+	return i.validate(t, v.Leeway, kind)
+}
+
+// allowed reports whether the tokens of the issuer signed with alg are
+// accepted. The signing algorithms of the provider replace the defaults.
+func (i *issuerValidator) allowed(alg string, defaults []string) bool {
+	algs := i.Provider.SigningAlgs
+	if len(algs) == 0 {
+		algs = defaults
+	}
+	for _, a := range algs {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// validate verifies the signature and the claims of a token from this
+// issuer.
+func (i *issuerValidator) validate(t *rawJWT, leeway time.Duration, kind tokenKind) (*openid.User, error) {
+	if err := i.verifySignature(t); err != nil {
+		return nil, err
+	}
+	if err := validateTimes(t.Claims, time.Now(), leeway, !i.Provider.AllowMissingExp); err != nil {
+		return nil, validationError(openid.ValidationErrorJwtValidationFailure, http.StatusUnauthorized, err.Error(), err)
+	}
+	if err := i.validateAudience(t, kind != accessToken); err != nil {
+		return nil, err
+	}
+
+	sub, found := t.Claims["sub"]
+	if !found && kind == logoutToken {
+		return &openid.User{Issuer: i.Provider.Issuer, Claims: t.Claims}, nil
+	}
+	if !found {
+		return nil, validationError(openid.ValidationErrorSubjectNotFound, http.StatusUnauthorized,
+			"The token does not contain the sub claim", nil)
+	}
+	subject, ok := sub.(string)
+	if !ok {
+		return nil, validationError(openid.ValidationErrorInvalidSubjectType, http.StatusUnauthorized,
+			"The sub claim of the token is not a string", nil)
+	}
+	if subject == "" {
+		return nil, validationError(openid.ValidationErrorInvalidSubject, http.StatusUnauthorized,
+			"The sub claim of the token is empty", nil)
+	}
+
+	u := &openid.User{Issuer: i.Provider.Issuer, ID: subject, Claims: t.Claims}
+	if i.Profile != nil && kind != logoutToken {
+		if err := i.Profile.normalize(u); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// verifySignature checks the signature of the token with the keys of the
+// issuer.
+func (i *issuerValidator) verifySignature(t *rawJWT) error {
+	keys, err := i.signingKeys()
+	if err != nil {
+		return validationError(openid.ValidationErrorGetJwksFailure, http.StatusServiceUnavailable,
+			"Failed to get the signing keys of the issuer", err)
+	}
+
+	candidates := matchingKeys(keys, t)
+	if len(candidates) == 0 && t.Header.Kid != "" && i.LocalKeys == nil && i.mayRefetch() {
+		// The token may be signed with a key the provider has rotated in
+		// since the JWKS was fetched.
+		if keys, err := i.refetchKeys(); err == nil {
+			candidates = matchingKeys(keys, t)
+		}
+	}
+	if len(candidates) == 0 {
+		return validationError(openid.ValidationErrorKidNotFound, http.StatusUnauthorized,
+			fmt.Sprintf("No signing key found for kid %q", t.Header.Kid), nil)
+	}
+
+	for _, k := range candidates {
+		if err = verifySignature(t.Header.Alg, k.Key, t.SigningInput, t.Signature); err == nil {
+			return nil
+		}
+	}
+	return validationError(openid.ValidationErrorJwtValidationFailure, http.StatusUnauthorized,
+		"The token signature is invalid", err)
+}
+
+// matchingKeys returns the keys the token may have been signed with.
+func matchingKeys(keys []publicKey, t *rawJWT) []publicKey {
+	var candidates []publicKey
+	for _, k := range keys {
+		// Keys without a kid, like the ones from PEM files, are tried for
+		// all tokens.
+		if t.Header.Kid != "" && k.Kid != "" && k.Kid != t.Header.Kid {
+			continue
+		}
+		if k.Alg != "" && k.Alg != t.Header.Alg {
+			continue
+		}
+		candidates = append(candidates, k)
+	}
+	return candidates
+}
+
+// mayRefetch reports whether the JWKS may be fetched again ahead of time,
+// and if so records that it is.
+func (i *issuerValidator) mayRefetch() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if time.Since(i.refetched) < jwksRefetchInterval {
+		return false
+	}
+	i.refetched = time.Now()
+	return true
+}
+
+// refetchKeys fetches the JWKS of the issuer again, bypassing the cache.
+func (i *issuerValidator) refetchKeys() ([]publicKey, error) {
+	doc, err := i.Discovery.Document()
+	if err != nil {
+		return nil, err
+	}
+	body, err := i.Cache.Refresh(doc.JwksURI)
+	if err != nil {
+		return nil, err
+	}
+	return i.parseKeys(body)
+}
+
+// signingKeys returns the keys in the JWKS of the issuer.
+func (i *issuerValidator) signingKeys() ([]publicKey, error) {
+	if i.LocalKeys != nil {
+		return i.LocalKeys.Keys()
+	}
+
+	doc, err := i.Discovery.Document()
+	if err != nil {
+		return nil, err
+	}
+	body, err := i.Cache.Get(doc.JwksURI)
+	if err != nil {
+		return nil, err
+	}
+	return i.parseKeys(body)
+}
+
+// parseKeys returns the keys in the JWKS. It is only parsed again when the
+// document changes.
+func (i *issuerValidator) parseKeys(body []byte) ([]publicKey, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.keys != nil && bytes.Equal(body, i.jwksBody) {
+		return i.keys, nil
+	}
+	keys, err := parseJWKS(body)
+	if err != nil {
+		return nil, err
+	}
+	i.jwksBody, i.keys = body, keys
+	return keys, nil
+}
+
+// validateAudience checks that the token was issued for one of the accepted
+// audiences. These are the configured audiences, or the client ids if no
+// audience is configured. The client ids are always accepted for ID tokens.
+func (i *issuerValidator) validateAudience(t *rawJWT, idToken bool) error {
+	if i.Provider.SkipAudienceCheck {
+		return nil
+	}
+	audiences := t.audiences()
+	if i.Provider.Profile == profileCognito {
+		audiences = cognitoAudiences(t)
+	} else if _, found := t.Claims["aud"]; !found {
+		return validationError(openid.ValidationErrorAudienceNotFound, http.StatusUnauthorized,
+			"The token does not contain the aud claim", nil)
+	}
+	if len(audiences) == 0 {
+		return validationError(openid.ValidationErrorInvalidAudienceType, http.StatusUnauthorized,
+			"The aud claim of the token is not a string or an array of strings", nil)
+	}
+
+	accepted := i.Provider.Audiences
+	if len(accepted) == 0 {
+		accepted = i.Provider.ClientIds
+	}
+	for _, aud := range audiences {
+		if containsString(accepted, aud) || idToken && containsString(i.Provider.ClientIds, aud) {
+			return nil
+		}
+	}
+	return validationError(openid.ValidationErrorInvalidAudience, http.StatusUnauthorized,
+		"The token was not issued for an accepted audience", nil)
+}
+
+// validateTimes checks the exp, nbf and iat claims if they are present,
+// tolerating a clock skew of leeway. With requireExp a token without exp
+// is rejected, it would never expire.
+func validateTimes(claims map[string]interface{}, now time.Time, leeway time.Duration, requireExp bool) error {
+	if _, found := claims["exp"]; found {
+		exp := claimTime(claims["exp"])
+		if exp.IsZero() || !now.Before(exp.Add(leeway)) {
+			return fmt.Errorf("The token is expired")
+		}
+	} else if requireExp {
+		return fmt.Errorf("The token does not contain the exp claim")
+	}
+	if _, found := claims["nbf"]; found {
+		nbf := claimTime(claims["nbf"])
+		if nbf.IsZero() || now.Add(leeway).Before(nbf) {
+			return fmt.Errorf("The token is not valid yet")
+		}
+	}
+	if _, found := claims["iat"]; found {
+		iat := claimTime(claims["iat"])
+		if iat.IsZero() || now.Add(leeway).Before(iat) {
+			return fmt.Errorf("The token is used before it was issued")
+		}
+	}
+	return nil
+}
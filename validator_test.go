@@ -0,0 +1,215 @@
+package openidauth
+
+import (
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestValidator returns a validator for two issuers whose keys are read
+// from a JWKS file, with the RSA key under the kid k1. The second issuer
+// accepts the audience orders instead of its client id.
+func newTestValidator(t *testing.T, key *rsa.PrivateKey) *tokenValidator {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "openidauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	jwks, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+	file := filepath.Join(dir, "jwks.json")
+	if err := ioutil.WriteFile(file, jwks, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return newTokenValidator([]providerConfig{
+		{Issuer: "https://issuer.example.com", ClientIds: []string{"web"}, JWKSFile: file},
+		{Issuer: "https://api.example.com", ClientIds: []string{"web"}, Audiences: []string{"orders"}, JWKSFile: file},
+	}, time.Minute, defaultAllowedAlgs, nil)
+}
+
+// testClaims returns the claims of a valid token, changed by the pairs of
+// names and values. A nil value removes the claim.
+func testClaims(changes ...interface{}) map[string]interface{} {
+	claims := map[string]interface{}{
+		"iss": "https://issuer.example.com",
+		"aud": "web",
+		"sub": "user",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for i := 0; i < len(changes); i += 2 {
+		name := changes[i].(string)
+		if changes[i+1] == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = changes[i+1]
+		}
+	}
+	return claims
+}
+
+// unsignedJWT creates an unsigned JWT with the header and the claims.
+func unsignedJWT(header, claims interface{}) string {
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	return base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+}
+
+func TestValidateToken(t *testing.T) {
+	rsaKey, ecKeys, _ := generateKeys(t)
+	otherKey, _, _ := generateKeys(t)
+	v := newTestValidator(t, rsaKey)
+
+	hs256 := func(claims map[string]interface{}) string {
+		input := unsignedJWT(jwtHeader{Alg: "HS256", Kid: "k1"}, claims)
+		mac := hmac.New(sha256.New, rsaKey.N.Bytes())
+		mac.Write([]byte(input))
+		return input + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+
+	// The claims are changed after signing.
+	signed := signJWT(t, "RS256", "k1", rsaKey, testClaims())
+	tampered := unsignedJWT(jwtHeader{Alg: "RS256", Kid: "k1"}, testClaims("sub", "admin")) + signed[strings.LastIndex(signed, "."):]
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"valid", signJWT(t, "RS256", "k1", rsaKey, testClaims()), true},
+		{"aud array", signJWT(t, "RS256", "k1", rsaKey, testClaims("aud", []string{"other", "web"})), true},
+		{"exp within leeway", signJWT(t, "RS256", "k1", rsaKey, testClaims("exp", time.Now().Add(-30*time.Second).Unix())), true},
+		{"configured audience", signJWT(t, "RS256", "k1", rsaKey, testClaims("iss", "https://api.example.com", "aud", "orders")), true},
+
+		// alg
+		{"alg none", unsignedJWT(jwtHeader{Alg: "none", Kid: "k1"}, testClaims()) + ".", false},
+		{"alg HS256 with the public key", hs256(testClaims()), false},
+		{"alg not allowed", signJWT(t, "PS256", "k1", rsaKey, testClaims()), false},
+		{"alg of another key family", signJWT(t, "ES256", "k1", ecKeys["ES256"], testClaims()), false},
+		{"signed with another key", signJWT(t, "RS256", "k1", otherKey, testClaims()), false},
+		{"signature of other claims", tampered, false},
+
+		// kid
+		{"unknown kid", signJWT(t, "RS256", "k2", rsaKey, testClaims()), false},
+
+		// aud
+		{"other aud", signJWT(t, "RS256", "k1", rsaKey, testClaims("aud", "other")), false},
+		{"missing aud", signJWT(t, "RS256", "k1", rsaKey, testClaims("aud", nil)), false},
+		{"aud not a string", signJWT(t, "RS256", "k1", rsaKey, testClaims("aud", 1)), false},
+		{"client id with configured audience", signJWT(t, "RS256", "k1", rsaKey, testClaims("iss", "https://api.example.com")), false},
+
+		// iss
+		{"unknown iss", signJWT(t, "RS256", "k1", rsaKey, testClaims("iss", "https://evil.example.com")), false},
+		{"missing iss", signJWT(t, "RS256", "k1", rsaKey, testClaims("iss", nil)), false},
+		{"iss not a string", signJWT(t, "RS256", "k1", rsaKey, testClaims("iss", 1)), false},
+
+		// exp and the other times
+		{"expired", signJWT(t, "RS256", "k1", rsaKey, testClaims("exp", time.Now().Add(-time.Hour).Unix())), false},
+		{"exp not a number", signJWT(t, "RS256", "k1", rsaKey, testClaims("exp", "tomorrow")), false},
+		{"missing exp", signJWT(t, "RS256", "k1", rsaKey, testClaims("exp", nil)), false},
+		{"not yet valid", signJWT(t, "RS256", "k1", rsaKey, testClaims("nbf", time.Now().Add(time.Hour).Unix())), false},
+		{"missing sub", signJWT(t, "RS256", "k1", rsaKey, testClaims("sub", nil)), false},
+		{"empty sub", signJWT(t, "RS256", "k1", rsaKey, testClaims("sub", "")), false},
+
+		// malformed
+		{"empty", "", false},
+		{"opaque", "opaque-token", false},
+		{"two segments", "eyJhbGciOiJSUzI1NiJ9.e30", false},
+		{"six segments", "a.b.c.d.e.f", false},
+		{"header not base64", "%%%.e30.c2ln", false},
+		{"header not JSON", base64.RawURLEncoding.EncodeToString([]byte("RS256")) + ".e30.c2ln", false},
+		{"claims not an object", unsignedJWT(jwtHeader{Alg: "RS256", Kid: "k1"}, []string{"sub"}) + ".c2ln", false},
+		{"signature not base64", unsignedJWT(jwtHeader{Alg: "RS256", Kid: "k1"}, testClaims()) + ".%%%", false},
+	}
+	for _, tt := range tests {
+		u, err := v.Validate(tt.token)
+		if tt.valid && (err != nil || u.ID != "user") {
+			t.Errorf("%s: valid token rejected: %v", tt.name, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%s: invalid token accepted", tt.name)
+		}
+	}
+
+	v.Issuers[0].Provider.AllowMissingExp = true
+	if _, err := v.Validate(signJWT(t, "RS256", "k1", rsaKey, testClaims("exp", nil))); err != nil {
+		t.Errorf("token without exp rejected with allow_missing_exp: %v", err)
+	}
+}
+
+func TestValidateIDTokenAudience(t *testing.T) {
+	rsaKey, _, _ := generateKeys(t)
+	v := newTestValidator(t, rsaKey)
+
+	// ID tokens are issued for the client, also where access tokens are
+	// issued for another audience.
+	token := signJWT(t, "RS256", "k1", rsaKey, testClaims("iss", "https://api.example.com"))
+	if _, err := v.ValidateIDToken(token); err != nil {
+		t.Errorf("ID token for the client id rejected: %v", err)
+	}
+	if _, err := v.Validate(token); err == nil {
+		t.Error("access token for the client id accepted with a configured audience")
+	}
+	token = signJWT(t, "RS256", "k1", rsaKey, testClaims("iss", "https://api.example.com", "aud", "other"))
+	if _, err := v.ValidateIDToken(token); err == nil {
+		t.Error("ID token for another audience accepted")
+	}
+}
+
+func TestHMACValidator(t *testing.T) {
+	secret := []byte(strings.Repeat("s", 48))
+	v := &hmacValidator{Secret: secret, Issuer: "https://auth.internal", Audience: "orders"}
+	sign := func(alg string, claims map[string]interface{}) string {
+		input := unsignedJWT(jwtHeader{Alg: alg}, claims)
+		mac := hmac.New(hashes[alg[2:]].New, secret)
+		mac.Write([]byte(input))
+		return input + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+	claims := func(changes ...interface{}) map[string]interface{} {
+		return testClaims(append([]interface{}{"iss", "https://auth.internal", "aud", "orders"}, changes...)...)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"valid", sign("HS256", claims()), true},
+		{"secret as long as the hash", sign("HS384", claims()), true},
+		{"secret shorter than the hash", sign("HS512", claims()), false},
+		{"other iss", sign("HS256", claims("iss", "https://other.internal")), false},
+		{"missing iss", sign("HS256", claims("iss", nil)), false},
+		{"other aud", sign("HS256", claims("aud", "billing")), false},
+		{"aud array", sign("HS256", claims("aud", []string{"billing", "orders"})), true},
+		{"missing exp", sign("HS256", claims("exp", nil)), false},
+	}
+	for _, tt := range tests {
+		_, err := v.Validate(tt.token)
+		if tt.valid && err != nil {
+			t.Errorf("%s: valid token rejected: %v", tt.name, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%s: invalid token accepted", tt.name)
+		}
+	}
+
+	v.OptionalExp = true
+	if _, err := v.Validate(sign("HS256", claims("exp", nil))); err != nil {
+		t.Errorf("token without exp rejected with exp=optional: %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package openidauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/emanoelxavier/openid2go/openid"
+)
+
+const defaultWebhookTimeout = 5 * time.Second
+
+// authzInput describes an authenticated request to an external
+// authorization service.
+type authzInput struct {
+	Method     string                 `json:"method"`
+	Path       string                 `json:"path"`
+	Query      string                 `json:"query,omitempty"`
+	Host       string                 `json:"host"`
+	RemoteAddr string                 `json:"remote_addr"`
+	Headers    map[string][]string    `json:"headers"`
+	Issuer     string                 `json:"issuer"`
+	Subject    string                 `json:"subject"`
+	Claims     map[string]interface{} `json:"claims"`
+}
+
+func newAuthzInput(r *http.Request, u *openid.User) *authzInput {
+	return &authzInput{
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Query:      r.URL.RawQuery,
+		Host:       r.Host,
+		RemoteAddr: r.RemoteAddr,
+		Headers:    requestHeaders(r),
+		Issuer:     u.Issuer,
+		Subject:    u.ID,
+		Claims:     u.Claims,
+	}
+}
+
+// requestHeaders returns the headers of the request without the ones that
+// carry credentials, which an authorization service has no business seeing.
+func requestHeaders(r *http.Request) map[string][]string {
+	headers := make(map[string][]string, len(r.Header))
+	for name, values := range r.Header {
+		switch name {
+		case "Authorization", "Proxy-Authorization", "Cookie":
+			continue
+		}
+		headers[name] = values
+	}
+	return headers
+}
+
+// authzWebhook asks an HTTP endpoint whether a request is allowed. The
+// endpoint receives the authzInput as JSON and answers with a 2xx status to
+// allow the request, or 401 or 403 to deny it. The body of a denial is used
+// as the error description. Headers are the response headers that are
+// passed on to the backend, they are removed from the requests of the
+// clients so they can't be forged.
+type authzWebhook struct {
+	URL     string
+	Headers []string
+	Client  *http.Client
+}
+
+func newAuthzWebhook(url string, timeout time.Duration, headers []string) *authzWebhook {
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+	canonical := make([]string, len(headers))
+	for i, h := range headers {
+		canonical[i] = http.CanonicalHeaderKey(h)
+	}
+	return &authzWebhook{URL: url, Headers: canonical, Client: &http.Client{Timeout: timeout}}
+}
+
+// removeHeaders deletes the headers the webhook can set from the request.
+func (w *authzWebhook) removeHeaders(r *http.Request) {
+	for _, name := range w.Headers {
+		r.Header.Del(name)
+	}
+}
+
+// authorize calls the webhook and copies its headers into the request if it
+// allows the request. It returns an authorizationError if the webhook denies
+// the request, or if it can't be called.
+func (w *authzWebhook) authorize(r *http.Request, u *openid.User) error {
+	unavailable := &authorizationError{
+		Code:        "temporarily_unavailable",
+		Description: "The authorization service is unavailable",
+		Unavailable: true,
+	}
+	body, err := json.Marshal(newAuthzInput(r, u))
+	if err != nil {
+		return unavailable
+	}
+	resp, err := w.Client.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return unavailable
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		io.Copy(ioutil.Discard, resp.Body)
+		for _, name := range w.Headers {
+			if values, ok := resp.Header[name]; ok {
+				r.Header[name] = values
+			}
+		}
+		return nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		reason, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		description := string(bytes.TrimSpace(reason))
+		if description == "" {
+			description = "The request is not allowed by the authorization service"
+		}
+		return &authorizationError{Description: description}
+	}
+	return unavailable
+}